@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// allowedNets are the networks the API accepts requests from, and
+// trustedProxies those whose X-Forwarded-For header is believed. Both are
+// empty unless configured. h2cNets are those which may use HTTP/2 without
+// TLS, loopback unless configured.
+var allowedNets, trustedProxies, h2cNets []*net.IPNet
+
+// parseCIDRs parses a comma separated list of CIDRs, where a bare address is
+// a network of its own.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client which made a request, nil for
+// requests over the Unix socket. Addresses in X-Forwarded-For are only
+// believed when added by a trusted proxy: the client is the last address
+// which isn't one, counting back from the peer.
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// a malformed entry can't be attributed, so stop at the
+			// last address known to be genuine
+			return ip
+		}
+		ip = hop
+		if !containsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// allowListHandler refuses requests from clients outside API_ALLOWED_CIDRS.
+// Requests over the Unix socket are always allowed, as access to it is
+// controlled by its file mode.
+func allowListHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ip := clientIP(req); ip != nil && !containsIP(allowedNets, ip) {
+			audit(origin{Source: ip.String()}, securityAuthzFailure, "allow_list", req.Method+" "+req.URL.Path, fmt.Errorf("client address is not allowed"))
+			httphelper.JSON(w, 403, httphelper.JSONError{
+				Code:    forbiddenCode,
+				Message: "the client address is not allowed to use the API",
+			})
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// h2cHandler refuses HTTP/2 requests without TLS from peers outside
+// API_H2C_CIDRS. The peer is the address connected to the API rather than
+// the client given in X-Forwarded-For, as h2c concerns the connection.
+// Requests over the Unix socket are always allowed.
+func h2cHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && req.TLS == nil {
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if ip := net.ParseIP(host); err == nil && ip != nil && !containsIP(h2cNets, ip) {
+				audit(origin{Source: ip.String()}, securityAuthzFailure, "h2c", req.Method+" "+req.URL.Path, fmt.Errorf("peer address may not use h2c"))
+				httphelper.JSON(w, 403, httphelper.JSONError{
+					Code:    forbiddenCode,
+					Message: "HTTP/2 without TLS is only allowed from trusted internal callers",
+				})
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var errArchiveNotFound = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "archive not found"}
+
+// archive is a deprovisioned resource's database, kept under an archive name
+// which nobody but the provider can connect to until it expires.
+type archive struct {
+	Database         string    `json:"database"`
+	OriginalDatabase string    `json:"original_database"`
+	ResourceID       string    `json:"resource_id"`
+	Region           string    `json:"region"`
+	App              string    `json:"app"`
+	Env              string    `json:"env"`
+	Tenant           string    `json:"tenant,omitempty"`
+	Tags             []string  `json:"tags"`
+	ArchivedBy       string    `json:"archived_by,omitempty"`
+	ArchivedAt       time.Time `json:"archived_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+// archiveColumns selects an archive, with $1 being the main backend's
+// region.
+const archiveColumns = `database, original_database, resource_id, coalesce(region, $1), app, env, coalesce(tenant, ''), tags, coalesce(archived_by, ''), archived_at, expires_at`
+
+func scanArchive(s scanner) (*archive, error) {
+	a := &archive{}
+	if err := s.Scan(&a.Database, &a.OriginalDatabase, &a.ResourceID, &a.Region, &a.App, &a.Env, &a.Tenant, &a.Tags, &a.ArchivedBy, &a.ArchivedAt, &a.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// archiveResource deprovisions a resource but keeps its data: the database
+// is handed to the provider and renamed to archive_<random>, its roles are
+// dropped so nobody else can connect, and it is recorded in the archives
+// table until retention lapses. Snapshots and replication slots aren't
+// kept. Progress is logged to run when it's done as a job.
+func archiveResource(state *postgres.DB, r *resourceRef, retention time.Duration, requester string, run *jobRun) (err error) {
+	start := time.Now()
+	defer func() { recordOperation(state, "archive", start, err) }()
+	if r.UUID != "" {
+		if err := setStatus(state, r.UUID, statusDeleting, ""); err != nil {
+			return err
+		}
+	}
+	name := "archive_" + random.Hex(12)
+	if err := archiveDatabase(state, r, name, run); err != nil {
+		if r.UUID != "" {
+			setStatus(state, r.UUID, statusFailed, err.Error())
+		}
+		return err
+	}
+
+	tx, err := state.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// legacy resources aren't in the state database, so have no details
+	if err := tx.Exec(`
+INSERT INTO archives (database, original_database, resource_id, region, app, env, tenant, tags, archived_by, expires_at)
+SELECT $1, $2, $3, r.region, coalesce(r.app, ''), coalesce(r.env, ''), r.tenant, coalesce(r.tags, '{}'), nullif($4, ''), now() + make_interval(secs => $5)
+FROM (SELECT 1) AS one LEFT JOIN resources r ON r.uuid::text = $6`,
+		name, r.Database, r.id(), requester, retention.Seconds(), r.UUID); err != nil {
+		return err
+	}
+	if err := tx.Exec(`DELETE FROM resources WHERE database = $1`, r.Database); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	run.stage("state_removed", "recorded %s as archive %s", r.id(), name)
+	return nil
+}
+
+func archiveDatabase(state *postgres.DB, r *resourceRef, name string, run *jobRun) error {
+	b, database := r.Backend, r.Database
+	if err := b.checkPrimary(); err != nil {
+		return err
+	}
+	if err := dropSnapshots(state, r); err != nil {
+		return err
+	}
+	if err := dropDatabaseSlots(b, database); err != nil {
+		return err
+	}
+
+	// the roles which may own objects in the database, or have privileges
+	// on it, and still exist
+	owners := []string{r.Username}
+	if r.UUID != "" {
+		var rotated string
+		if err := state.QueryRow(`SELECT new_username FROM rotations WHERE resource = $1`, r.UUID).Scan(&rotated); err == nil {
+			owners = append(owners, rotated)
+		} else if err != pgx.ErrNoRows {
+			return err
+		}
+	}
+	ro, rw := accessRoleNames(database)
+	roles, err := backendRoles(b)
+	if err != nil {
+		return err
+	}
+	var owned []string
+	for _, role := range owners {
+		if _, ok := roles[role]; ok {
+			owned = append(owned, role)
+		}
+	}
+	all := append([]string{}, owned...)
+	for _, role := range append([]string{ro, rw}, memberUsernames(database)...) {
+		if _, ok := roles[role]; ok {
+			all = append(all, role)
+		}
+	}
+
+	// a paused database has to accept connections again to be handed over
+	if err := b.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" ALLOW_CONNECTIONS true`, database)); err != nil {
+		return err
+	}
+	if err := revokeAccess(b, database, owned, all); err != nil {
+		return err
+	}
+	run.stage("access_revoked", "revoked access to database %s", database)
+
+	if err := b.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" ALLOW_CONNECTIONS false`, database)); err != nil {
+		return err
+	}
+	if err := b.db.Exec(disconnectConns, database); err != nil {
+		return err
+	}
+	run.stage("connections_terminated", "terminated connections to database %s", database)
+	if err := b.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" RENAME TO "%s"`, database, name)); err != nil {
+		return err
+	}
+	run.stage("database_archived", "renamed database %s to %s on backend %s", database, name, b.name)
+
+	if err := dropAccessRoles(b, database); err != nil {
+		return err
+	}
+	if err := dropPublicationRoles(state, r); err != nil {
+		return err
+	}
+	for _, role := range owners {
+		if err := b.db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, role)); err != nil {
+			return err
+		}
+	}
+	run.stage("role_dropped", "dropped role %s", r.Username)
+	return nil
+}
+
+// revokeAccess hands everything in a database owned by owners to the
+// provider, then revokes the remaining privileges of roles, including those
+// on the database itself.
+func revokeAccess(b *backend, database string, owners, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(owners) > 0 {
+		if _, err := conn.Exec(fmt.Sprintf(`REASSIGN OWNED BY "%s" TO "%s"`, strings.Join(owners, `", "`), serviceUser)); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Exec(fmt.Sprintf(`DROP OWNED BY "%s"`, strings.Join(roles, `", "`)))
+	return err
+}
+
+// dropArchive drops an archived database and forgets it.
+func dropArchive(state *postgres.DB, b *backend, name string) error {
+	caps := b.get()
+	if err := dropBackendDatabase(b, name, caps != nil && caps.DropForce); err != nil {
+		return err
+	}
+	return state.Exec(`DELETE FROM archives WHERE database = $1`, name)
+}
+
+// getArchives lists the archived databases, oldest first.
+func (p *pgAPI) getArchives(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	rows, err := p.state.Query(`SELECT `+archiveColumns+` FROM archives WHERE $2 = '' OR tenant = $2 ORDER BY archived_at`, p.backend.region, callerTenant(ctx))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	archives := []*archive{}
+	for rows.Next() {
+		a, err := scanArchive(rows)
+		if err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		archives = append(archives, a)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, archives)
+}
+
+// deleteArchive drops an archived database before it expires.
+func (p *pgAPI) deleteArchive(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	a, err := scanArchive(p.state.QueryRow(`SELECT `+archiveColumns+` FROM archives WHERE database = $2 AND ($3 = '' OR tenant = $3)`,
+		p.backend.region, params.ByName("name"), callerTenant(ctx)))
+	if err == pgx.ErrNoRows {
+		err = errArchiveNotFound
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	b, ok := p.backends.lookupRegion(w, a.Region)
+	if !ok {
+		return
+	}
+	if err := b.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	err = dropArchive(p.state, b, a.Database)
+	audit(requestOrigin(ctx, req), securityDestructive, "delete_archive", a.Database, err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// expireArchives drops the archived databases whose retention has lapsed,
+// checked along with the expiry of resources.
+func expireArchives(state *postgres.DB, backends *backendSet) error {
+	rows, err := state.Query(`SELECT `+archiveColumns+` FROM archives WHERE expires_at <= now()`, backends.main.region)
+	if err != nil {
+		return err
+	}
+	var expired []*archive
+	for rows.Next() {
+		a, err := scanArchive(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, a := range expired {
+		region := a.Region
+		b, err := backends.forRegion(&region)
+		if err == nil {
+			err = b.checkPrimary()
+		}
+		if err == nil {
+			err = dropArchive(state, b, a.Database)
+		}
+		audit(origin{}, securityDestructive, "expire_archive", a.Database, err)
+		if err != nil {
+			logger.Error("error dropping expired archive", "database", a.Database, "err", err)
+			continue
+		}
+		logger.Info("dropped expired archive", "database", a.Database, "original_database", a.OriginalDatabase)
+		notify("archive.expired", map[string]interface{}{
+			"database":          a.Database,
+			"original_database": a.OriginalDatabase,
+			"resource_id":       a.ResourceID,
+		})
+	}
+	return nil
+}
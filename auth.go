@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errUnauthenticated = httphelper.JSONError{Code: httphelper.UnauthorizedErrorCode, Message: "a valid API key is required"}
+	errAPIKeyNotFound  = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "API key not found"}
+)
+
+// unauthenticatedPaths are served without an API key, for health checks.
+var unauthenticatedPaths = map[string]bool{
+	"/ping":   true,
+	"/readyz": true,
+}
+
+// caller is the API key a request was authenticated with. Keys bound to a
+// tenant only see that tenant's resources, other keys are admin keys. Role
+// limits what the key may do.
+type caller struct {
+	KeyID  string
+	Name   string
+	Tenant string
+	Role   string
+}
+
+// admin reports whether the caller may act on every resource, which is
+// always the case when authentication is disabled.
+func (c *caller) admin() bool {
+	return c == nil || c.Tenant == ""
+}
+
+// sees reports whether the caller may act on a resource owned by tenant.
+func (c *caller) sees(tenant string) bool {
+	return c.admin() || c.Tenant == tenant
+}
+
+// callerTenant returns the tenant the caller is scoped to, empty for admin
+// keys.
+func callerTenant(ctx context.Context) string {
+	if c := callerFromContext(ctx); c != nil {
+		return c.Tenant
+	}
+	return ""
+}
+
+type callerKey struct{}
+
+// callerFromContext returns the caller of the request, nil when
+// authentication is disabled.
+func callerFromContext(ctx context.Context) *caller {
+	c, _ := ctx.Value(callerKey{}).(*caller)
+	return c
+}
+
+// requestKey returns the API key of a request, given as a bearer token or
+// as the password of basic authentication, which Flynn uses when the key is
+// part of the provider URL.
+func requestKey(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	_, password, _ := req.BasicAuth()
+	return password
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the caller with the given API key, or JWT when OIDC
+// is configured. API_ADMIN_KEY is an admin operator key which isn't stored,
+// to create the first keys with.
+func authenticate(state *postgres.DB, key string) (*caller, error) {
+	if key == "" {
+		return nil, errUnauthenticated
+	}
+	if oidc != nil && isJWT(key) {
+		c, err := oidc.verify(key)
+		if err != nil {
+			return nil, httphelper.JSONError{Code: httphelper.UnauthorizedErrorCode, Message: "invalid token: " + err.Error()}
+		}
+		return c, nil
+	}
+	if apiAdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(apiAdminKey)) == 1 {
+		return &caller{Role: roleOperator}, nil
+	}
+	c := &caller{}
+	err := state.QueryRow(`SELECT id, name, coalesce(tenant, ''), role FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`, hashKey(key)).Scan(&c.KeyID, &c.Name, &c.Tenant, &c.Role)
+	if err == pgx.ErrNoRows {
+		return nil, errUnauthenticated
+	}
+	return c, err
+}
+
+// authHandler requires requests to carry a valid API key, and passes the
+// caller on to the handlers in the request context.
+func authHandler(state *postgres.DB, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if unauthenticatedPaths[req.URL.Path] {
+			h.ServeHTTP(w, req)
+			return
+		}
+		rw := w.(*httphelper.ResponseWriter)
+		if crossOrigin(req) {
+			audit(requestOrigin(rw.Context(), req), securityAuthzFailure, "cross_origin", req.Method+" "+req.URL.Path, fmt.Errorf("request from origin %s", req.Header.Get("Origin")))
+			httphelper.JSON(w, 403, httphelper.JSONError{
+				Code:    forbiddenCode,
+				Message: "cross-origin requests are not allowed",
+			})
+			return
+		}
+		c, err := authenticate(state, requestKey(req))
+		if err != nil {
+			if e, ok := err.(httphelper.JSONError); ok && e.Code == httphelper.UnauthorizedErrorCode {
+				audit(requestOrigin(rw.Context(), req), securityAuthFailure, "authenticate", req.Method+" "+req.URL.Path, err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="pg-external"`)
+				// lets browsers prompt for a key to load the dashboard with
+				w.Header().Add("WWW-Authenticate", `Basic realm="pg-external"`)
+			}
+			httphelper.Error(w, err)
+			return
+		}
+		h.ServeHTTP(httphelper.NewResponseWriter(rw, context.WithValue(rw.Context(), callerKey{}, c)), req)
+	})
+}
+
+type apiKeyRequest struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant"`
+	Admin  bool   `json:"admin"`
+	Role   string `json:"role"`
+}
+
+// apiKey is an API key, whose secret is only returned when it is created
+// since only its hash is stored.
+type apiKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Tenant    *string    `json:"tenant"`
+	Role      string     `json:"role"`
+	Key       string     `json:"key,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// createAPIKey creates an API key with a role, bound to a tenant or an admin
+// key.
+func (p *pgAPI) createAPIKey(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var config apiKeyRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.Name == "" {
+		httphelper.ValidationError(w, "name", "must be set")
+		return
+	}
+	switch {
+	case config.Admin && config.Tenant != "":
+		httphelper.ValidationError(w, "tenant", "must not be set for admin keys")
+		return
+	case !config.Admin && !validTenant.MatchString(config.Tenant):
+		httphelper.ValidationError(w, "tenant", "must be set to lowercase letters, digits, dashes and underscores, or admin to true")
+		return
+	}
+	if _, ok := rolePermissions[config.Role]; !ok {
+		httphelper.ValidationError(w, "role", "must be one of viewer, provisioner, operator")
+		return
+	}
+	k := &apiKey{ID: random.UUID(), Name: config.Name, Role: config.Role, Key: "pgx_" + random.Hex(24)}
+	if !config.Admin {
+		k.Tenant = &config.Tenant
+	}
+	err := p.state.QueryRow(`INSERT INTO api_keys (id, name, tenant, role, key_hash) VALUES ($1, $2, $3, $4, $5) RETURNING created_at`,
+		k.ID, k.Name, k.Tenant, k.Role, hashKey(k.Key)).Scan(&k.CreatedAt)
+	audit(requestOrigin(ctx, req), securityAdmin, "create_api_key", k.ID, err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 201, k)
+}
+
+// listAPIKeys lists the API keys, without their secrets.
+func (p *pgAPI) listAPIKeys(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	rows, err := p.state.Query(`SELECT id, name, tenant, role, created_at, revoked_at FROM api_keys ORDER BY created_at`)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	keys := []*apiKey{}
+	for rows.Next() {
+		k := &apiKey{}
+		if err := rows.Scan(&k.ID, &k.Name, &k.Tenant, &k.Role, &k.CreatedAt, &k.RevokedAt); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, keys)
+}
+
+// revokeAPIKey stops an API key from authenticating.
+func (p *pgAPI) revokeAPIKey(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	id := params.ByName("id")
+	if !uuidPattern.MatchString(id) {
+		httphelper.Error(w, errAPIKeyNotFound)
+		return
+	}
+	var revoked bool
+	err := p.state.QueryRow(`UPDATE api_keys SET revoked_at = coalesce(revoked_at, now()) WHERE id = $1 RETURNING true`, strings.ToLower(id)).Scan(&revoked)
+	if err == pgx.ErrNoRows {
+		httphelper.Error(w, errAPIKeyNotFound)
+		return
+	}
+	audit(requestOrigin(ctx, req), securityAdmin, "revoke_api_key", id, err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var errStandby = httphelper.JSONError{
+	Code:    httphelper.ServiceUnavailableErrorCode,
+	Message: "the backend server is a standby (in recovery), refusing to run DDL until the primary is reachable",
+	Retry:   true,
+}
+
+// minServerVersion is the oldest PostgreSQL release the provider supports.
+const minServerVersion = 90600
+
+// capabilities describes the backend server and the optional features it
+// supports.
+type capabilities struct {
+	Version            string    `json:"version"`
+	VersionNum         int       `json:"version_num"`
+	DropForce          bool      `json:"drop_force"`
+	ICULocales         bool      `json:"icu_locales"`
+	SCRAM              bool      `json:"scram"`
+	PasswordEncryption string    `json:"password_encryption"`
+	StatStatements     bool      `json:"pg_stat_statements"`
+	CheckedAt          time.Time `json:"checked_at"`
+}
+
+// backend is the server databases are provisioned on. Its capabilities are
+// kept up to date since the server may be upgraded or reconfigured
+// underneath the provider, and with DISCOVERY its address follows the
+// primary as the cluster topology changes.
+type backend struct {
+	name     string
+	region   string
+	db       *postgres.DB
+	discover discoverFunc
+
+	// appHost and appPort are given to apps instead of the current address
+	// when set, typically a DNS name or proxy which follows the primary
+	appHost string
+	appPort string
+
+	mtx      sync.RWMutex
+	host     string
+	port     string
+	caps     *capabilities
+	capacity *capacity
+	conn     connectivity
+}
+
+func newBackend(name, region, host, port string, discover discoverFunc) (*backend, error) {
+	b := &backend{name: name, region: region, discover: discover, host: host, port: port, appHost: host, appPort: port}
+	if discover != nil {
+		var err error
+		if b.host, b.port, err = discover(); err != nil {
+			return nil, fmt.Errorf("error discovering backend in region %s: %s", region, err)
+		}
+		logger.Info("discovered backend", "region", region, "addr", net.JoinHostPort(b.host, b.port))
+	}
+	// Don't use Wait wrapper, establish conn directly and wrap in DB
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: b.connConfig("postgres")})
+	if err != nil {
+		return nil, err
+	}
+	b.db = postgres.New(pool, nil)
+	if err := b.refresh(); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	if v := b.get().VersionNum; v < minServerVersion {
+		pool.Close()
+		return nil, fmt.Errorf("unsupported PostgreSQL version %d, at least %d is required", v, minServerVersion)
+	}
+	return b, nil
+}
+
+func (b *backend) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := b.refresh(); err != nil {
+			logger.Error("error checking backend capabilities", "region", b.region, "err", err)
+		}
+	}
+}
+
+// watch periodically repeats discovery, moving to the new primary when its
+// address changes.
+func (b *backend) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := b.rediscover(); err != nil {
+			logger.Error("error discovering backend", "region", b.region, "err", err)
+		}
+	}
+}
+
+// rediscover looks up the primary again and, if it has moved, resets the
+// pool so that new connections are made to the new address.
+func (b *backend) rediscover() error {
+	host, port, err := b.discover()
+	if err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	moved := host != b.host || port != b.port
+	if moved {
+		logger.Info("backend moved", "region", b.region, "from", net.JoinHostPort(b.host, b.port), "to", net.JoinHostPort(host, port))
+		b.host, b.port = host, port
+	}
+	b.mtx.Unlock()
+	if moved {
+		b.db.Reset()
+	}
+	return nil
+}
+
+// addr returns the address the provider currently connects to.
+func (b *backend) addr() (host, port string) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.host, b.port
+}
+
+// appAddr returns the address apps are given to connect to.
+func (b *backend) appAddr() (host, port string) {
+	if b.appHost != "" {
+		return b.appHost, b.appPort
+	}
+	return b.addr()
+}
+
+func (b *backend) refresh() (err error) {
+	defer func() { b.record(err) }()
+	caps := &capabilities{CheckedAt: time.Now()}
+	if err := b.db.QueryRow(`SELECT current_setting('server_version'), current_setting('server_version_num')::integer, current_setting('password_encryption')`).Scan(
+		&caps.Version, &caps.VersionNum, &caps.PasswordEncryption); err != nil {
+		return err
+	}
+	caps.DropForce = caps.VersionNum >= 130000
+	caps.SCRAM = caps.VersionNum >= 100000
+	if caps.VersionNum >= 100000 {
+		if err := b.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_collation WHERE collprovider = 'i')`).Scan(&caps.ICULocales); err != nil {
+			return err
+		}
+	}
+	if err := b.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_stat_statements')`).Scan(&caps.StatStatements); err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	b.caps = caps
+	b.mtx.Unlock()
+	return nil
+}
+
+func (b *backend) get() *capabilities {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.caps
+}
+
+func (b *backend) getCapacity() *capacity {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.capacity
+}
+
+func (b *backend) setCapacity(c *capacity) {
+	b.mtx.Lock()
+	b.capacity = c
+	b.mtx.Unlock()
+}
+
+// isConnError reports whether err indicates a broken connection to the
+// backend rather than an error returned by the server.
+func isConnError(err error) bool {
+	if err == pgx.ErrDeadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// checkPrimary verifies that the backend accepts writes before running DDL.
+// PGHOST may be a DNS name which moves to a new primary on failover, so on
+// connection errors or when connected to a standby the pool is reset, making
+// new connections resolve the name (or repeat discovery) again.
+func (b *backend) checkPrimary() (err error) {
+	defer func() { b.record(err) }()
+	var recovery bool
+	err = b.db.QueryRow(`SELECT pg_is_in_recovery()`).Scan(&recovery)
+	if err != nil && isConnError(err) {
+		logger.Warn("lost connection to backend, reconnecting", "region", b.region, "err", err)
+		b.reconnect()
+		err = b.db.QueryRow(`SELECT pg_is_in_recovery()`).Scan(&recovery)
+	}
+	if err != nil {
+		return err
+	}
+	if recovery {
+		logger.Warn("backend is in recovery, reconnecting", "region", b.region)
+		b.reconnect()
+		return errStandby
+	}
+	return nil
+}
+
+func (b *backend) reconnect() {
+	if b.discover != nil {
+		if err := b.rediscover(); err != nil {
+			logger.Error("error discovering backend", "region", b.region, "err", err)
+		}
+	}
+	b.db.Reset()
+}
+
+type serverResponse struct {
+	*capabilities
+	Capacity            *capacity `json:"capacity,omitempty"`
+	ManagedDatabases    int       `json:"managed_databases"`
+	MaxManagedDatabases int       `json:"max_managed_databases,omitempty"`
+}
+
+// getServer returns the capabilities and capacity of the main backend, or of
+// the backend for the given region.
+func (p *pgAPI) getServer(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	b := p.backend
+	if region := req.FormValue("region"); region != "" {
+		var ok bool
+		if b, ok = p.backends.lookupRegion(w, region); !ok {
+			return
+		}
+	}
+	managed, err := managedDatabases(p.state, p.backends.main.region, b.region)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &serverResponse{
+		capabilities:        b.get(),
+		Capacity:            b.getCapacity(),
+		ManagedDatabases:    managed,
+		MaxManagedDatabases: maxManagedDatabases,
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"golang.org/x/net/context"
+)
+
+var errBulkChanged = httphelper.JSONError{
+	Code:    httphelper.ConflictErrorCode,
+	Message: "the resources matching the filter have changed since the dry run, repeat it and confirm the new result",
+}
+
+type bulkMatch struct {
+	ID        string    `json:"id"`
+	Database  string    `json:"database"`
+	Tags      []string  `json:"tags"`
+	CreatedAt time.Time `json:"created_at"`
+
+	ref *resourceRef
+}
+
+type bulkDryRun struct {
+	Matched []*bulkMatch `json:"matched"`
+	Confirm string       `json:"confirm"`
+}
+
+// bulkDelete deprovisions every resource matching ?tag= (repeatable, all
+// must match), ?older_than= and ?region=. Without ?confirm= it is a dry run
+// listing the matches along with a token which has to be passed back as
+// ?confirm= to delete them, and which is only accepted while the filter
+// still matches exactly the same resources. With ?async=true the confirmed
+// deletion runs as a purge job. Tenant scoped API keys only match their
+// tenant's resources.
+func (p *pgAPI) bulkDelete(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	tags := req.Form["tag"]
+	if err := validateTags(tags); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var olderThan float64
+	if s := req.FormValue("older_than"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			httphelper.ValidationError(w, "older_than", "is invalid")
+			return
+		}
+		olderThan = d.Seconds()
+	}
+	region := req.FormValue("region")
+	if len(tags) == 0 && olderThan == 0 && region == "" {
+		httphelper.ValidationError(w, "id", "or a filter (tag, older_than, region) must be set")
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	tenant := callerTenant(ctx)
+
+	rows, err := p.state.Query(`
+SELECT uuid, username, database, region, tags, created_at, coalesce(tenant, '') FROM resources
+WHERE tags @> $1
+  AND ($2 = 0 OR created_at < now() - make_interval(secs => $2))
+  AND ($3 = '' OR coalesce(region, $4) = $3)
+  AND ($5 = '' OR tenant = $5)
+ORDER BY uuid`, tags, olderThan, region, p.backend.region, tenant)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	matched := []*bulkMatch{}
+	for rows.Next() {
+		m := &bulkMatch{ref: &resourceRef{}}
+		var region *string
+		if err := rows.Scan(&m.ref.UUID, &m.ref.Username, &m.ref.Database, &region, &m.Tags, &m.CreatedAt, &m.ref.Tenant); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		if m.ref.Backend, err = p.backends.forRegion(region); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		m.ID, m.Database = resourceID(m.ref.UUID), m.ref.Database
+		matched = append(matched, m)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	token := bulkToken(req.Form, matched)
+	confirm := req.FormValue("confirm")
+	if confirm == "" {
+		httphelper.JSON(w, 200, &bulkDryRun{Matched: matched, Confirm: token})
+		return
+	}
+	if confirm != token {
+		httphelper.Error(w, errBulkChanged)
+		return
+	}
+
+	refs := make([]*resourceRef, len(matched))
+	for i, m := range matched {
+		refs[i] = m.ref
+	}
+	filter := bulkFilter(req.Form)
+	if tenant != "" {
+		filter += "&tenant=" + tenant
+	}
+	source := requestOrigin(ctx, req)
+	refs, scheduled, err := p.scheduleDrops(refs, source, req)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	done := func(res *destroyResult, err error) {
+		res.Scheduled = scheduled
+		audit(source, securityDestructive, "bulk_deprovision", filter, err)
+		logger.Info("bulk deprovisioned resources", "filter", filter, "deleted", len(res.Deleted), "failed", len(res.Failed))
+		notify("resources.bulk_deleted", map[string]interface{}{
+			"filter":    filter,
+			"deleted":   res.Deleted,
+			"failed":    res.Failed,
+			"requester": source.Requester,
+		})
+	}
+	if async, _ := strconv.ParseBool(req.FormValue("async")); async {
+		j, _, err := p.jobs.start("purge", filter, tenant, source.Requester, purgeBackend(refs), func(run *jobRun) error {
+			res, err := purge(p.state, refs, run)
+			done(res, err)
+			return err
+		})
+		if err != nil {
+			jobError(w, err)
+			return
+		}
+		acceptJob(w, j)
+		return
+	}
+	res, err := purge(p.state, refs, nil)
+	done(res, err)
+	httphelper.JSON(w, 200, res)
+}
+
+// scheduleDrops defers deprovisioning those of refs outside their
+// maintenance window to the window's next opening, like a single
+// deprovision, and returns the rest, which are to be deprovisioned now.
+func (p *pgAPI) scheduleDrops(refs []*resourceRef, source origin, req *http.Request) ([]*resourceRef, []*scheduledOperation, error) {
+	var now []*resourceRef
+	var scheduled []*scheduledOperation
+	for _, r := range refs {
+		op, err := p.schedule(r, "deprovision", source, &scheduledDrop{Retain: archiveRetention.String()}, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		if op != nil {
+			scheduled = append(scheduled, op)
+			continue
+		}
+		now = append(now, r)
+	}
+	return now, scheduled, nil
+}
+
+// purgeBackend returns the name of the backend all of refs are on, or ""
+// if they are on several, for scheduling a purge of them.
+func purgeBackend(refs []*resourceRef) string {
+	var name string
+	for i, r := range refs {
+		if i > 0 && r.Backend.name != name {
+			return ""
+		}
+		name = r.Backend.name
+	}
+	return name
+}
+
+// purge deprovisions resources one at a time, failing if any of them could
+// not be deprovisioned. When run as a job, each one is logged and the job can
+// be cancelled between them.
+func purge(state *postgres.DB, refs []*resourceRef, run *jobRun) (*destroyResult, error) {
+	res := &destroyResult{Deleted: []string{}}
+	for _, r := range refs {
+		if err := run.cancelled(); err != nil {
+			return res, err
+		}
+		if err := deprovision(state, r, run); err != nil {
+			if res.Failed == nil {
+				res.Failed = make(map[string]string)
+			}
+			res.Failed[r.id()] = err.Error()
+			logger.Error("error deprovisioning resource", "database", r.Database, "err", err)
+			run.logf("error deprovisioning %s: %s", r.id(), err)
+			continue
+		}
+		res.Deleted = append(res.Deleted, r.id())
+	}
+	if len(res.Failed) > 0 {
+		return res, fmt.Errorf("%d of %d resources could not be deprovisioned", len(res.Failed), len(refs))
+	}
+	return res, nil
+}
+
+// bulkFilter returns a canonical description of the filter parameters.
+func bulkFilter(form map[string][]string) string {
+	tags := append([]string(nil), form["tag"]...)
+	sort.Strings(tags)
+	var older, region string
+	if v := form["older_than"]; len(v) > 0 {
+		older = v[0]
+	}
+	if v := form["region"]; len(v) > 0 {
+		region = v[0]
+	}
+	return "tag=" + strings.Join(tags, ",") + "&older_than=" + older + "&region=" + region
+}
+
+// bulkToken identifies a filter and the exact set of resources it matched.
+func bulkToken(form map[string][]string, matched []*bulkMatch) string {
+	h := sha256.New()
+	h.Write([]byte(bulkFilter(form)))
+	for _, m := range matched {
+		h.Write([]byte("\n" + m.ref.UUID))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+// canaryTag marks the databases provisioned by the canary.
+const canaryTag = "canary"
+
+// canary periodically goes through the whole provisioning path on every
+// backend: it provisions a database, connects to it with the issued
+// credentials, writes and reads back a row, and deprovisions it.
+type canary struct {
+	api      *pgAPI
+	interval time.Duration
+
+	mtx     sync.RWMutex
+	results map[string]*canaryResult
+}
+
+type canaryResult struct {
+	Region   string         `json:"region"`
+	Backend  string         `json:"backend"`
+	OK       bool           `json:"ok"`
+	Error    string         `json:"error,omitempty"`
+	Duration float64        `json:"duration_seconds"`
+	Time     time.Time      `json:"time"`
+	Stages   []*canaryStage `json:"stages"`
+}
+
+// canaryStage is a step of a canary run, which stops at the first failing
+// step other than deprovisioning.
+type canaryStage struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func newCanary(api *pgAPI, interval time.Duration) *canary {
+	return &canary{api: api, interval: interval, results: make(map[string]*canaryResult)}
+}
+
+func (c *canary) run() {
+	for {
+		for _, b := range c.api.backends.all() {
+			c.check(b)
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+func (c *canary) check(b *backend) {
+	res := c.cycle(b)
+	if !res.OK {
+		logger.Error("canary failed", "backend", b.name, "region", b.region, "err", res.Error)
+	}
+	c.mtx.Lock()
+	c.results[b.region] = res
+	c.mtx.Unlock()
+}
+
+// cycle runs the canary once on a backend, timing each stage.
+func (c *canary) cycle(b *backend) *canaryResult {
+	res := &canaryResult{Region: b.region, Backend: b.name, Time: time.Now(), Stages: []*canaryStage{}}
+	stage := func(name string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		s := &canaryStage{Name: name, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			s.Error = redact(err.Error())
+		}
+		res.Stages = append(res.Stages, s)
+		return err
+	}
+
+	var r *resourceResponse
+	err := stage("provision", func() error {
+		if err := b.checkPrimary(); err != nil {
+			return err
+		}
+		var err error
+		r, err = c.api.provision(b, &provisionSpec{App: canaryTag, Tags: []string{canaryTag}, Comment: "provider self-test"})
+		return err
+	})
+	if err == nil {
+		err = canaryQuery(b, r.username, r.password, r.database, stage)
+		ref := &resourceRef{UUID: r.Meta.UUID, Username: r.username, Database: r.database, Backend: b}
+		if dropErr := stage("deprovision", func() error { return deprovision(c.api.state, ref, nil) }); err == nil {
+			err = dropErr
+		}
+	}
+
+	res.OK = err == nil
+	res.Duration = time.Since(res.Time).Seconds()
+	for _, s := range res.Stages {
+		if s.Error != "" {
+			res.Error = fmt.Sprintf("%s: %s", s.Name, s.Error)
+			break
+		}
+	}
+	return res
+}
+
+// canaryQuery connects to a database with the given credentials and writes
+// and reads back a row, running each step as a stage.
+func canaryQuery(b *backend, username, password, database string, stage func(string, func() error) error) error {
+	conf := b.connConfig(database)
+	conf.User, conf.Password = username, password
+	var conn *pgx.Conn
+	if err := stage("connect", func() (err error) {
+		conn, err = pgx.Connect(conf)
+		return err
+	}); err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := stage("create_table", func() error {
+		_, err := conn.Exec(`CREATE TABLE canary (value text NOT NULL)`)
+		return err
+	}); err != nil {
+		return err
+	}
+	value := random.Hex(8)
+	if err := stage("write", func() error {
+		_, err := conn.Exec(`INSERT INTO canary (value) VALUES ($1)`, value)
+		return err
+	}); err != nil {
+		return err
+	}
+	return stage("read", func() error {
+		var read string
+		if err := conn.QueryRow(`SELECT value FROM canary`).Scan(&read); err != nil {
+			return err
+		}
+		if read != value {
+			return fmt.Errorf("read %q instead of %q", read, value)
+		}
+		return nil
+	})
+}
+
+// status returns the latest result for each backend, and whether they all
+// passed recently. A backend without a result, or whose result is older than
+// three intervals, is not ready.
+func (c *canary) status() ([]*canaryResult, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	ready := true
+	var results []*canaryResult
+	for _, b := range c.api.backends.all() {
+		res, ok := c.results[b.region]
+		if !ok {
+			ready = false
+			continue
+		}
+		ready = ready && res.OK && time.Since(res.Time) < 3*c.interval+time.Minute
+		results = append(results, res)
+	}
+	return results, ready
+}
+
+const (
+	readyOK          = "ok"
+	readyDegraded    = "degraded"
+	readyUnavailable = "unavailable"
+)
+
+var readyStatuses = []string{readyOK, readyDegraded, readyUnavailable}
+
+var readySeverity = map[string]int{readyOK: 0, readyDegraded: 1, readyUnavailable: 2}
+
+type readiness struct {
+	Ready bool `json:"ready"`
+	// Status is ok, degraded while the provider serves requests but a
+	// backend is failing, or unavailable.
+	Status   string              `json:"status"`
+	Error    string              `json:"error,omitempty"`
+	Backends []*backendReadiness `json:"backends"`
+	Canary   []*canaryResult     `json:"canary,omitempty"`
+}
+
+type backendReadiness struct {
+	Name   string `json:"name"`
+	Region string `json:"region"`
+	connectivity
+}
+
+// worsen sets the status, and the error explaining it, unless the status is
+// already as bad.
+func (r *readiness) worsen(status, msg string) {
+	if readySeverity[status] <= readySeverity[r.Status] {
+		return
+	}
+	r.Status, r.Error = status, msg
+}
+
+// readiness reports whether the provider can serve requests. It is
+// unavailable while shutting down, when the main backend, which holds the
+// state database, is down or, with the canary enabled, when a backend hasn't
+// passed its latest canary run. It is degraded while any backend is failing.
+func (p *pgAPI) readiness() *readiness {
+	res := &readiness{Status: readyOK}
+	for _, b := range p.backends.all() {
+		c := b.connectivity()
+		res.Backends = append(res.Backends, &backendReadiness{Name: b.name, Region: b.region, connectivity: c})
+		switch {
+		case c.State == backendDown && b == p.backends.main:
+			res.worsen(readyUnavailable, fmt.Sprintf("main backend %s is down: %s", b.name, c.LastError))
+		case c.State != backendUp:
+			res.worsen(readyDegraded, fmt.Sprintf("backend %s is %s: %s", b.name, c.State, c.LastError))
+		}
+	}
+	if p.canary != nil {
+		var ok bool
+		if res.Canary, ok = p.canary.status(); !ok {
+			res.worsen(readyUnavailable, "a backend hasn't passed its latest canary run")
+		}
+	}
+	if p.jobs.draining() {
+		res.worsen(readyUnavailable, "the provider is shutting down")
+	}
+	res.Ready = res.Status != readyUnavailable
+	return res
+}
+
+// readyz responds with the provider's readiness, with 503 when it is
+// unavailable. A degraded provider is still ready.
+func (p *pgAPI) readyz(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	res := p.readiness()
+	status := 200
+	if !res.Ready {
+		status = 503
+	}
+	httphelper.JSON(w, status, res)
+}
+
+type selfTestReport struct {
+	OK      bool            `json:"ok"`
+	Results []*canaryResult `json:"results"`
+}
+
+// selfTest runs the canary immediately on every backend, or the one for
+// ?region=, and reports each stage. It works whether or not the periodic
+// canary is enabled, and doesn't affect its results.
+func (p *pgAPI) selfTest(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	backends := p.backends.all()
+	if region := req.FormValue("region"); region != "" {
+		b, ok := p.backends.lookupRegion(w, region)
+		if !ok {
+			return
+		}
+		backends = []*backend{b}
+	}
+	c := p.canary
+	if c == nil {
+		c = newCanary(p, 0)
+	}
+	report := &selfTestReport{OK: true, Results: make([]*canaryResult, 0, len(backends))}
+	for _, b := range backends {
+		res := c.cycle(b)
+		report.OK = report.OK && res.OK
+		report.Results = append(report.Results, res)
+	}
+	status := 200
+	if !report.OK {
+		status = 503
+	}
+	httphelper.JSON(w, status, report)
+}
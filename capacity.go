@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) postgres.Scanner
+}
+
+// managedDatabases counts the databases the provider manages on the backend
+// of region, including those being provisioned or deleted, which counts
+// against MAX_DATABASES_PER_BACKEND.
+func managedDatabases(q rowQueryer, mainRegion, region string) (int, error) {
+	var n int
+	err := q.QueryRow(`SELECT count(*)::integer FROM resources WHERE coalesce(region, $1) = $2 AND status <> 'failed'`, mainRegion, region).Scan(&n)
+	return n, err
+}
+
+// capacity is a backend's usage, and the limits it exceeds, as of the last
+// check by the capacity monitor.
+type capacity struct {
+	DiskBytes      int64     `json:"disk_bytes"`
+	Connections    int       `json:"connections"`
+	MaxConnections int       `json:"max_connections"`
+	Databases      int       `json:"databases"`
+	Exceeded       []string  `json:"exceeded,omitempty"`
+	CheckedAt      time.Time `json:"checked_at"`
+
+	// message explains the first limit exceeded
+	message string
+}
+
+// measureCapacity checks b's usage against the configured limits.
+func measureCapacity(b *backend) (*capacity, error) {
+	c := &capacity{CheckedAt: time.Now()}
+	if err := b.db.QueryRow(`
+SELECT (SELECT sum(pg_database_size(datname))::bigint FROM pg_database),
+  (SELECT count(*)::integer FROM pg_stat_activity),
+  current_setting('max_connections')::integer,
+  (SELECT count(*)::integer FROM pg_database WHERE NOT datistemplate)`).Scan(
+		&c.DiskBytes, &c.Connections, &c.MaxConnections, &c.Databases); err != nil {
+		return nil, err
+	}
+	exceeded := func(limit, msg string) {
+		if c.message == "" {
+			c.message = msg
+		}
+		c.Exceeded = append(c.Exceeded, limit)
+	}
+	if capacityDiskLimit > 0 && c.DiskBytes >= capacityDiskLimit {
+		exceeded("disk", fmt.Sprintf("its databases use %d bytes, over the limit of %d: free up space or provision in another region", c.DiskBytes, capacityDiskLimit))
+	}
+	if capacityConnectionsPercent > 0 && c.Connections*100 >= c.MaxConnections*capacityConnectionsPercent {
+		exceeded("connections", fmt.Sprintf("%d of its %d connections are in use: close idle connections or provision in another region", c.Connections, c.MaxConnections))
+	}
+	if capacityMaxDatabases > 0 && c.Databases >= capacityMaxDatabases {
+		exceeded("databases", fmt.Sprintf("it has %d databases, the limit is %d: deprovision unused databases or provision in another region", c.Databases, capacityMaxDatabases))
+	}
+	return c, nil
+}
+
+// checkCapacity refuses provisioning on a backend over its capacity limits,
+// with 507 if it is out of disk and 503 otherwise, returning whether it may
+// go ahead.
+func checkCapacity(w http.ResponseWriter, b *backend) bool {
+	c := b.getCapacity()
+	if c == nil || len(c.Exceeded) == 0 {
+		return true
+	}
+	msg := fmt.Sprintf("backend %s is over capacity, %s", b.name, c.message)
+	if c.Exceeded[0] == "disk" {
+		httphelper.JSON(w, 507, httphelper.JSONError{Code: "insufficient_storage", Message: msg})
+		return false
+	}
+	httphelper.Error(w, httphelper.JSONError{Code: httphelper.ServiceUnavailableErrorCode, Message: msg, Retry: true})
+	return false
+}
+
+// capacityMonitor measures the usage of every backend, so provisioning
+// stops before a shared server's disk or connections run out, and alerts
+// when a backend goes over or back under its limits.
+type capacityMonitor struct {
+	backends *backendSet
+}
+
+func (m *capacityMonitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, b := range m.backends.all() {
+			if err := m.check(b); err != nil {
+				logger.Error("error checking backend capacity", "backend", b.name, "err", err)
+			}
+		}
+	}
+}
+
+func (m *capacityMonitor) check(b *backend) error {
+	c, err := measureCapacity(b)
+	if err != nil {
+		return err
+	}
+	prev := b.getCapacity()
+	b.setCapacity(c)
+	was := prev != nil && len(prev.Exceeded) > 0
+	info := map[string]interface{}{
+		"backend":         b.name,
+		"region":          b.region,
+		"disk_bytes":      c.DiskBytes,
+		"connections":     c.Connections,
+		"max_connections": c.MaxConnections,
+		"databases":       c.Databases,
+	}
+	switch {
+	case len(c.Exceeded) > 0 && (!was || prev.message != c.message):
+		logger.Warn("backend is over capacity, refusing provisions", "backend", b.name, "exceeded", c.Exceeded)
+		info["exceeded"] = c.Exceeded
+		info["message"] = c.message
+		notify("capacity.exceeded", info)
+	case len(c.Exceeded) == 0 && was:
+		logger.Info("backend is back under capacity", "backend", b.name)
+		notify("capacity.recovered", info)
+	}
+	return nil
+}
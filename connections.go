@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+const (
+	listConnections = `
+SELECT pid, usename::text, application_name, host(client_addr), backend_start, state,
+       query_start, wait_event_type, wait_event, coalesce(wait_event_type = 'Lock', false), query
+FROM pg_stat_activity
+WHERE datname = $1 AND pid <> pg_backend_pid()
+ORDER BY backend_start`
+
+	terminateSessions = `
+SELECT pid, pg_terminate_backend(pid) FROM pg_stat_activity
+WHERE datname = $1 AND pid <> pg_backend_pid()
+  AND ($2 = 0 OR pid = $2)
+  AND ($3 = '' OR state = $3)`
+)
+
+type connection struct {
+	PID             int32      `json:"pid"`
+	Username        *string    `json:"username"`
+	ApplicationName *string    `json:"application_name"`
+	ClientAddr      *string    `json:"client_addr"`
+	BackendStart    *time.Time `json:"backend_start"`
+	State           *string    `json:"state"`
+	QueryStart      *time.Time `json:"query_start"`
+	WaitEventType   *string    `json:"wait_event_type"`
+	WaitEvent       *string    `json:"wait_event"`
+	Waiting         bool       `json:"waiting"`
+	Query           *string    `json:"query"`
+}
+
+func (p *pgAPI) getConnections(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+
+	rows, err := r.Backend.db.Query(listConnections, r.Database)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var conns []*connection
+	for rows.Next() {
+		c := &connection{}
+		if err := rows.Scan(&c.PID, &c.Username, &c.ApplicationName, &c.ClientAddr, &c.BackendStart, &c.State,
+			&c.QueryStart, &c.WaitEventType, &c.WaitEvent, &c.Waiting, &c.Query); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		conns = append(conns, c)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, conns)
+}
+
+// terminateConnections terminates the session with the given :pid in a
+// resource's database, or all of its sessions if :pid is "all" (optionally
+// only those in the given state, e.g. "idle in transaction").
+func (p *pgAPI) terminateConnections(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	var pid int32
+	if s := params.ByName("pid"); s != "all" {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n <= 0 {
+			httphelper.ValidationError(w, "pid", "is invalid")
+			return
+		}
+		pid = int32(n)
+	}
+
+	rows, err := r.Backend.db.Query(terminateSessions, r.Database, pid, req.FormValue("state"))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	terminated := []int32{}
+	for rows.Next() {
+		var pid int32
+		var ok bool
+		if err := rows.Scan(&pid, &ok); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		if ok {
+			terminated = append(terminated, pid)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if pid != 0 && len(terminated) == 0 {
+		httphelper.ObjectNotFoundError(w, "connection not found")
+		return
+	}
+	audit(requestOrigin(ctx, req), securityDestructive, "terminate_connections", r.id(), nil)
+	httphelper.JSON(w, 200, map[string][]int32{"terminated": terminated})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	backendUp       = "up"
+	backendDegraded = "degraded"
+	backendDown     = "down"
+)
+
+var backendStates = []string{backendUp, backendDegraded, backendDown}
+
+// connectivity is the provider's view of whether it can reach a backend,
+// from the outcome of its probes and of the checks made before operations
+// on it. A backend is degraded after a failure, e.g. while it's a standby
+// after a failover, and down after BACKEND_DOWN_AFTER failures in a row,
+// when it is probed with backoff until it recovers.
+type connectivity struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	// RetryAt is when a failing backend is next probed.
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// record updates the backend's connectivity with the outcome of an operation
+// on it.
+func (b *backend) record(err error) {
+	now := time.Now()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	c := &b.conn
+	if err == nil {
+		if c.State == backendDown {
+			logger.Info("backend has recovered", "backend", b.name)
+		}
+		c.State, c.ConsecutiveFailures, c.LastSuccess, c.RetryAt = backendUp, 0, &now, nil
+		return
+	}
+	c.ConsecutiveFailures++
+	c.LastFailure, c.LastError = &now, redact(err.Error())
+	if c.ConsecutiveFailures >= backendDownAfter {
+		if c.State != backendDown {
+			logger.Error("backend is down", "backend", b.name, "failures", c.ConsecutiveFailures, "err", err)
+		}
+		c.State = backendDown
+	} else {
+		c.State = backendDegraded
+	}
+}
+
+func (b *backend) connectivity() connectivity {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.conn
+}
+
+// probe checks that the backend is reachable every interval, doubling the
+// delay up to maxBackoff while it fails.
+func (b *backend) probe(interval, maxBackoff time.Duration) {
+	delay := interval
+	for {
+		time.Sleep(delay)
+		err := b.db.Exec(`SELECT 1`)
+		b.record(err)
+		if err == nil {
+			delay = interval
+			continue
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+		retry := time.Now().Add(delay)
+		b.mtx.Lock()
+		b.conn.RetryAt = &retry
+		b.mtx.Unlock()
+	}
+}
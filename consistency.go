@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// driftSummary counts the differences between the state database and a
+// backend found by the consistency check.
+type driftSummary struct {
+	Backend string
+	// MissingDatabases and MissingRoles are tracked resources in use whose
+	// database or role doesn't exist.
+	MissingDatabases int
+	MissingRoles     int
+	// UntrackedDatabases and UntrackedRoles look like the provider created
+	// them, but aren't in the state database, e.g. leaked by a failed
+	// provision or created before the state database existed.
+	UntrackedDatabases int
+	UntrackedRoles     int
+}
+
+func (s *driftSummary) total() int {
+	return s.MissingDatabases + s.MissingRoles + s.UntrackedDatabases + s.UntrackedRoles
+}
+
+// drift holds the summaries of the latest consistency check, for metrics.
+var drift struct {
+	mtx       sync.RWMutex
+	summaries []*driftSummary
+}
+
+func driftSummaries() []*driftSummary {
+	drift.mtx.RLock()
+	defer drift.mtx.RUnlock()
+	return drift.summaries
+}
+
+// backendRoles returns the roles on b, and whether each is managed by the
+// provider, which is a member of every role it creates.
+func backendRoles(b *backend) (map[string]bool, error) {
+	rows, err := b.db.Query(`
+SELECT r.rolname::text, EXISTS (
+  SELECT 1 FROM pg_auth_members m JOIN pg_roles s ON s.oid = m.member
+  WHERE m.roleid = r.oid AND s.rolname = $1
+) FROM pg_roles r`, serviceUser)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var managed bool
+		if err := rows.Scan(&name, &managed); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		roles[name] = managed
+	}
+	return roles, rows.Err()
+}
+
+// trackedNames returns the names of every role and database recorded in the
+// state database, including those of rotations, publications, snapshots and
+// archives, along with the access and member roles named after each
+// database.
+func trackedNames(state *postgres.DB) (map[string]bool, error) {
+	rows, err := state.Query(`
+SELECT username, false FROM resources UNION SELECT database, true FROM resources
+UNION SELECT old_username, false FROM rotations UNION SELECT new_username, false FROM rotations
+UNION SELECT username, false FROM publications UNION SELECT database, true FROM snapshots
+UNION SELECT database, true FROM archives`)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var database bool
+		if err := rows.Scan(&name, &database); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names[name] = true
+		if database {
+			ro, rw := accessRoleNames(name)
+			names[ro], names[rw] = true, true
+			for _, member := range memberUsernames(name) {
+				names[member] = true
+			}
+		}
+	}
+	return names, rows.Err()
+}
+
+// checkConsistency compares the state database with each backend's databases
+// and roles when the provider starts, so that drift after an incident is
+// caught straight away rather than when a resource is next used. Resources
+// whose database or role is missing are marked degraded by the health check,
+// and the differences are logged and exported as metrics.
+func checkConsistency(state *postgres.DB, backends *backendSet, health *healthMonitor) {
+	tracked, err := trackedNames(state)
+	if err != nil {
+		logger.Error("error checking consistency", "err", err)
+		return
+	}
+	var summaries []*driftSummary
+	for _, b := range backends.all() {
+		if err := health.check(b); err != nil {
+			logger.Error("error checking resource health", "backend", b.name, "err", err)
+		}
+		s, err := checkBackendConsistency(state, b, backends.main.region, tracked)
+		if err != nil {
+			logger.Error("error checking consistency", "backend", b.name, "err", err)
+			continue
+		}
+		summaries = append(summaries, s)
+		if s.total() == 0 {
+			logger.Info("state database is consistent with backend", "backend", b.name)
+			continue
+		}
+		logger.Warn("state database has drifted from backend", "backend", b.name,
+			"missing_databases", s.MissingDatabases, "missing_roles", s.MissingRoles,
+			"untracked_databases", s.UntrackedDatabases, "untracked_roles", s.UntrackedRoles)
+	}
+	drift.mtx.Lock()
+	drift.summaries = summaries
+	drift.mtx.Unlock()
+}
+
+func checkBackendConsistency(state *postgres.DB, b *backend, mainRegion string, tracked map[string]bool) (*driftSummary, error) {
+	s := &driftSummary{Backend: b.name}
+	roles, err := backendRoles(b)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.db.Query(`SELECT d.datname::text, o.rolname::text FROM pg_database d JOIN pg_roles o ON o.oid = d.datdba WHERE NOT d.datistemplate`)
+	if err != nil {
+		return nil, err
+	}
+	databases := make(map[string]string)
+	for rows.Next() {
+		var name, owner string
+		if err := rows.Scan(&name, &owner); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		databases[name] = owner
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = state.Query(`SELECT uuid, username, database FROM resources WHERE status IN ('ready', 'degraded') AND coalesce(region, $1) = $2`, mainRegion, b.region)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var uuid, username, database string
+		if err := rows.Scan(&uuid, &username, &database); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, ok := databases[database]; !ok {
+			s.MissingDatabases++
+			logger.Warn("tracked database is missing", "backend", b.name, "id", resourceID(uuid), "database", database)
+		}
+		if _, ok := roles[username]; !ok {
+			s.MissingRoles++
+			logger.Warn("tracked role is missing", "backend", b.name, "id", resourceID(uuid), "role", username)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, owner := range databases {
+		if roles[owner] && !tracked[name] && shouldBeTracked(name) {
+			s.UntrackedDatabases++
+			logger.Warn("untracked database", "backend", b.name, "database", name, "owner", owner)
+		}
+	}
+	for name, managed := range roles {
+		if managed && !tracked[name] && shouldBeTracked(name) {
+			s.UntrackedRoles++
+			logger.Warn("untracked role", "backend", b.name, "role", name)
+		}
+	}
+	return s, nil
+}
+
+// shouldBeTracked reports whether an object the provider manages should be in
+// the state database. Pooled databases and their roles aren't tracked until
+// they are claimed, and roles granted to the provider by the operator, e.g.
+// pg_monitor, can't be the names of resources.
+func shouldBeTracked(name string) bool {
+	return !poolName.MatchString(name) && validateName("name", name) == nil && strings.HasPrefix(name, namePrefix)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+var errCostNotConfigured = httphelper.JSONError{Code: httphelper.PreconditionFailedErrorCode, Message: "cost estimation is not configured"}
+
+// pricing is the operator's price of each resource for a month, nil unless
+// any COST_PER_* variable is set.
+type pricing struct {
+	PerGB         float64
+	PerDatabase   float64
+	PerConnection float64
+	Currency      string
+}
+
+var costPricing *pricing
+
+// parsePricing reads the COST_* variables.
+func parsePricing() (*pricing, error) {
+	p := &pricing{Currency: os.Getenv("COST_CURRENCY")}
+	set := false
+	for name, v := range map[string]*float64{
+		"COST_PER_GB_MONTH":         &p.PerGB,
+		"COST_PER_DATABASE_MONTH":   &p.PerDatabase,
+		"COST_PER_CONNECTION_MONTH": &p.PerConnection,
+	} {
+		s := os.Getenv(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil, fmt.Errorf("%s must be a non-negative number", name)
+		}
+		*v, set = n, true
+	}
+	if !set {
+		return nil, nil
+	}
+	if p.Currency == "" {
+		p.Currency = "USD"
+	}
+	return p, nil
+}
+
+// usage is what a resource, or a group of them, is charged for.
+type usage struct {
+	Databases   int   `json:"databases"`
+	SizeBytes   int64 `json:"size_bytes"`
+	Connections int   `json:"connections"`
+}
+
+func (u *usage) add(o usage) {
+	u.Databases += o.Databases
+	u.SizeBytes += o.SizeBytes
+	u.Connections += o.Connections
+}
+
+// monthlyCost is the estimated cost of a month at the current usage.
+type monthlyCost struct {
+	Storage     float64 `json:"storage"`
+	Databases   float64 `json:"databases"`
+	Connections float64 `json:"connections"`
+	Total       float64 `json:"total"`
+}
+
+func (p *pricing) estimate(u usage) *monthlyCost {
+	c := &monthlyCost{
+		Storage:     float64(u.SizeBytes) / (1 << 30) * p.PerGB,
+		Databases:   float64(u.Databases) * p.PerDatabase,
+		Connections: float64(u.Connections) * p.PerConnection,
+	}
+	c.Total = roundCents(c.Storage + c.Databases + c.Connections)
+	c.Storage, c.Databases, c.Connections = roundCents(c.Storage), roundCents(c.Databases), roundCents(c.Connections)
+	return c
+}
+
+func roundCents(n float64) float64 {
+	return math.Round(n*100) / 100
+}
+
+type resourceCost struct {
+	ResourceID string `json:"resource_id"`
+	Currency   string `json:"currency"`
+	usage
+	Monthly *monthlyCost `json:"monthly"`
+}
+
+// getCost estimates the monthly cost of a resource from its current size
+// and connections.
+func (p *pgAPI) getCost(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if costPricing == nil {
+		httphelper.Error(w, errCostNotConfigured)
+		return
+	}
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	u := usage{Databases: 1}
+	if err := r.Backend.db.QueryRow(`SELECT pg_database_size($1), (SELECT count(*) FROM pg_stat_activity WHERE datname = $1)`, r.Database).Scan(&u.SizeBytes, &u.Connections); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &resourceCost{
+		ResourceID: r.id(),
+		Currency:   costPricing.Currency,
+		usage:      u,
+		Monthly:    costPricing.estimate(u),
+	})
+}
+
+// costGroupings are the fields accepted by ?group_by=.
+var costGroupings = map[string]bool{"tag": true, "tenant": true, "app": true, "region": true}
+
+type costGroup struct {
+	Key string `json:"key"`
+	usage
+	Monthly *monthlyCost `json:"monthly"`
+}
+
+type costReport struct {
+	Currency string `json:"currency"`
+	GroupBy  string `json:"group_by"`
+	usage
+	Monthly *monthlyCost `json:"monthly"`
+	Groups  []*costGroup `json:"groups"`
+}
+
+// getCostReport estimates the monthly cost of every resource and totals it
+// by ?group_by= tag (the default), tenant, app or region, most expensive
+// first. A resource counts towards each of its tags, so tag totals overlap.
+// Tenant scoped API keys only see their tenant's resources.
+func (p *pgAPI) getCostReport(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if costPricing == nil {
+		httphelper.Error(w, errCostNotConfigured)
+		return
+	}
+	groupBy := req.FormValue("group_by")
+	if groupBy == "" {
+		groupBy = "tag"
+	}
+	if !costGroupings[groupBy] {
+		httphelper.ValidationError(w, "group_by", "must be one of tag, tenant, app, region")
+		return
+	}
+
+	rows, err := p.state.Query(`SELECT database, coalesce(region, $1), app, tags, coalesce(tenant, '') FROM resources WHERE $2 = '' OR tenant = $2`, p.backend.region, callerTenant(ctx))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	type resource struct {
+		database, region, app, tenant string
+		tags                          []string
+	}
+	var resources []*resource
+	for rows.Next() {
+		r := &resource{}
+		if err := rows.Scan(&r.database, &r.region, &r.app, &r.tags, &r.tenant); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	// usage of every database, by region and name, with one query per
+	// backend
+	usages := make(map[string]map[string]usage)
+	for _, b := range p.backends.all() {
+		rows, err := b.db.Query(`
+SELECT d.datname::text, pg_database_size(d.oid), (SELECT count(*) FROM pg_stat_activity a WHERE a.datname = d.datname)
+FROM pg_database d WHERE NOT d.datistemplate`)
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		m := make(map[string]usage)
+		for rows.Next() {
+			var name string
+			u := usage{Databases: 1}
+			if err := rows.Scan(&name, &u.SizeBytes, &u.Connections); err != nil {
+				rows.Close()
+				httphelper.Error(w, err)
+				return
+			}
+			m[name] = u
+		}
+		if err := rows.Err(); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		usages[b.region] = m
+	}
+
+	report := &costReport{Currency: costPricing.Currency, GroupBy: groupBy, Groups: []*costGroup{}}
+	groups := make(map[string]*costGroup)
+	for _, r := range resources {
+		// a resource whose database is missing is still charged for
+		u, ok := usages[r.region][r.database]
+		if !ok {
+			u = usage{Databases: 1}
+		}
+		report.usage.add(u)
+		var keys []string
+		switch groupBy {
+		case "tag":
+			keys = r.tags
+			if len(keys) == 0 {
+				keys = []string{""}
+			}
+		case "tenant":
+			keys = []string{r.tenant}
+		case "app":
+			keys = []string{r.app}
+		case "region":
+			keys = []string{r.region}
+		}
+		for _, k := range keys {
+			g, ok := groups[k]
+			if !ok {
+				g = &costGroup{Key: k}
+				groups[k] = g
+				report.Groups = append(report.Groups, g)
+			}
+			g.usage.add(u)
+		}
+	}
+	report.Monthly = costPricing.estimate(report.usage)
+	for _, g := range report.Groups {
+		g.Monthly = costPricing.estimate(g.usage)
+	}
+	sort.Sort(byCost(report.Groups))
+	httphelper.JSON(w, 200, report)
+}
+
+// byCost sorts cost groups most expensive first, then by key.
+type byCost []*costGroup
+
+func (c byCost) Len() int      { return len(c) }
+func (c byCost) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCost) Less(i, j int) bool {
+	if a, b := c[i].Monthly.Total, c[j].Monthly.Total; a != b {
+		return a > b
+	}
+	return c[i].Key < c[j].Key
+}
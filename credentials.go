@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errCredentialNotFound = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "credential not found"}
+	errOnlyCredential     = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "the only credential of a database can't be revoked, rotate the credentials first"}
+)
+
+// revokeCredential revokes one of a resource's login roles, for when a
+// credential has leaked, leaving the database and its other credentials
+// intact. The role is blocked from logging in and its sessions terminated
+// before it is dropped.
+//
+// While a rotation is in progress either role can be revoked: revoking the
+// new role abandons the rotation, revoking the previous one completes it
+// early. Outside a rotation the owning role is the only credential, and is
+// refused.
+func (p *pgAPI) revokeCredential(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	name := params.ByName("name")
+
+	rot := &rotation{resource: r.UUID, database: r.Database, backend: r.Backend}
+	err := p.state.QueryRow(`SELECT old_username, new_username, expires_at, created_at FROM rotations WHERE resource = $1`, r.UUID).Scan(
+		&rot.PreviousUsername, &rot.Username, &rot.ExpiresAt, &rot.CreatedAt)
+	if err == pgx.ErrNoRows {
+		rot = nil
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	switch {
+	case rot != nil && (name == rot.Username || name == rot.PreviousUsername):
+	case name == r.Username:
+		httphelper.Error(w, errOnlyCredential)
+		return
+	default:
+		httphelper.Error(w, errCredentialNotFound)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	if err := r.Backend.db.Exec(fmt.Sprintf(`ALTER ROLE "%s" NOLOGIN`, name)); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if name == rot.PreviousUsername {
+		// completing the rotation terminates the role's sessions and drops it
+		err = completeRotation(p.state, rot)
+	} else {
+		err = abandonRotation(p.state, rot)
+	}
+	audit(requestOrigin(ctx, req), securityDestructive, "revoke_credential", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	notify("credentials.revoked", map[string]interface{}{
+		"id":        resourceID(r.UUID),
+		"database":  r.Database,
+		"username":  name,
+		"requester": requester(ctx, req),
+	})
+	w.WriteHeader(200)
+}
+
+// abandonRotation drops the new role of a rotation, handing anything it
+// created over to the owning role, and forgets the rotation.
+func abandonRotation(state *postgres.DB, rot *rotation) error {
+	b := rot.backend
+	if err := b.db.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1`, rot.Username); err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(b.connConfig(rot.database))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(fmt.Sprintf(`REASSIGN OWNED BY "%s" TO "%s"`, rot.Username, rot.PreviousUsername))
+	if err == nil {
+		_, err = conn.Exec(fmt.Sprintf(`DROP OWNED BY "%s"`, rot.Username))
+	}
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	if err := reassignSnapshots(state, b, rot.resource, rot.Username, rot.PreviousUsername); err != nil {
+		return err
+	}
+	if err := b.db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, rot.Username)); err != nil {
+		return err
+	}
+	return state.Exec(`DELETE FROM rotations WHERE resource = $1`, rot.resource)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+// crossOrigin reports whether a request which may change something was made
+// by a page of another origin. Browsers resend the basic credentials the
+// dashboard was loaded with to any page's requests, so those are refused.
+func crossOrigin(req *http.Request) bool {
+	if req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS" {
+		return false
+	}
+	o := req.Header.Get("Origin")
+	if o == "" {
+		return false
+	}
+	u, err := url.Parse(o)
+	return err != nil || u.Host != req.Host
+}
+
+// getAuditEvents returns the latest security events, newest first, up to
+// ?limit=.
+func (p *pgAPI) getAuditEvents(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	limit := defaultPageSize
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > recentEventsSize {
+			httphelper.ValidationError(w, "limit", "must be between 1 and "+strconv.Itoa(recentEventsSize))
+			return
+		}
+		limit = n
+	}
+	httphelper.JSON(w, 200, recentEvents.latest(limit))
+}
+
+// getDashboard serves the admin dashboard, a single page which reads
+// everything it shows from the API with the credentials it was loaded with.
+func (p *pgAPI) getDashboard(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(200)
+	io.WriteString(w, dashboardHTML)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pg-external</title>
+<style>
+body { font: 14px sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 20px; }
+h2 { font-size: 16px; margin-top: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 3px 8px; border-bottom: 1px solid #ddd; white-space: nowrap; }
+th { background: #f4f4f4; }
+td.wrap { white-space: normal; }
+.failure, .failed, .degraded { color: #b00; }
+.ready, .succeeded, .success { color: #070; }
+#error { color: #b00; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+button { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>pg-external</h1>
+<p id="server"></p>
+<p id="error"></p>
+<pre id="output" hidden></pre>
+
+<h2>Databases</h2>
+<table>
+<thead><tr><th>Database</th><th>App</th><th>Env</th><th>Region</th><th>Status</th><th>Size</th><th>Connections</th><th>Created</th><th>Created by</th><th></th></tr></thead>
+<tbody id="databases"></tbody>
+</table>
+
+<h2>Jobs</h2>
+<table>
+<thead><tr><th>Type</th><th>Resource</th><th>State</th><th>Requester</th><th>Created</th><th>Error</th></tr></thead>
+<tbody id="jobs"></tbody>
+</table>
+
+<h2>Audit events</h2>
+<table>
+<thead><tr><th>Time</th><th>Category</th><th>Action</th><th>Resource</th><th>Source</th><th>Requester</th><th>Outcome</th><th>Error</th></tr></thead>
+<tbody id="events"></tbody>
+</table>
+
+<script>
+function api(method, path) {
+  return fetch(path, {method: method, credentials: 'same-origin', headers: {'Content-Type': 'application/json'}}).then(function(res) {
+    return res.json().then(function(body) {
+      if (!res.ok) throw new Error(method + ' ' + path + ': ' + (body.message || res.status));
+      return body;
+    });
+  });
+}
+
+function size(bytes) {
+  if (bytes == null) return '';
+  var units = ['B', 'kB', 'MB', 'GB', 'TB'], i = 0;
+  while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+  return bytes.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+
+function time(t) {
+  return t ? new Date(t).toLocaleString() : '';
+}
+
+function row(tbody, cells, cls) {
+  var tr = document.createElement('tr');
+  cells.forEach(function(c, i) {
+    var td = document.createElement('td');
+    if (c instanceof Node) td.appendChild(c); else td.textContent = c == null ? '' : c;
+    if (cls && cls[i]) td.className = cls[i];
+    tr.appendChild(td);
+  });
+  tbody.appendChild(tr);
+  return tr;
+}
+
+function fail(err) {
+  document.getElementById('error').textContent = err.message;
+}
+
+function button(label, fn) {
+  var b = document.createElement('button');
+  b.textContent = label;
+  b.onclick = fn;
+  return b;
+}
+
+function rotate(db) {
+  if (!confirm('Rotate the credentials of ' + db.database + '? The new credentials are shown once.')) return;
+  api('POST', db.id + '/rotate').then(function(res) {
+    var out = document.getElementById('output');
+    out.textContent = 'Rotation of ' + db.database + ' started:\n' + JSON.stringify(res, null, 2);
+    out.hidden = false;
+    load();
+  }).catch(fail);
+}
+
+function connections(db, td) {
+  api('GET', db.id + '/connections').then(function(conns) {
+    td.textContent = conns.length;
+  }).catch(function() { td.textContent = '?'; });
+}
+
+function load() {
+  document.getElementById('error').textContent = '';
+  api('GET', '/server').then(function(s) {
+    var text = 'PostgreSQL ' + s.version;
+    if (s.capacity) text += ', ' + size(s.capacity.disk_bytes) + ' used, ' + s.capacity.connections + ' of ' + s.capacity.max_connections + ' connections';
+    if (s.capacity && s.capacity.exceeded) text += ', over capacity: ' + s.capacity.exceeded.join(', ');
+    document.getElementById('server').textContent = text;
+  }).catch(fail);
+  api('GET', '/databases?sort=-size&limit=100').then(function(list) {
+    var tbody = document.getElementById('databases');
+    tbody.textContent = '';
+    list.resources.forEach(function(db) {
+      var conns = document.createElement('span');
+      row(tbody, [db.database, db.app, db.env, db.region, db.status, size(db.size_bytes), conns, time(db.created_at), db.created_by,
+        button('Rotate', function() { rotate(db); })], [null, null, null, null, db.status]);
+      connections(db, conns);
+    });
+  }).catch(fail);
+  api('GET', '/jobs?limit=20').then(function(jobs) {
+    var tbody = document.getElementById('jobs');
+    tbody.textContent = '';
+    jobs.forEach(function(j) {
+      row(tbody, [j.type, j.resource, j.state, j.requester, time(j.created_at), j.error], [null, null, j.state, null, null, 'wrap']);
+    });
+  }).catch(fail);
+  api('GET', '/admin/audit?limit=50').then(function(events) {
+    var tbody = document.getElementById('events');
+    tbody.textContent = '';
+    events.forEach(function(e) {
+      row(tbody, [time(e.time), e.category, e.action, e.resource, e.source, e.requester, e.outcome, e.error], [null, null, null, null, null, null, e.outcome, 'wrap']);
+    });
+  }).catch(fail);
+}
+
+load();
+setInterval(load, 30000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// discoverFunc returns the current address of the backend primary.
+type discoverFunc func() (host, port string, err error)
+
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+// parseDiscovery parses DISCOVERY, which is one of "srv:<name>",
+// "consul:<key>" or "etcd:<key>".
+func parseDiscovery(s string) (discoverFunc, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("must be of the form srv:<name>, consul:<key> or etcd:<key>")
+	}
+	target := parts[1]
+	switch parts[0] {
+	case "srv":
+		return func() (string, string, error) { return discoverSRV(target) }, nil
+	case "consul":
+		return func() (string, string, error) { return discoverConsul(target) }, nil
+	case "etcd":
+		return func() (string, string, error) { return discoverEtcd(target) }, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery method %q", parts[0])
+	}
+}
+
+// discoverSRV looks up the SRV records for name, returning the target with
+// the lowest priority (net.LookupSRV orders them and randomizes by weight).
+func discoverSRV(name string) (string, string, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return "", "", err
+	}
+	if len(addrs) == 0 {
+		return "", "", fmt.Errorf("no SRV records found for %s", name)
+	}
+	return strings.TrimSuffix(addrs[0].Target, "."), fmt.Sprint(addrs[0].Port), nil
+}
+
+// discoverConsul reads the primary's address from a key in the Consul KV
+// store.
+func discoverConsul(key string) (string, string, error) {
+	req, err := http.NewRequest("GET", httpAddr(consulAddr)+"/v1/kv/"+strings.TrimPrefix(key, "/")+"?raw", nil)
+	if err != nil {
+		return "", "", err
+	}
+	if consulToken != "" {
+		req.Header.Set("X-Consul-Token", consulToken)
+	}
+	res, err := discoveryClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", "", fmt.Errorf("unexpected status code %d reading Consul key %s", res.StatusCode, key)
+	}
+	value, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return parseBackendAddr(string(value))
+}
+
+// discoverEtcd reads the primary's address from a key in etcd using the v3
+// JSON gateway.
+func discoverEtcd(key string) (string, string, error) {
+	body, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+	res, err := discoveryClient.Post(httpAddr(etcdEndpoint)+"/v3/kv/range", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", "", fmt.Errorf("unexpected status code %d reading etcd key %s", res.StatusCode, key)
+	}
+	var data struct {
+		KVs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return "", "", err
+	}
+	if len(data.KVs) == 0 {
+		return "", "", fmt.Errorf("etcd key %s not found", key)
+	}
+	return parseBackendAddr(string(data.KVs[0].Value))
+}
+
+// httpAddr adds the http scheme to addr if it doesn't have one, as Consul
+// and etcd addresses are commonly given as host:port.
+func httpAddr(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+// parseBackendAddr parses an address stored in a discovery key, either
+// host[:port] or a postgres:// URL. The port defaults to PGPORT.
+func parseBackendAddr(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", "", err
+		}
+		s = u.Host
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), servicePort
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("invalid backend address %q", s)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// envRule copies the env var From to To. If wildcard is set, From and To are
+// prefixes and the rule applies to every var starting with From.
+type envRule struct {
+	To       string
+	From     string
+	Wildcard bool
+}
+
+// parseEnvRules parses a comma separated list of NEW=OLD rules, for example
+// "POSTGRES_URL=DATABASE_URL,DB_*=PG*".
+func parseEnvRules(s string) ([]envRule, error) {
+	var rules []envRule
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid env rule %q", f)
+		}
+		to, from := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		toWild, fromWild := strings.HasSuffix(to, "*"), strings.HasSuffix(from, "*")
+		if toWild != fromWild {
+			return nil, fmt.Errorf("invalid env rule %q: both names must end in * or neither", f)
+		}
+		rules = append(rules, envRule{
+			To:       strings.TrimSuffix(to, "*"),
+			From:     strings.TrimSuffix(from, "*"),
+			Wildcard: toWild,
+		})
+	}
+	return rules, nil
+}
+
+// renameEnv applies the configured rules to env, removing the original vars
+// if ENV_NAMES_REPLACE is set.
+func renameEnv(env map[string]string) map[string]string {
+	if len(envRules) == 0 {
+		return env
+	}
+	out := make(map[string]string, len(env))
+	renamed := make(map[string]bool)
+	for _, r := range envRules {
+		for k, v := range env {
+			switch {
+			case r.Wildcard && strings.HasPrefix(k, r.From):
+				out[r.To+strings.TrimPrefix(k, r.From)] = v
+			case !r.Wildcard && k == r.From:
+				out[r.To] = v
+			default:
+				continue
+			}
+			renamed[k] = true
+		}
+	}
+	for k, v := range env {
+		if envNamesReplace && renamed[k] {
+			continue
+		}
+		if _, ok := out[k]; !ok {
+			out[k] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"golang.org/x/net/context"
+)
+
+// expiryMonitor deprovisions ephemeral resources once their TTL lapses,
+// posting a resource.expiring event beforehand so that anything worth
+// keeping can be backed up.
+type expiryMonitor struct {
+	state    *postgres.DB
+	backends *backendSet
+	warning  time.Duration
+}
+
+func (m *expiryMonitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.check(); err != nil {
+			logger.Error("error checking resource expiry", "err", err)
+		}
+		if err := expireArchives(m.state, m.backends); err != nil {
+			logger.Error("error checking archive expiry", "err", err)
+		}
+	}
+}
+
+type expiringResource struct {
+	resourceRef
+	expiresAt time.Time
+	warned    bool
+}
+
+func (m *expiryMonitor) check() error {
+	rows, err := m.state.Query(`
+SELECT uuid, username, database, region, expires_at, expiry_warned FROM resources
+WHERE expires_at <= now() + make_interval(secs => $1) AND status NOT IN ('provisioning', 'migrating', 'deleting')`, m.warning.Seconds())
+	if err != nil {
+		return err
+	}
+	var resources []*expiringResource
+	for rows.Next() {
+		r := &expiringResource{}
+		var region *string
+		if err := rows.Scan(&r.UUID, &r.Username, &r.Database, &region, &r.expiresAt, &r.warned); err != nil {
+			rows.Close()
+			return err
+		}
+		if r.Backend, err = m.backends.forRegion(region); err != nil {
+			logger.Error("error checking resource expiry", "database", r.Database, "err", err)
+			continue
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range resources {
+		if err := m.checkResource(r); err != nil {
+			logger.Error("error checking resource expiry", "database", r.Database, "err", err)
+		}
+	}
+	return nil
+}
+
+func (m *expiryMonitor) checkResource(r *expiringResource) error {
+	info := map[string]interface{}{
+		"id":         resourceID(r.UUID),
+		"database":   r.Database,
+		"expires_at": r.expiresAt,
+	}
+	if time.Now().Before(r.expiresAt) {
+		if r.warned {
+			return nil
+		}
+		if err := m.state.Exec(`UPDATE resources SET expiry_warned = true WHERE uuid = $1`, r.UUID); err != nil {
+			return err
+		}
+		notify("resource.expiring", info)
+		return nil
+	}
+
+	err := deprovision(m.state, &r.resourceRef, nil)
+	audit(origin{}, securityDestructive, "expire", r.id(), err)
+	if err != nil {
+		return err
+	}
+	logger.Info("deprovisioned expired resource", "id", resourceID(r.UUID), "database", r.Database)
+	notify("resource.expired", info)
+	return nil
+}
+
+// parseTTL parses the TTL of a new resource, which is limited by
+// MAX_LIFETIME when set.
+func parseTTL(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "ttl is invalid"}
+	}
+	if maxLifetime > 0 && d > maxLifetime {
+		return 0, httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: fmt.Sprintf("ttl must be at most %s", maxLifetime)}
+	}
+	return d, nil
+}
+
+type renewRequest struct {
+	TTL string `json:"ttl"`
+}
+
+type renewResponse struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Renewals  int       `json:"renewals"`
+}
+
+// renewDatabase extends an ephemeral resource's lifetime by the given TTL,
+// or by its original TTL, counted from now. Renewals are limited by
+// MAX_RENEWALS and MAX_LIFETIME (measured from creation) when set.
+func (p *pgAPI) renewDatabase(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	var config renewRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil && err != io.EOF {
+		httphelper.Error(w, err)
+		return
+	}
+
+	var createdAt time.Time
+	var expiresAt *time.Time
+	var ttl *float64
+	var renewals int
+	if err := p.state.QueryRow(`SELECT created_at, expires_at, ttl_seconds, renewals FROM resources WHERE uuid = $1`, r.UUID).Scan(
+		&createdAt, &expiresAt, &ttl, &renewals); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if expiresAt == nil {
+		httphelper.Error(w, httphelper.PreconditionFailedErr("the resource has no TTL"))
+		return
+	}
+	if config.TTL != "" {
+		d, err := time.ParseDuration(config.TTL)
+		if err != nil || d <= 0 {
+			httphelper.ValidationError(w, "ttl", "is invalid")
+			return
+		}
+		secs := d.Seconds()
+		ttl = &secs
+	} else if ttl == nil {
+		httphelper.ValidationError(w, "ttl", "must be set")
+		return
+	}
+	if maxRenewalCount > 0 && renewals >= maxRenewalCount {
+		httphelper.Error(w, httphelper.PreconditionFailedErr(fmt.Sprintf("the resource has already been renewed %d times", renewals)))
+		return
+	}
+	if maxLifetime > 0 && time.Now().Add(time.Duration(*ttl*float64(time.Second))).After(createdAt.Add(maxLifetime)) {
+		httphelper.Error(w, httphelper.PreconditionFailedErr(fmt.Sprintf("renewing would exceed the maximum lifetime of %s", maxLifetime)))
+		return
+	}
+
+	res := &renewResponse{ID: resourceID(r.UUID)}
+	if err := p.state.QueryRow(`UPDATE resources SET expires_at = now() + make_interval(secs => $1), expiry_warned = false, renewals = renewals + 1 WHERE uuid = $2 RETURNING expires_at, renewals`,
+		*ttl, r.UUID).Scan(&res.ExpiresAt, &res.Renewals); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := extendRoleValidity(p.state, r.Backend, r.UUID, r.Username, r.Database, res.ExpiresAt); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, res)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+// terraformResource describes a database or role in the form used by the
+// postgresql Terraform provider, where both are imported by name.
+type terraformResource struct {
+	ResourceID string                 `json:"resource_id"`
+	Type       string                 `json:"type"`
+	Name       string                 `json:"name"`
+	ImportID   string                 `json:"import_id"`
+	Region     string                 `json:"region"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type terraformExport struct {
+	Backend     string               `json:"backend"`
+	Region      string               `json:"region"`
+	GeneratedAt time.Time            `json:"generated_at"`
+	Resources   []*terraformResource `json:"resources"`
+}
+
+// exportTerraform returns the provisioned databases and roles so they can be
+// imported into Terraform state, as JSON or, with format=hcl, as import
+// blocks and matching resource definitions. Resources in other regions than
+// the main backend's use a provider alias named after the region.
+func (p *pgAPI) exportTerraform(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format != "" && format != "json" && format != "hcl" {
+		httphelper.ValidationError(w, "format", "must be one of json, hcl")
+		return
+	}
+
+	rows, err := p.state.Query(`SELECT uuid, database, username, coalesce(region, $1), created_at FROM resources ORDER BY created_at`, p.backend.region)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	export := &terraformExport{Backend: p.backend.name, Region: p.backend.region, GeneratedAt: time.Now().UTC()}
+	for rows.Next() {
+		var uuid, database, username, region string
+		var createdAt time.Time
+		if err := rows.Scan(&uuid, &database, &username, &region, &createdAt); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		id := resourceID(uuid)
+		export.Resources = append(export.Resources,
+			&terraformResource{
+				ResourceID: id,
+				Type:       "postgresql_role",
+				Name:       "role_" + sanitizeName(username),
+				ImportID:   username,
+				Region:     region,
+				Attributes: map[string]interface{}{"name": username, "login": true},
+			},
+			&terraformResource{
+				ResourceID: id,
+				Type:       "postgresql_database",
+				Name:       "db_" + sanitizeName(database),
+				ImportID:   database,
+				Region:     region,
+				Attributes: map[string]interface{}{"name": database, "owner": username},
+			},
+		)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	if format == "hcl" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(200)
+		w.Write(terraformHCL(export))
+		return
+	}
+	if export.Resources == nil {
+		export.Resources = []*terraformResource{}
+	}
+	httphelper.JSON(w, 200, export)
+}
+
+func terraformHCL(export *terraformExport) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by pg-external for %s at %s\n", export.Backend, export.GeneratedAt.Format(time.RFC3339))
+	for _, r := range export.Resources {
+		var provider string
+		if r.Region != export.Region {
+			provider = fmt.Sprintf("  provider = postgresql.%s\n", sanitizeName(r.Region))
+		}
+		fmt.Fprintf(&buf, "\n# %s\nimport {\n  to = %s.%s\n  id = %q\n%s}\n\n", r.ResourceID, r.Type, r.Name, r.ImportID, provider)
+		fmt.Fprintf(&buf, "resource %q %q {\n%s", r.Type, r.Name, provider)
+		switch r.Type {
+		case "postgresql_role":
+			fmt.Fprintf(&buf, "  name  = %q\n  login = true\n", r.Attributes["name"])
+		case "postgresql_database":
+			fmt.Fprintf(&buf, "  name  = %q\n  owner = postgresql_role.role_%s.name\n", r.Attributes["name"], sanitizeName(r.Attributes["owner"].(string)))
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.Bytes()
+}
+
+// inventoryRecord is a resource in the inventory export.
+type inventoryRecord struct {
+	*resourceInfo
+	Tenant string `json:"tenant"`
+}
+
+// inventoryColumns are the columns of the CSV inventory export.
+var inventoryColumns = []string{
+	"id", "uuid", "database", "username", "region", "app", "env", "tenant", "tags", "comment", "status",
+	"size_bytes", "quota_bytes", "parent", "created_by", "created_at", "expires_at",
+}
+
+// exportInventory returns every resource with its current size, as CSV or,
+// with format=jsonl, one JSON object per line.
+func (p *pgAPI) exportInventory(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		httphelper.ValidationError(w, "format", "must be one of csv, jsonl")
+		return
+	}
+
+	tenants := make(map[string]string)
+	rows, err := p.state.Query(`SELECT uuid, tenant FROM resources WHERE tenant IS NOT NULL`)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	for rows.Next() {
+		var uuid, tenant string
+		if err := rows.Scan(&uuid, &tenant); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		tenants[uuid] = tenant
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	rows, err = p.state.Query(`SELECT `+resourceInfoColumns+` FROM resources ORDER BY created_at, uuid`, p.backend.region)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var resources []*resourceInfo
+	for rows.Next() {
+		r, err := scanResourceInfo(rows)
+		if err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := p.addSizes(resources); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	filename := "pg-external-inventory-" + time.Now().UTC().Format("20060102") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(200)
+		enc := json.NewEncoder(w)
+		for _, r := range resources {
+			enc.Encode(&inventoryRecord{resourceInfo: r, Tenant: tenants[r.UUID]})
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(200)
+	cw := csv.NewWriter(w)
+	cw.Write(inventoryColumns)
+	for _, r := range resources {
+		cw.Write([]string{
+			r.ID, r.UUID, r.Database, r.Username, r.Region, r.App, r.Env, tenants[r.UUID],
+			strings.Join(r.Tags, " "), csvText(r.Comment), r.Status,
+			csvInt(r.SizeBytes), csvInt(r.QuotaBytes), csvString(r.Parent), csvText(r.CreatedBy),
+			r.CreatedAt.UTC().Format(time.RFC3339), csvTime(r.ExpiresAt),
+		})
+	}
+	cw.Flush()
+}
+
+// csvText escapes free text which a spreadsheet would otherwise evaluate as
+// a formula.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvInt(n *int64) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.FormatInt(*n, 10)
+}
+
+func csvString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
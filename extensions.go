@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+// allowedExtensions are the extensions provisioned databases may use, from
+// the comma separated ALLOWED_EXTENSIONS.
+var allowedExtensions = make(map[string]bool)
+
+type extension struct {
+	Name           string   `json:"name"`
+	DefaultVersion *string  `json:"default_version"`
+	Versions       []string `json:"versions"`
+	Comment        *string  `json:"comment,omitempty"`
+	Allowed        bool     `json:"allowed"`
+}
+
+// getExtensions lists the extensions available on the main backend, or the
+// backend for the given region, with their versions and whether they are
+// allowed.
+func (p *pgAPI) getExtensions(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	b := p.backend
+	if region := req.FormValue("region"); region != "" {
+		var ok bool
+		if b, ok = p.backends.lookupRegion(w, region); !ok {
+			return
+		}
+	}
+	rows, err := b.db.Query(`
+SELECT a.name::text, a.default_version::text, a.comment,
+  coalesce(array_agg(v.version::text ORDER BY v.version) FILTER (WHERE v.version IS NOT NULL), '{}')
+FROM pg_available_extensions a
+LEFT JOIN pg_available_extension_versions v ON v.name = a.name
+GROUP BY a.name, a.default_version, a.comment
+ORDER BY a.name`)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	extensions := []*extension{}
+	for rows.Next() {
+		e := &extension{}
+		if err := rows.Scan(&e.Name, &e.DefaultVersion, &e.Comment, &e.Versions); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		e.Allowed = allowedExtensions[e.Name]
+		extensions = append(extensions, e)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, extensions)
+}
+
+var validExtensionVersion = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var errExtensionNotInstalled = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "extension not installed"}
+
+// extensionRequest asks for an extension to be installed in a new database,
+// at the given version or the default one.
+type extensionRequest struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// installedExtension is an extension installed in a resource's database.
+// Pinned extensions were installed at a version the request asked for.
+type installedExtension struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Pinned    bool      `json:"pinned"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func extensionError(message string) error {
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "extensions: " + message,
+		Detail:  json.RawMessage(`{"field":"extensions"}`),
+	}
+}
+
+// validateExtensions checks that the requested extensions are allowed.
+func validateExtensions(exts []extensionRequest) error {
+	seen := make(map[string]bool, len(exts))
+	for _, e := range exts {
+		if !allowedExtensions[e.Name] {
+			return extensionError(fmt.Sprintf("%q is not allowed", e.Name))
+		}
+		if seen[e.Name] {
+			return extensionError(fmt.Sprintf("%q is given more than once", e.Name))
+		}
+		seen[e.Name] = true
+		if e.Version != "" && !validExtensionVersion.MatchString(e.Version) {
+			return extensionError(fmt.Sprintf("the version of %q is invalid", e.Name))
+		}
+	}
+	return nil
+}
+
+// createExtensions installs extensions in a new database and records the
+// versions installed.
+func createExtensions(state *postgres.DB, b *backend, resource, database string, exts []extensionRequest) error {
+	if len(exts) == 0 {
+		return nil
+	}
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, e := range exts {
+		stmt := fmt.Sprintf(`CREATE EXTENSION IF NOT EXISTS "%s"`, e.Name)
+		if e.Version != "" {
+			stmt += fmt.Sprintf(` VERSION '%s'`, e.Version)
+		}
+		if _, err := conn.Exec(stmt); err != nil {
+			// invalid_parameter_value for unknown versions
+			if postgres.IsPostgresCode(err, "22023") {
+				return extensionError(err.(pgx.PgError).Message)
+			}
+			return err
+		}
+		var version string
+		if err := conn.QueryRow(`SELECT extversion FROM pg_extension WHERE extname = $1`, e.Name).Scan(&version); err != nil {
+			return err
+		}
+		if err := state.Exec(`INSERT INTO extensions (resource, name, version, pinned) VALUES ($1, $2, $3, $4)`,
+			resource, e.Name, version, e.Version != ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getDatabaseExtensions lists the extensions installed in a resource's
+// database by the provider.
+func (p *pgAPI) getDatabaseExtensions(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	rows, err := p.state.Query(`SELECT name, version, pinned, updated_at FROM extensions WHERE resource = $1 ORDER BY name`, r.UUID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	installed := []*installedExtension{}
+	for rows.Next() {
+		e := &installedExtension{}
+		if err := rows.Scan(&e.Name, &e.Version, &e.Pinned, &e.UpdatedAt); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		installed = append(installed, e)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, installed)
+}
+
+type upgradeExtensionRequest struct {
+	Version string `json:"version"`
+}
+
+// upgradeExtension updates an extension installed in a resource's database
+// to the given version, or the default one, and pins it if a version is
+// given.
+func (p *pgAPI) upgradeExtension(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	name := params.ByName("name")
+	var config upgradeExtensionRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil && err != io.EOF {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.Version != "" && !validExtensionVersion.MatchString(config.Version) {
+		httphelper.ValidationError(w, "version", "is invalid")
+		return
+	}
+	var exists bool
+	if err := p.state.QueryRow(`SELECT EXISTS (SELECT 1 FROM extensions WHERE resource = $1 AND name = $2)`, r.UUID, name).Scan(&exists); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if !exists {
+		httphelper.Error(w, errExtensionNotInstalled)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	conn, err := pgx.Connect(r.Backend.connConfig(r.Database))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	defer conn.Close()
+	stmt := fmt.Sprintf(`ALTER EXTENSION "%s" UPDATE`, name)
+	if config.Version != "" {
+		stmt += fmt.Sprintf(` TO '%s'`, config.Version)
+	}
+	if _, err := conn.Exec(stmt); err != nil {
+		if postgres.IsPostgresCode(err, "22023") {
+			httphelper.ValidationError(w, "version", err.(pgx.PgError).Message)
+			return
+		}
+		httphelper.Error(w, err)
+		return
+	}
+	e := &installedExtension{Name: name, Pinned: config.Version != ""}
+	if err := conn.QueryRow(`SELECT extversion FROM pg_extension WHERE extname = $1`, name).Scan(&e.Version); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := p.state.QueryRow(`UPDATE extensions SET version = $1, pinned = $2, updated_at = now() WHERE resource = $3 AND name = $4 RETURNING updated_at`,
+		e.Version, e.Pinned, r.UUID, name).Scan(&e.UpdatedAt); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, e)
+}
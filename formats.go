@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// connectionFormats are the additional connection strings which can be
+// included in the resource env with CONNECTION_FORMATS.
+var connectionFormats = map[string]func(b *backend, env map[string]string, username, password, database string){
+	"jdbc":       jdbcURL,
+	"dotnet":     dotnetConnectionString,
+	"sqlalchemy": sqlalchemyURL,
+}
+
+func addConnectionFormats(b *backend, env map[string]string, username, password, database string) {
+	for _, name := range enabledFormats {
+		connectionFormats[name](b, env, username, password, database)
+	}
+}
+
+// jdbcURL sets JDBC_DATABASE_URL for the PostgreSQL JDBC driver, which
+// doesn't support Unix sockets without extra libraries.
+func jdbcURL(b *backend, env map[string]string, username, password, database string) {
+	host, port := b.appAddr()
+	if isSocket(host) {
+		return
+	}
+	q := url.Values{"user": {username}, "password": {password}, "sslmode": {b.appSSLMode()}}
+	if resourceRootCert != "" {
+		q.Set("sslrootcert", resourceRootCert)
+	}
+	env["JDBC_DATABASE_URL"] = fmt.Sprintf("jdbc:postgresql://%s/%s?%s", net.JoinHostPort(host, port), url.PathEscape(database), q.Encode())
+}
+
+var npgsqlSSLModes = map[string]string{
+	"disable":     "Disable",
+	"allow":       "Allow",
+	"prefer":      "Prefer",
+	"require":     "Require",
+	"verify-ca":   "VerifyCA",
+	"verify-full": "VerifyFull",
+}
+
+// dotnetConnectionString sets DOTNET_CONNECTION_STRING in the format used
+// by Npgsql.
+func dotnetConnectionString(b *backend, env map[string]string, username, password, database string) {
+	host, port := b.appAddr()
+	params := []string{
+		"Host=" + quoteConnValue(host),
+		"Port=" + port,
+		"Database=" + quoteConnValue(database),
+		"Username=" + quoteConnValue(username),
+		"Password=" + quoteConnValue(password),
+		"SSL Mode=" + npgsqlSSLModes[b.appSSLMode()],
+	}
+	if resourceRootCert != "" {
+		params = append(params, "Root Certificate="+quoteConnValue(resourceRootCert))
+	}
+	env["DOTNET_CONNECTION_STRING"] = strings.Join(params, ";")
+}
+
+// quoteConnValue quotes a connection string value if it contains characters
+// which are significant to the ADO.NET connection string syntax.
+func quoteConnValue(s string) string {
+	if !strings.ContainsAny(s, `;="' `) {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// sqlalchemyURL sets SQLALCHEMY_DATABASE_URI, which is DATABASE_URL with the
+// dialect and driver SQLAlchemy expects.
+func sqlalchemyURL(b *backend, env map[string]string, username, password, database string) {
+	env["SQLALCHEMY_DATABASE_URI"] = "postgresql+psycopg2" + strings.TrimPrefix(b.databaseURL(username, password, database), "postgres")
+}
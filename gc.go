@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// leakedRoles lists the roles on b which the provider created, as its
+// membership of them shows, but which own no database and aren't tracked in
+// the state database, e.g. those left behind by provisions which failed
+// after creating the role before failures were rolled back.
+func leakedRoles(state *postgres.DB, b *backend) ([]string, error) {
+	tracked, err := trackedNames(state)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := backendRoles(b)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.db.Query(`SELECT DISTINCT o.rolname::text FROM pg_database d JOIN pg_roles o ON o.oid = d.datdba`)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		owners[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var leaked []string
+	for name, managed := range roles {
+		if managed && !tracked[name] && !owners[name] && shouldBeTracked(name) {
+			leaked = append(leaked, name)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked, nil
+}
+
+// runGC implements the gc command, which drops leaked roles on every
+// backend. It lists them and asks for confirmation first, unless --yes is
+// given, and only lists them with --dry-run.
+func runGC(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the roles which would be dropped without dropping them")
+	yes := flags.Bool("yes", false, "drop the roles without asking for confirmation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	backends, err := openBackends()
+	if err != nil {
+		return err
+	}
+	state, err := openState(backends.main)
+	if err != nil {
+		return err
+	}
+
+	leaked := make(map[*backend][]string)
+	var total int
+	for _, b := range backends.all() {
+		roles, err := leakedRoles(state, b)
+		if err != nil {
+			return fmt.Errorf("error listing roles on backend %s: %s", b.name, err)
+		}
+		for _, role := range roles {
+			fmt.Fprintf(stdout, "%s\t%s\n", b.name, role)
+		}
+		leaked[b] = roles
+		total += len(roles)
+	}
+	if total == 0 {
+		fmt.Fprintln(stdout, "no leaked roles found")
+		return nil
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, "%d leaked roles would be dropped\n", total)
+		return nil
+	}
+	if !*yes {
+		fmt.Fprintf(stdout, "drop %d leaked roles? [y/N] ", total)
+		answer, _ := bufio.NewReader(stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return fmt.Errorf("aborted")
+		}
+	}
+
+	var failed int
+	for _, b := range backends.all() {
+		if len(leaked[b]) == 0 {
+			continue
+		}
+		if err := b.checkPrimary(); err != nil {
+			return fmt.Errorf("error checking backend %s: %s", b.name, err)
+		}
+		for _, role := range leaked[b] {
+			// roles owning objects in other databases fail to drop, and are
+			// left for an operator to look at
+			err := b.db.Exec(fmt.Sprintf(`DROP ROLE IF EXISTS "%s"`, role))
+			audit(origin{Source: "gc"}, securityDestructive, "gc_role", role, err)
+			if err != nil {
+				fmt.Fprintf(stdout, "error dropping role %s on backend %s: %s\n", role, b.name, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(stdout, "dropped role %s on backend %s\n", role, b.name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d roles could not be dropped", failed, total)
+	}
+	return nil
+}
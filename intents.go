@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+)
+
+// errInterrupted is the status message of a resource whose provisioning was
+// rolled back by the janitor.
+const errInterrupted = "provisioning was interrupted"
+
+// A provisioning intent is recorded along with a new resource, before any of
+// its objects are created on the backend, and removed once the resource is
+// ready or everything created for it has been dropped. An intent left behind
+// marks a provision which died mid-flight, or whose rollback failed.
+
+// completeProvision marks a resource as ready and removes its intent, unless
+// the janitor has already rolled it back.
+func completeProvision(state *postgres.DB, uuid string) error {
+	tx, err := state.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id string
+	err = tx.QueryRow(`UPDATE resources SET status = $1, status_message = '', status_changed_at = now() WHERE uuid = $2 AND status = $3 RETURNING uuid`, statusReady, uuid, statusProvisioning).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("%s: %s", errInterrupted, resourceID(uuid))
+	} else if err != nil {
+		return err
+	}
+	if err := tx.Exec(`DELETE FROM provision_intents WHERE resource = $1`, uuid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rollbackProvision drops whatever was created on the backend for a resource
+// which failed to provision, and removes its intent if that succeeded so
+// that the janitor doesn't try again.
+func rollbackProvision(state *postgres.DB, r *resourceRef) error {
+	if err := dropResource(state, r, nil); err != nil {
+		logger.Error("error rolling back provision", "id", r.id(), "database", r.Database, "err", err)
+		return err
+	}
+	return clearIntent(state, r.UUID)
+}
+
+func clearIntent(state *postgres.DB, uuid string) error {
+	err := state.Exec(`DELETE FROM provision_intents WHERE resource = $1`, uuid)
+	if err != nil {
+		logger.Error("error removing provisioning intent", "id", resourceID(uuid), "err", err)
+	}
+	return err
+}
+
+// provisionJanitor rolls back provisions which died mid-flight, e.g. when the
+// process crashed between creating a role and its database, and retries the
+// rollback of failed provisions. A provision is presumed dead once it has
+// been running for PROVISION_TIMEOUT.
+type provisionJanitor struct {
+	state    *postgres.DB
+	backends *backendSet
+	timeout  time.Duration
+}
+
+func (j *provisionJanitor) run(interval time.Duration) {
+	for {
+		if err := j.check(); err != nil {
+			logger.Error("error checking provisioning intents", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (j *provisionJanitor) check() error {
+	rows, err := j.state.Query(`
+SELECT r.uuid, r.username, r.database, r.region FROM provision_intents i JOIN resources r ON r.uuid = i.resource
+WHERE r.status = $1 OR (r.status = $2 AND i.created_at < now() - make_interval(secs => $3))`,
+		statusFailed, statusProvisioning, j.timeout.Seconds())
+	if err != nil {
+		return err
+	}
+	var resources []*resourceRef
+	for rows.Next() {
+		r := &resourceRef{}
+		var region *string
+		if err := rows.Scan(&r.UUID, &r.Username, &r.Database, &region); err != nil {
+			rows.Close()
+			return err
+		}
+		if r.Backend, err = j.backends.forRegion(region); err != nil {
+			logger.Error("error rolling back provision", "database", r.Database, "err", err)
+			continue
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range resources {
+		// fail the resource first, so that a provision which is merely slow
+		// can't complete while it is being dropped
+		if err := j.state.Exec(`UPDATE resources SET status = $1, status_message = $2, status_changed_at = now() WHERE uuid = $3 AND status = $4`,
+			statusFailed, errInterrupted, r.UUID, statusProvisioning); err != nil {
+			return err
+		}
+		err := rollbackProvision(j.state, r)
+		audit(origin{}, securityDestructive, "rollback_provision", r.id(), err)
+		if err == nil {
+			logger.Info("rolled back interrupted provision", "id", r.id(), "database", r.Database)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// resourceInfo is a provisioned resource as listed by GET /databases.
+type resourceInfo struct {
+	ID            string     `json:"id"`
+	UUID          string     `json:"uuid"`
+	Database      string     `json:"database"`
+	Username      string     `json:"username"`
+	Region        string     `json:"region"`
+	App           string     `json:"app"`
+	Env           string     `json:"env"`
+	Comment       string     `json:"comment"`
+	Tags          []string   `json:"tags"`
+	QuotaBytes    *int64     `json:"quota_bytes"`
+	Parent        *string    `json:"parent"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	Status        string     `json:"status"`
+	StatusMessage string     `json:"status_message"`
+	CreatedBy     string     `json:"created_by"`
+	SizeBytes     *int64     `json:"size_bytes,omitempty"`
+}
+
+// resourceInfoFields are the field names accepted by ?fields=.
+var resourceInfoFields = map[string]bool{
+	"id": true, "uuid": true, "database": true, "username": true, "region": true,
+	"app": true, "env": true, "comment": true, "tags": true,
+	"quota_bytes": true, "parent": true, "created_at": true, "expires_at": true,
+	"status": true, "status_message": true, "created_by": true, "size_bytes": true,
+}
+
+// resourceInfoColumns selects a resourceInfo from the resources table, with
+// $1 being the main backend's region.
+const resourceInfoColumns = `uuid, database, username, coalesce(region, $1), app, env, comment, tags, quota_bytes, parent, created_at, expires_at, status, status_message, coalesce(created_by, '')`
+
+type scanner interface {
+	Scan(...interface{}) error
+}
+
+func scanResourceInfo(s scanner) (*resourceInfo, error) {
+	r := &resourceInfo{}
+	if err := s.Scan(&r.UUID, &r.Database, &r.Username, &r.Region, &r.App, &r.Env, &r.Comment, &r.Tags, &r.QuotaBytes, &r.Parent, &r.CreatedAt, &r.ExpiresAt, &r.Status, &r.StatusMessage, &r.CreatedBy); err != nil {
+		return nil, err
+	}
+	r.ID = resourceID(r.UUID)
+	return r, nil
+}
+
+// listSorts maps the orderings accepted by ?sort= to their columns. Sorting
+// by size is done in memory as sizes come from the backends.
+var listSorts = map[string]string{
+	"created_at": "created_at",
+	"name":       "database",
+	"size":       "",
+}
+
+type resourceList struct {
+	Resources  []interface{} `json:"resources"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// listCursor is the position after the last resource of a page, encoded as
+// an opaque string so the ordering can change without breaking clients. Key
+// is the value of the sort field.
+type listCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	UUID string `json:"u"`
+}
+
+func (c *listCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseCursor(s, sortBy string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &listCursor{}
+	if err := json.Unmarshal(data, c); err != nil || c.Sort != sortBy || !uuidPattern.MatchString(c.UUID) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+func cursorFor(r *resourceInfo, sortBy string) *listCursor {
+	c := &listCursor{Sort: sortBy, UUID: r.UUID}
+	switch strings.TrimPrefix(sortBy, "-") {
+	case "created_at":
+		c.Key = r.CreatedAt.Format(time.RFC3339Nano)
+	case "name":
+		c.Key = r.Database
+	case "size":
+		c.Key = strconv.FormatInt(*r.SizeBytes, 10)
+	}
+	return c
+}
+
+// listDatabases lists the resources in the state database, filtered by
+// ?name= (matching part of the database or role name), ?tag= (repeatable,
+// all must match), ?region=, ?status= and ?tenant=, a page of ?limit= at a time. ?sort= orders
+// them by created_at (the default), name or size, descending when prefixed
+// with "-", and ?fields= selects the fields returned for each resource.
+func (p *pgAPI) listDatabases(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	limit := defaultPageSize
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			httphelper.ValidationError(w, "limit", fmt.Sprintf("must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+	sortBy := req.FormValue("sort")
+	if sortBy == "" {
+		sortBy = "created_at"
+	}
+	column, ok := listSorts[strings.TrimPrefix(sortBy, "-")]
+	if !ok {
+		httphelper.ValidationError(w, "sort", "must be one of created_at, name, size")
+		return
+	}
+	desc := strings.HasPrefix(sortBy, "-")
+	var fields []string
+	withSize := column == ""
+	if s := req.FormValue("fields"); s != "" {
+		for _, f := range strings.Split(s, ",") {
+			if !resourceInfoFields[f] {
+				httphelper.ValidationError(w, "fields", fmt.Sprintf("contains unknown field %q", f))
+				return
+			}
+			fields = append(fields, f)
+			withSize = withSize || f == "size_bytes"
+		}
+	}
+	tags := req.Form["tag"]
+	if err := validateTags(tags); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	status := req.FormValue("status")
+	if status != "" && !validStatus[status] {
+		httphelper.ValidationError(w, "status", "is not a valid status")
+		return
+	}
+	var cursor *listCursor
+	if s := req.FormValue("cursor"); s != "" {
+		var err error
+		if cursor, err = parseCursor(s, sortBy); err != nil {
+			httphelper.ValidationError(w, "cursor", "is invalid")
+			return
+		}
+	}
+
+	args := []interface{}{p.backend.region}
+	var where []string
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if name := req.FormValue("name"); name != "" {
+		n := arg(name)
+		where = append(where, fmt.Sprintf("(strpos(database, %s) > 0 OR strpos(username, %s) > 0)", n, n))
+	}
+	if len(tags) > 0 {
+		where = append(where, "tags @> "+arg(tags))
+	}
+	if region := req.FormValue("region"); region != "" {
+		where = append(where, "coalesce(region, $1) = "+arg(region))
+	}
+	if status != "" {
+		where = append(where, "status = "+arg(status))
+	}
+	// tenant scoped API keys only see their own tenant's resources
+	tenant := req.FormValue("tenant")
+	if t := callerTenant(ctx); t != "" {
+		tenant = t
+	}
+	if tenant != "" {
+		where = append(where, "tenant = "+arg(tenant))
+	}
+	order := "ASC"
+	cmp := ">"
+	if desc {
+		order, cmp = "DESC", "<"
+	}
+	if cursor != nil && column != "" {
+		key := arg(cursor.Key)
+		if column == "created_at" {
+			key += "::timestamptz"
+		}
+		where = append(where, fmt.Sprintf("(%s, uuid) %s (%s, %s)", column, cmp, key, arg(cursor.UUID)))
+	}
+	query := `SELECT ` + resourceInfoColumns + ` FROM resources`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if column != "" {
+		query += fmt.Sprintf(" ORDER BY %s %s, uuid %s", column, order, order)
+		// fetch one more than requested to know whether there is another
+		// page
+		query += " LIMIT " + arg(limit+1)
+	}
+
+	rows, err := p.state.Query(query, args...)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var resources []*resourceInfo
+	for rows.Next() {
+		r, err := scanResourceInfo(rows)
+		if err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	if withSize {
+		if err := p.addSizes(resources); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+	if column == "" {
+		resources = sortBySize(resources, desc, cursor, limit+1)
+	}
+
+	list := &resourceList{Resources: make([]interface{}, 0, len(resources))}
+	if len(resources) > limit {
+		resources = resources[:limit]
+		list.NextCursor = cursorFor(resources[limit-1], sortBy).String()
+	}
+	for _, r := range resources {
+		list.Resources = append(list.Resources, selectFields(r, fields))
+	}
+	httphelper.JSON(w, 200, list)
+}
+
+// addSizes sets the current size of each resource's database, with one
+// query per backend.
+func (p *pgAPI) addSizes(resources []*resourceInfo) error {
+	for _, b := range p.backends.all() {
+		rows, err := b.db.Query(`SELECT datname::text, pg_database_size(oid) FROM pg_database WHERE NOT datistemplate`)
+		if err != nil {
+			return err
+		}
+		sizes := make(map[string]int64)
+		for rows.Next() {
+			var name string
+			var size int64
+			if err := rows.Scan(&name, &size); err != nil {
+				rows.Close()
+				return err
+			}
+			sizes[name] = size
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range resources {
+			if size, ok := sizes[r.Database]; ok && r.Region == b.region {
+				r.SizeBytes = &size
+			}
+		}
+	}
+	return nil
+}
+
+// bySize sorts resources whose sizes have been set by size, then UUID.
+type bySize struct {
+	resources []*resourceInfo
+	desc      bool
+}
+
+func (s bySize) Len() int      { return len(s.resources) }
+func (s bySize) Swap(i, j int) { s.resources[i], s.resources[j] = s.resources[j], s.resources[i] }
+func (s bySize) Less(i, j int) bool {
+	a, b := s.resources[i], s.resources[j]
+	if s.desc {
+		a, b = b, a
+	}
+	if *a.SizeBytes != *b.SizeBytes {
+		return *a.SizeBytes < *b.SizeBytes
+	}
+	return a.UUID < b.UUID
+}
+
+// sortBySize orders resources by size (then UUID), skips those up to the
+// cursor and returns at most n. Resources whose database is missing sort as
+// empty.
+func sortBySize(resources []*resourceInfo, desc bool, cursor *listCursor, n int) []*resourceInfo {
+	for _, r := range resources {
+		if r.SizeBytes == nil {
+			r.SizeBytes = new(int64)
+		}
+	}
+	less := func(size int64, uuid string, r *resourceInfo) bool {
+		if size != *r.SizeBytes {
+			return size < *r.SizeBytes
+		}
+		return uuid < r.UUID
+	}
+	sort.Sort(bySize{resources, desc})
+	if cursor != nil {
+		size, _ := strconv.ParseInt(cursor.Key, 10, 64)
+		i := sort.Search(len(resources), func(i int) bool {
+			if desc {
+				return less(*resources[i].SizeBytes, resources[i].UUID, &resourceInfo{SizeBytes: &size, UUID: cursor.UUID})
+			}
+			return less(size, cursor.UUID, resources[i])
+		})
+		resources = resources[i:]
+	}
+	if len(resources) > n {
+		resources = resources[:n]
+	}
+	return resources
+}
+
+// selectFields returns v with only the given JSON fields, or v itself if no
+// fields are given.
+func selectFields(v interface{}, fields []string) interface{} {
+	if len(fields) == 0 {
+		return v
+	}
+	data, _ := json.Marshal(v)
+	var all map[string]json.RawMessage
+	json.Unmarshal(data, &all)
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		selected[f] = all[f]
+	}
+	return selected
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/sse"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var validJobState = map[string]bool{jobQueued: true, jobRunning: true, jobSucceeded: true, jobFailed: true, jobCancelled: true}
+
+var (
+	errJobNotFound   = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "job not found"}
+	errJobFinished   = httphelper.JSONError{Code: httphelper.PreconditionFailedErrorCode, Message: "the job has already finished"}
+	errJobCancelled  = fmt.Errorf("cancelled")
+	errJobNotRunning = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "the job is not running in this process and cannot be cancelled"}
+	errQueueFull     = httphelper.JSONError{Code: httphelper.RatelimitedErrorCode, Message: "too many jobs are queued, retry later", Retry: true}
+	errDraining      = httphelper.JSONError{Code: httphelper.ServiceUnavailableErrorCode, Message: "the provider is shutting down, retry later", Retry: true}
+)
+
+// jobCancelWait is how long a shutdown waits for the jobs it cancels to stop
+// at the end of their current step.
+const jobCancelWait = 10 * time.Second
+
+// queueRetryAfter is the Retry-After given to clients when the job queue is
+// full.
+const queueRetryAfter = "30"
+
+// job is a long running operation on a resource, run in the background.
+// Resource identifies what the job operates on, a resource ID or for jobs
+// covering several resources, the filter selecting them.
+type job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Resource   string     `json:"resource"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Requester  string     `json:"requester,omitempty"`
+}
+
+const jobColumns = `id, type, resource, state, error, created_at, finished_at, coalesce(requester, '')`
+
+func scanJob(s scanner) (*job, error) {
+	j := &job{}
+	err := s.Scan(&j.ID, &j.Type, &j.Resource, &j.State, &j.Error, &j.CreatedAt, &j.FinishedAt, &j.Requester)
+	return j, err
+}
+
+// jobLog is a line logged by a job, marking the completion of a stage of
+// the operation when Stage is set.
+type jobLog struct {
+	Time    time.Time `json:"time"`
+	Stage   string    `json:"stage,omitempty"`
+	Message string    `json:"message"`
+}
+
+// jobRun is passed to a running job, to record its progress and check
+// whether it has been cancelled. Its methods do nothing when called on nil,
+// so operations can report progress whether or not they run as a job.
+type jobRun struct {
+	id     string
+	runner *jobRunner
+	ctx    context.Context
+}
+
+// logf appends a line to the job's log.
+func (r *jobRun) logf(format string, args ...interface{}) {
+	r.stage("", format, args...)
+}
+
+// stage logs the completion of a stage of the job.
+func (r *jobRun) stage(stage, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	e := &jobEvent{Event: "log", Stage: stage, Message: redact(fmt.Sprintf(format, args...))}
+	if err := r.runner.state.QueryRow(`INSERT INTO job_logs (job, stage, message) VALUES ($1, $2, $3) RETURNING id, time`,
+		r.id, e.Stage, e.Message).Scan(&e.ID, &e.Time); err != nil {
+		logger.Error("error writing job log", "job", r.id, "err", err)
+		return
+	}
+	r.runner.publish(r.id, e, false)
+}
+
+// cancelled returns errJobCancelled once the job has been cancelled. Jobs
+// check it between steps, so a step in progress always completes.
+func (r *jobRun) cancelled() error {
+	if r == nil {
+		return nil
+	}
+	select {
+	case <-r.ctx.Done():
+		return errJobCancelled
+	default:
+		return nil
+	}
+}
+
+// jobRunner runs jobs in the background with a fixed number of workers and
+// records them in the state database, keeping track of those queued or
+// running in this process so they can be cancelled and their progress
+// followed. Jobs are refused once the queue is full, rather than letting
+// work pile up.
+//
+// Queued jobs wait in a queue per tenant, and workers take turns between
+// the tenants with jobs waiting, so that one tenant's batch can't hold up
+// everyone else's. At most backendWorkers jobs run against a backend at
+// once; a job whose backend is busy is passed over for the next one which
+// can run.
+type jobRunner struct {
+	state          *postgres.DB
+	workers        int
+	backendWorkers int
+	queueSize      int
+
+	mtx    sync.Mutex
+	queued int
+	active int
+	// pending are the queued jobs of each tenant, and tenants those with
+	// jobs pending, next to be served first
+	pending        map[string][]*queuedJob
+	tenants        []string
+	backendRunning map[string]int
+	cancels        map[string]context.CancelFunc
+	subs           map[string]map[chan *jobEvent]struct{}
+	// stopped is set once the runner is draining for a shutdown, and
+	// interrupted once it has cancelled the jobs still running. idle is
+	// closed when no more jobs are running.
+	stopped     bool
+	interrupted bool
+	idle        chan struct{}
+}
+
+type queuedJob struct {
+	job     *job
+	run     *jobRun
+	cancel  context.CancelFunc
+	fn      func(*jobRun) error
+	tenant  string
+	backend string
+	params  string
+}
+
+// newJobRunner returns a job runner with the given number of workers, of
+// which at most backendWorkers work on the same backend.
+func newJobRunner(state *postgres.DB, workers, backendWorkers, queueSize int) *jobRunner {
+	return &jobRunner{
+		state:          state,
+		workers:        workers,
+		backendWorkers: backendWorkers,
+		queueSize:      queueSize,
+		pending:        make(map[string][]*queuedJob),
+		backendRunning: make(map[string]int),
+		cancels:        make(map[string]context.CancelFunc),
+		subs:           make(map[string]map[chan *jobEvent]struct{}),
+	}
+}
+
+// failInterrupted marks the jobs left queued or running by a previous
+// process as failed, unless they were checkpointed to be resumed.
+func (jr *jobRunner) failInterrupted() error {
+	return jr.state.Exec(`UPDATE jobs SET state = 'failed', error = 'interrupted by a restart of the provider', finished_at = now() WHERE state IN ('queued', 'running') AND checkpointed_at IS NULL`)
+}
+
+// errShutdown is the error of jobs interrupted by a shutdown which can't be
+// resumed.
+const errShutdown = "interrupted by a shutdown of the provider"
+
+// draining reports whether the runner has stopped starting jobs for a
+// shutdown.
+func (jr *jobRunner) draining() bool {
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	return jr.stopped
+}
+
+// drain prepares the runner for a shutdown: no more jobs are started, and
+// those running are given up to timeout to finish. The rest are then
+// cancelled, stopping once their current step completes. Jobs which can be
+// resumed are left queued in the state database, checkpointed for the next
+// process to resume, and the others are marked as failed.
+func (jr *jobRunner) drain(timeout time.Duration) {
+	jr.mtx.Lock()
+	jr.stopped = true
+	idle := make(chan struct{})
+	if jr.active == 0 {
+		close(idle)
+	} else {
+		jr.idle = idle
+		logger.Info("waiting for jobs to finish before shutting down", "running", jr.active, "timeout", timeout)
+	}
+	jr.mtx.Unlock()
+
+	select {
+	case <-idle:
+	case <-time.After(timeout):
+		jr.mtx.Lock()
+		jr.interrupted = true
+		logger.Warn("cancelling jobs still running", "running", jr.active)
+		for _, cancel := range jr.cancels {
+			cancel()
+		}
+		jr.mtx.Unlock()
+		select {
+		case <-idle:
+		case <-time.After(jobCancelWait):
+			// these are resumed from the start
+			logger.Warn("jobs did not stop before shutting down")
+		}
+	}
+
+	// the jobs left are those still queued, and any which didn't stop
+	jr.mtx.Lock()
+	ids := make([]string, 0, len(jr.cancels))
+	for id := range jr.cancels {
+		ids = append(ids, id)
+	}
+	jr.mtx.Unlock()
+	for _, id := range ids {
+		err := jr.state.Exec(`UPDATE jobs SET checkpointed_at = now() WHERE id = $1 AND state IN ('queued', 'running') AND params IS NOT NULL`, id)
+		if err == nil {
+			err = jr.state.Exec(`UPDATE jobs SET state = 'failed', error = $1, finished_at = now() WHERE id = $2 AND state = 'queued' AND params IS NULL`, errShutdown, id)
+		}
+		if err != nil {
+			logger.Error("error checkpointing job", "job", id, "err", err)
+		}
+	}
+}
+
+// resume queues a job checkpointed by a previous process again.
+func (jr *jobRunner) resume(j *job, tenant, backend, params string, fn func(*jobRun) error) error {
+	if err := jr.state.Exec(`UPDATE jobs SET state = $1, checkpointed_at = NULL WHERE id = $2`, jobQueued, j.ID); err != nil {
+		return err
+	}
+	(&jobRun{id: j.ID, runner: jr}).logf("resumed after a restart of the provider")
+	jr.mtx.Lock()
+	jr.queued++
+	jr.mtx.Unlock()
+	jr.enqueue(j, tenant, backend, params, fn)
+	return nil
+}
+
+// startOperation starts a job running an operation on r which can be resumed
+// after a shutdown, see operationFunc.
+func (p *pgAPI) startOperation(typ string, r *resourceRef, source origin, params interface{}) (*job, bool, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, false, err
+	}
+	fn, err := p.operationFunc(typ, r, source, string(data))
+	if err != nil {
+		return nil, false, err
+	}
+	return p.jobs.startResumable(typ, r.id(), r.Tenant, source.Requester, r.Backend.name, string(data), fn)
+}
+
+// resumeJobs queues the jobs checkpointed by the last shutdown again, and
+// marks those which can no longer run, e.g. because their resource is gone,
+// as failed. They are resumed from the start, the operations being safe to
+// repeat after being stopped between steps.
+func (p *pgAPI) resumeJobs() error {
+	type checkpointed struct {
+		*job
+		tenant, params string
+	}
+	rows, err := p.state.Query(`SELECT ` + jobColumns + `, coalesce(tenant, ''), params FROM jobs WHERE state IN ('queued', 'running') AND checkpointed_at IS NOT NULL ORDER BY created_at`)
+	if err != nil {
+		return err
+	}
+	var jobs []*checkpointed
+	for rows.Next() {
+		c := &checkpointed{job: &job{}}
+		if err := rows.Scan(&c.ID, &c.Type, &c.Resource, &c.State, &c.Error, &c.CreatedAt, &c.FinishedAt, &c.Requester, &c.tenant, &c.params); err != nil {
+			rows.Close()
+			return err
+		}
+		jobs = append(jobs, c)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range jobs {
+		r, err := p.resolveAnyID(c.Resource)
+		var fn func(*jobRun) error
+		if err == nil {
+			fn, err = p.operationFunc(c.Type, r, origin{Source: "resume", Requester: c.Requester}, c.params)
+		}
+		if err == nil {
+			err = p.jobs.resume(c.job, c.tenant, r.Backend.name, c.params, fn)
+		}
+		if err != nil {
+			logger.Error("error resuming job", "job", c.ID, "type", c.Type, "resource", c.Resource, "err", err)
+			if err := p.state.Exec(`UPDATE jobs SET state = 'failed', error = $1, finished_at = now(), params = NULL WHERE id = $2`,
+				"could not be resumed after a restart of the provider: "+redact(err.Error()), c.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		logger.Info("resumed job", "job", c.ID, "type", c.Type, "resource", c.Resource)
+	}
+	return nil
+}
+
+// depth returns the number of jobs waiting for a worker.
+func (jr *jobRunner) depth() int {
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	return jr.queued
+}
+
+// start records a job and queues fn to run in the background, recording its
+// outcome once it returns. Only one job of each type may be queued or run for
+// a resource at a time, if there already is one it is returned instead with
+// started set to false. errQueueFull is returned if the queue is full. Jobs
+// for a tenant are visible to its API keys, other jobs only to admins.
+// requester records who started the job, and backend is the name of the
+// backend it works on, empty for jobs which may work on several.
+func (jr *jobRunner) start(typ, resource, tenant, requester, backend string, fn func(*jobRun) error) (j *job, started bool, err error) {
+	return jr.startResumable(typ, resource, tenant, requester, backend, "", fn)
+}
+
+// startResumable starts a job like start, which if params is set can be
+// resumed after being interrupted by a shutdown, by passing params to
+// operationFunc. errDraining is returned once the runner is draining.
+func (jr *jobRunner) startResumable(typ, resource, tenant, requester, backend, params string, fn func(*jobRun) error) (j *job, started bool, err error) {
+	jr.mtx.Lock()
+	if jr.stopped {
+		jr.mtx.Unlock()
+		return nil, false, errDraining
+	}
+	if jr.queued >= jr.queueSize {
+		jr.mtx.Unlock()
+		if j, err := jr.running(typ, resource); err == nil {
+			return j, false, nil
+		}
+		return nil, false, errQueueFull
+	}
+	jr.queued++
+	jr.mtx.Unlock()
+	release := func() {
+		jr.mtx.Lock()
+		jr.queued--
+		jr.mtx.Unlock()
+	}
+
+	j, err = scanJob(jr.state.QueryRow(`
+INSERT INTO jobs (id, type, resource, state, tenant, requester, params) VALUES ($1, $2, $3, $4, nullif($5, ''), nullif($6, ''), nullif($7, ''))
+ON CONFLICT (type, resource) WHERE state IN ('queued', 'running') DO NOTHING
+RETURNING `+jobColumns, random.UUID(), typ, resource, jobQueued, tenant, requester, params))
+	if err == pgx.ErrNoRows {
+		release()
+		j, err = jr.running(typ, resource)
+		return j, false, err
+	}
+	if err != nil {
+		release()
+		return nil, false, err
+	}
+	jr.enqueue(j, tenant, backend, params, fn)
+	return j, true, nil
+}
+
+// enqueue adds a recorded job to its tenant's queue, which has been counted
+// in queued.
+func (jr *jobRunner) enqueue(j *job, tenant, backend, params string, fn func(*jobRun) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &queuedJob{job: j, run: &jobRun{id: j.ID, runner: jr, ctx: ctx}, cancel: cancel, fn: fn, tenant: tenant, backend: backend, params: params}
+	jr.mtx.Lock()
+	jr.cancels[j.ID] = cancel
+	if len(jr.pending[tenant]) == 0 {
+		jr.tenants = append(jr.tenants, tenant)
+	}
+	jr.pending[tenant] = append(jr.pending[tenant], q)
+	jr.dispatch()
+	jr.mtx.Unlock()
+}
+
+// dispatch starts queued jobs while there are idle workers, taking the
+// first job which can run from each tenant's queue in turn. It is called
+// with mtx held whenever a job is queued or finishes. Nothing is started
+// once the runner is draining.
+func (jr *jobRunner) dispatch() {
+	for !jr.stopped && jr.active < jr.workers {
+		q := jr.next()
+		if q == nil {
+			return
+		}
+		jr.queued--
+		jr.active++
+		jr.backendRunning[q.backend]++
+		go func() {
+			jr.runJob(q)
+			jr.mtx.Lock()
+			jr.active--
+			if jr.backendRunning[q.backend]--; jr.backendRunning[q.backend] == 0 {
+				delete(jr.backendRunning, q.backend)
+			}
+			if jr.active == 0 && jr.idle != nil {
+				close(jr.idle)
+				jr.idle = nil
+			}
+			jr.dispatch()
+			jr.mtx.Unlock()
+		}()
+	}
+}
+
+// next removes and returns the next job to run, or nil if none can run
+// yet. The tenant it belongs to goes to the back of the line.
+func (jr *jobRunner) next() *queuedJob {
+	for i, tenant := range jr.tenants {
+		queue := jr.pending[tenant]
+		for k, q := range queue {
+			if q.backend != "" && jr.backendRunning[q.backend] >= jr.backendWorkers {
+				continue
+			}
+			queue = append(queue[:k:k], queue[k+1:]...)
+			jr.tenants = append(jr.tenants[:i:i], jr.tenants[i+1:]...)
+			if len(queue) > 0 {
+				jr.pending[tenant] = queue
+				jr.tenants = append(jr.tenants, tenant)
+			} else {
+				delete(jr.pending, tenant)
+			}
+			return q
+		}
+	}
+	return nil
+}
+
+// runJob runs a job taken from the queue, unless it was cancelled while
+// queued.
+func (jr *jobRunner) runJob(q *queuedJob) {
+	j, run := q.job, q.run
+	err := run.cancelled()
+	if err == nil {
+		if err = jr.state.Exec(`UPDATE jobs SET state = 'running' WHERE id = $1`, j.ID); err == nil {
+			run.logf("started")
+			err = q.fn(run)
+		}
+	}
+	q.cancel()
+
+	jr.mtx.Lock()
+	interrupted := jr.interrupted
+	jr.mtx.Unlock()
+	res, msg := jobSucceeded, ""
+	if err == errJobCancelled && interrupted && q.params != "" {
+		// stopped by a shutdown, to be resumed by the next process
+		run.logf("interrupted by a shutdown of the provider, it will be resumed")
+		if err := jr.state.Exec(`UPDATE jobs SET state = $1, checkpointed_at = now() WHERE id = $2`, jobQueued, j.ID); err != nil {
+			logger.Error("error checkpointing job", "job", j.ID, "err", err)
+		}
+		jr.publish(j.ID, &jobEvent{Event: "state", Time: time.Now(), State: jobQueued}, true)
+		return
+	} else if err == errJobCancelled && interrupted {
+		res, msg = jobFailed, errShutdown
+		run.logf("failed: %s", msg)
+	} else if err == errJobCancelled {
+		res = jobCancelled
+		run.logf("cancelled")
+	} else if err != nil {
+		res, msg = jobFailed, redact(err.Error())
+		run.logf("failed: %s", err)
+		logger.Error("job failed", "job", j.ID, "type", j.Type, "resource", j.Resource, "err", err)
+	}
+	// params may hold credentials, which aren't needed once the job is over
+	if err := jr.state.Exec(`UPDATE jobs SET state = $1, error = $2, finished_at = now(), params = NULL WHERE id = $3`, res, msg, j.ID); err != nil {
+		logger.Error("error recording job result", "job", j.ID, "err", err)
+	}
+	jr.publish(j.ID, &jobEvent{Event: "state", Time: time.Now(), State: res, Error: msg}, true)
+}
+
+// running returns the job of the given type queued or running for a
+// resource.
+func (jr *jobRunner) running(typ, resource string) (*job, error) {
+	return scanJob(jr.state.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE type = $1 AND resource = $2 AND state IN ('queued', 'running')`, typ, resource))
+}
+
+// subscribe sends the events of a job running in this process to ch until it
+// finishes, when ch is closed. It returns false if the job isn't running.
+func (jr *jobRunner) subscribe(id string, ch chan *jobEvent) bool {
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	if _, ok := jr.cancels[id]; !ok {
+		return false
+	}
+	if jr.subs[id] == nil {
+		jr.subs[id] = make(map[chan *jobEvent]struct{})
+	}
+	jr.subs[id][ch] = struct{}{}
+	return true
+}
+
+func (jr *jobRunner) unsubscribe(id string, ch chan *jobEvent) {
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	if _, ok := jr.subs[id][ch]; ok {
+		delete(jr.subs[id], ch)
+		close(ch)
+	}
+}
+
+// publish sends an event to a job's subscribers. Subscribers which fall
+// behind are dropped, they can reconnect and resume from the last event they
+// received. The final event of a job closes all subscriptions.
+func (jr *jobRunner) publish(id string, e *jobEvent, final bool) {
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	for ch := range jr.subs[id] {
+		select {
+		case ch <- e:
+		default:
+			delete(jr.subs[id], ch)
+			close(ch)
+		}
+	}
+	if final {
+		for ch := range jr.subs[id] {
+			close(ch)
+		}
+		delete(jr.subs, id)
+		delete(jr.cancels, id)
+	}
+}
+
+func (jr *jobRunner) cancel(id string) bool {
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	cancel, ok := jr.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// lookupJob returns the job named by the :id parameter, if it is visible to
+// the caller.
+func (p *pgAPI) lookupJob(ctx context.Context, w http.ResponseWriter) (*job, bool) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	id := params.ByName("id")
+	if !uuidPattern.MatchString(id) {
+		httphelper.Error(w, errJobNotFound)
+		return nil, false
+	}
+	j, err := scanJob(p.state.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = $1 AND ($2 = '' OR tenant = $2)`, strings.ToLower(id), callerTenant(ctx)))
+	if err == pgx.ErrNoRows {
+		err = errJobNotFound
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return nil, false
+	}
+	return j, true
+}
+
+// listJobs lists the jobs visible to the caller, newest first, filtered by
+// ?type=, ?resource= and ?state=.
+func (p *pgAPI) listJobs(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	limit := defaultPageSize
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			httphelper.ValidationError(w, "limit", fmt.Sprintf("must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+	state := req.FormValue("state")
+	if state != "" && !validJobState[state] {
+		httphelper.ValidationError(w, "state", "must be one of queued, running, succeeded, failed, cancelled")
+		return
+	}
+	rows, err := p.state.Query(`
+SELECT `+jobColumns+` FROM jobs
+WHERE ($1 = '' OR type = $1) AND ($2 = '' OR resource = $2) AND ($3 = '' OR state = $3) AND ($5 = '' OR tenant = $5)
+ORDER BY created_at DESC LIMIT $4`, req.FormValue("type"), req.FormValue("resource"), state, limit, callerTenant(ctx))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	jobs := []*job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, jobs)
+}
+
+func (p *pgAPI) getJob(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	j, ok := p.lookupJob(ctx, w)
+	if !ok {
+		return
+	}
+	httphelper.JSON(w, 200, j)
+}
+
+func (p *pgAPI) getJobLogs(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	j, ok := p.lookupJob(ctx, w)
+	if !ok {
+		return
+	}
+	rows, err := p.state.Query(`SELECT time, stage, message FROM job_logs WHERE job = $1 ORDER BY id`, j.ID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	logs := []*jobLog{}
+	for rows.Next() {
+		l := &jobLog{}
+		if err := rows.Scan(&l.Time, &l.Stage, &l.Message); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		logs = append(logs, l)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, logs)
+}
+
+// cancelJob asks a running job to stop after its current step.
+func (p *pgAPI) cancelJob(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	j, ok := p.lookupJob(ctx, w)
+	if !ok {
+		return
+	}
+	if j.State != jobQueued && j.State != jobRunning {
+		httphelper.Error(w, errJobFinished)
+		return
+	}
+	if !p.jobs.cancel(j.ID) {
+		httphelper.Error(w, errJobNotRunning)
+		return
+	}
+	audit(requestOrigin(ctx, req), securityAdmin, "cancel_job", j.ID, nil)
+	httphelper.JSON(w, 202, j)
+}
+
+// jobError responds with an error starting a job, telling the client when to
+// retry if the queue is full.
+func jobError(w http.ResponseWriter, err error) {
+	if e, ok := err.(httphelper.JSONError); ok && e.Code == httphelper.RatelimitedErrorCode {
+		w.Header().Set("Retry-After", queueRetryAfter)
+	}
+	httphelper.Error(w, err)
+}
+
+// acceptJob responds with a job running in the background.
+func acceptJob(w http.ResponseWriter, j *job) {
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	httphelper.JSON(w, 202, j)
+}
+
+// jobEvent is streamed by GET /jobs/:id/events, either a log line or the
+// final state of the job.
+type jobEvent struct {
+	ID      int64     `json:"-"`
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Stage   string    `json:"stage,omitempty"`
+	Message string    `json:"message,omitempty"`
+	State   string    `json:"state,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (e *jobEvent) EventID() string {
+	return strconv.FormatInt(e.ID, 10)
+}
+
+const jobEventBuffer = 100
+
+// streamJobEvents streams a job's log as server-sent events, followed by its
+// final state. The log so far is sent first, or the part of it following the
+// Last-Event-ID header when resuming a stream.
+func (p *pgAPI) streamJobEvents(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	j, ok := p.lookupJob(ctx, w)
+	if !ok {
+		return
+	}
+	since, _ := strconv.ParseInt(req.Header.Get("Last-Event-ID"), 10, 64)
+
+	// subscribe before reading the log so that no line is missed, the
+	// lines read from both are told apart by their ID
+	live := make(chan *jobEvent, jobEventBuffer)
+	subscribed := p.jobs.subscribe(j.ID, live)
+	if subscribed {
+		defer p.jobs.unsubscribe(j.ID, live)
+	}
+
+	events := make(chan *jobEvent)
+	stream := sse.NewStream(w, events, logger)
+	stream.Serve()
+	go func() {
+		defer close(events)
+		send := func(e *jobEvent) bool {
+			select {
+			case events <- e:
+				return true
+			case <-stream.Done:
+				return false
+			}
+		}
+		rows, err := p.state.Query(`SELECT id, time, stage, message FROM job_logs WHERE job = $1 AND id > $2 ORDER BY id`, j.ID, since)
+		if err != nil {
+			stream.Error(err)
+			return
+		}
+		var logs []*jobEvent
+		for rows.Next() {
+			e := &jobEvent{Event: "log"}
+			if err := rows.Scan(&e.ID, &e.Time, &e.Stage, &e.Message); err != nil {
+				rows.Close()
+				stream.Error(err)
+				return
+			}
+			logs = append(logs, e)
+		}
+		if err := rows.Err(); err != nil {
+			stream.Error(err)
+			return
+		}
+		last := since
+		for _, e := range logs {
+			if !send(e) {
+				return
+			}
+			last = e.ID
+		}
+
+		if !subscribed {
+			j, err := scanJob(p.state.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = $1`, j.ID))
+			if err != nil {
+				stream.Error(err)
+				return
+			}
+			e := &jobEvent{ID: last, Event: "state", State: j.State, Error: j.Error, Time: j.CreatedAt}
+			if j.FinishedAt != nil {
+				e.Time = *j.FinishedAt
+			}
+			send(e)
+			return
+		}
+		for e := range live {
+			if e.Event == "state" {
+				// events are shared between subscribers
+				state := *e
+				state.ID = last
+				e = &state
+			} else if e.ID <= last {
+				continue
+			}
+			if !send(e) {
+				return
+			}
+			last = e.ID
+		}
+	}()
+	stream.Wait()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// activationListeners returns the sockets passed by systemd (or another
+// supervisor implementing the same protocol) via LISTEN_FDS, if any.
+func activationListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n == 0 {
+		return nil, nil
+	}
+	// don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listen returns the listeners to serve the API on, preferring sockets
+// passed by the supervisor over binding PORT and API_SOCKET.
+func listen() ([]net.Listener, error) {
+	listeners, err := activationListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	if apiSocket != "" {
+		l, err := listenUnix(apiSocket, apiSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if !apiDisableTCP {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "3000"
+		}
+		l, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix socket at path, replacing any stale socket
+// left behind by a previous run, and sets its permissions to mode.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// newServer returns the API server, tuned for controllers making frequent
+// requests over long lived connections. HTTP/2 is negotiated automatically
+// over TLS, and with API_H2C also accepted in cleartext from trusted callers.
+func newServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		IdleTimeout:       apiIdleTimeout,
+		MaxHeaderBytes:    apiMaxHeaderBytes,
+	}
+	srv.SetKeepAlivesEnabled(apiKeepAlive)
+	if apiH2C {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
+
+func serve(srv *http.Server, l net.Listener) error {
+	if apiTLSCert != "" {
+		return srv.ServeTLS(l, apiTLSCert, apiTLSKey)
+	}
+	return srv.Serve(l)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// parseLogSinks parses a comma separated list of log sinks into a handler
+// writing to all of them. A sink is one of:
+//
+//	stdout, stderr
+//	file:///path/to/file          rotated by size
+//	syslog:                       the local syslog daemon
+//	syslog+udp://host:port, syslog+tcp://host:port
+//
+// followed by options as query parameters: format (logfmt or json), level
+// (the minimum level, debug by default) and for files, max_size (default
+// 100MB) and max_files (the number of rotated files kept, default 5).
+func parseLogSinks(s string) (log15.Handler, error) {
+	var handlers []log15.Handler
+	for _, sink := range strings.Split(s, ",") {
+		if sink = strings.TrimSpace(sink); sink == "" {
+			continue
+		}
+		h, err := parseLogSink(sink)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", sink, err)
+		}
+		handlers = append(handlers, h)
+	}
+	if len(handlers) == 0 {
+		return nil, fmt.Errorf("no sinks")
+	}
+	return log15.MultiHandler(handlers...), nil
+}
+
+func parseLogSink(sink string) (log15.Handler, error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	var format log15.Format
+	switch q.Get("format") {
+	case "", "logfmt":
+		format = log15.LogfmtFormat()
+	case "json":
+		format = log15.JsonFormat()
+	default:
+		return nil, fmt.Errorf("unknown format %q", q.Get("format"))
+	}
+	level := log15.LvlDebug
+	if l := q.Get("level"); l != "" {
+		if level, err = log15.LvlFromString(l); err != nil {
+			return nil, err
+		}
+	}
+
+	var h log15.Handler
+	switch {
+	case u.Scheme == "" && u.Path == "stdout":
+		h = log15.StreamHandler(os.Stdout, format)
+	case u.Scheme == "" && u.Path == "stderr":
+		h = log15.StreamHandler(os.Stderr, format)
+	case u.Scheme == "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing path")
+		}
+		maxSize := int64(100 << 20)
+		if s := q.Get("max_size"); s != "" {
+			if maxSize, err = parseSize(s); err != nil {
+				return nil, err
+			}
+		}
+		maxFiles := 5
+		if s := q.Get("max_files"); s != "" {
+			if maxFiles, err = strconv.Atoi(s); err != nil || maxFiles < 1 {
+				return nil, fmt.Errorf("invalid max_files %q", s)
+			}
+		}
+		f, err := openRotatingFile(u.Path, maxSize, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+		h = log15.StreamHandler(f, format)
+	case u.Scheme == "syslog":
+		if h, err = log15.SyslogHandler("pg-external", format); err != nil {
+			return nil, err
+		}
+	case u.Scheme == "syslog+udp" || u.Scheme == "syslog+tcp":
+		if h, err = log15.SyslogNetHandler(strings.TrimPrefix(u.Scheme, "syslog+"), u.Host, "pg-external", format); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown sink")
+	}
+	return log15.LvlFilterHandler(level, h), nil
+}
+
+// rotatingFile is a log file which is moved aside once it reaches maxSize,
+// keeping the last maxFiles as path.1 (the most recent) to path.<maxFiles>.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mtx  sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	for i := r.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
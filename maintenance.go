@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errNoWindow          = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "no maintenance window is set"}
+	errScheduledNotFound = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "scheduled operation not found"}
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceWindow is a weekly period, in UTC, in which destructive or
+// disruptive operations on a resource may run, set for the resource or its
+// tenant. Days are three letter names, e.g. "sun", and empty for every day.
+type maintenanceWindow struct {
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	Duration string   `json:"duration"`
+	// Tenant is set when the window is the resource's tenant's.
+	Tenant string `json:"tenant,omitempty"`
+
+	start    time.Duration
+	duration time.Duration
+}
+
+// parse validates the window and fills in its start and duration.
+func (mw *maintenanceWindow) parse() error {
+	if mw.Days == nil {
+		mw.Days = []string{}
+	}
+	for i, d := range mw.Days {
+		mw.Days[i] = strings.ToLower(d)
+		if _, ok := weekdays[mw.Days[i]]; !ok {
+			return httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "days must be sun, mon, tue, wed, thu, fri or sat"}
+		}
+	}
+	t, err := time.Parse("15:04", mw.Start)
+	if err != nil {
+		return httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "start must be a time of day in UTC, e.g. 02:00"}
+	}
+	mw.start = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	mw.duration, err = time.ParseDuration(mw.Duration)
+	if err != nil || mw.duration < time.Minute || mw.duration > 24*time.Hour {
+		return httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "duration must be between 1m and 24h"}
+	}
+	return nil
+}
+
+// next reports whether the window is open at now, and if not, when it next
+// opens.
+func (mw *maintenanceWindow) next(now time.Time) (time.Time, bool) {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var next time.Time
+	// the window may have opened yesterday and still be open
+	for day := -1; day <= 7; day++ {
+		d := midnight.AddDate(0, 0, day)
+		if !mw.on(d.Weekday()) {
+			continue
+		}
+		start := d.Add(mw.start)
+		if !now.Before(start) && now.Before(start.Add(mw.duration)) {
+			return start, true
+		}
+		if start.After(now) && next.IsZero() {
+			next = start
+		}
+	}
+	return next, false
+}
+
+func (mw *maintenanceWindow) on(day time.Weekday) bool {
+	if len(mw.Days) == 0 {
+		return true
+	}
+	for _, d := range mw.Days {
+		if weekdays[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+func scanWindow(s scanner) (*maintenanceWindow, error) {
+	mw := &maintenanceWindow{}
+	var start, duration int
+	if err := s.Scan(&mw.Days, &start, &duration, &mw.Tenant); err != nil {
+		return nil, err
+	}
+	mw.start = time.Duration(start) * time.Minute
+	mw.duration = time.Duration(duration) * time.Second
+	mw.Start = fmt.Sprintf("%02d:%02d", start/60, start%60)
+	mw.Duration = mw.duration.String()
+	return mw, nil
+}
+
+// loadWindow returns the maintenance window of a resource, or failing that
+// of its tenant, or nil if neither has one.
+func loadWindow(q rowQueryer, uuid, tenant string) (*maintenanceWindow, error) {
+	mw, err := scanWindow(q.QueryRow(`
+SELECT days, start_minute, duration_seconds, coalesce(tenant, '') FROM maintenance_windows
+WHERE resource = $1 OR (tenant = $2 AND $2 <> '') ORDER BY resource IS NULL LIMIT 1`, uuid, tenant))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return mw, err
+}
+
+// scheduledOperation is a destructive or disruptive operation requested
+// outside its resource's maintenance window, which runs as a job once the
+// window opens.
+type scheduledOperation struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Resource  string    `json:"resource"`
+	RunAt     time.Time `json:"run_at"`
+	CreatedAt time.Time `json:"created_at"`
+	Requester string    `json:"requester,omitempty"`
+
+	uuid   string
+	params string
+}
+
+const scheduledColumns = `id, type, resource, params, run_at, created_at, coalesce(requester, '')`
+
+func scanScheduled(s scanner) (*scheduledOperation, error) {
+	op := &scheduledOperation{}
+	if err := s.Scan(&op.ID, &op.Type, &op.uuid, &op.params, &op.RunAt, &op.CreatedAt, &op.Requester); err != nil {
+		return nil, err
+	}
+	op.Resource = resourceID(op.uuid)
+	return op, nil
+}
+
+// The parameters of scheduled operations, by type.
+type scheduledDrop struct {
+	Archive bool   `json:"archive"`
+	Retain  string `json:"retain"`
+}
+
+type scheduledMigration struct {
+	Region   string `json:"region"`
+	Logical  bool   `json:"logical"`
+	Password string `json:"password"`
+	// ReadonlyPassword and AppPassword are those of the read only and tenant
+	// scoped login roles, recreated on the target if the resource has them.
+	ReadonlyPassword string `json:"readonly_password,omitempty"`
+	AppPassword      string `json:"app_password,omitempty"`
+}
+
+// schedule defers an operation on r to its next maintenance window, unless
+// the request has ?force=true, r has no window or the window is open, in
+// which case it returns nil and the operation should run now. Only one
+// operation of each type is scheduled for a resource, a repeated request
+// replaces the params and requester of the one already scheduled.
+func (p *pgAPI) schedule(r *resourceRef, typ string, source origin, params interface{}, req *http.Request) (*scheduledOperation, error) {
+	if r.UUID == "" {
+		return nil, nil
+	}
+	if force, _ := strconv.ParseBool(req.FormValue("force")); force {
+		return nil, nil
+	}
+	mw, err := loadWindow(p.state, r.UUID, r.Tenant)
+	if err != nil || mw == nil {
+		return nil, err
+	}
+	runAt, open := mw.next(time.Now())
+	if open {
+		return nil, nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	op, err := scanScheduled(p.state.QueryRow(`
+INSERT INTO scheduled_operations (id, type, resource, params, tenant, requester, run_at) VALUES ($1, $2, $3, $4, nullif($5, ''), nullif($6, ''), $7)
+ON CONFLICT (resource, type) DO UPDATE SET params = EXCLUDED.params, requester = EXCLUDED.requester, run_at = EXCLUDED.run_at
+RETURNING `+scheduledColumns, random.UUID(), typ, r.UUID, string(data), r.Tenant, source.Requester, runAt))
+	audit(source, securityAdmin, "schedule_"+typ, r.id(), err)
+	return op, err
+}
+
+// acceptScheduled responds to a request whose operation was scheduled.
+func acceptScheduled(w http.ResponseWriter, op *scheduledOperation, res interface{}) {
+	w.Header().Set("Location", "/scheduled/"+op.ID)
+	httphelper.JSON(w, 202, res)
+}
+
+// scheduler starts scheduled operations as jobs once their maintenance
+// window opens, checked every MAINTENANCE_CHECK_INTERVAL. Operations whose
+// window was missed, or has moved, are rescheduled for the next one.
+type scheduler struct {
+	api *pgAPI
+}
+
+func (s *scheduler) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.check(); err != nil {
+			logger.Error("error starting scheduled operations", "err", err)
+		}
+	}
+}
+
+type dueOperation struct {
+	*scheduledOperation
+	ref *resourceRef
+}
+
+func (s *scheduler) check() error {
+	state := s.api.state
+	rows, err := state.Query(`
+SELECT o.id, o.type, o.resource, o.params, o.run_at, o.created_at, coalesce(o.requester, ''), r.username, r.database, r.region, coalesce(r.tenant, '')
+FROM scheduled_operations o JOIN resources r ON r.uuid = o.resource WHERE o.run_at <= now() ORDER BY o.run_at`)
+	if err != nil {
+		return err
+	}
+	var due []*dueOperation
+	for rows.Next() {
+		op := &scheduledOperation{}
+		r := &resourceRef{}
+		var region *string
+		if err := rows.Scan(&op.ID, &op.Type, &op.uuid, &op.params, &op.RunAt, &op.CreatedAt, &op.Requester, &r.Username, &r.Database, &region, &r.Tenant); err != nil {
+			rows.Close()
+			return err
+		}
+		op.Resource = resourceID(op.uuid)
+		r.UUID = op.uuid
+		if r.Backend, err = s.api.backends.forRegion(region); err != nil {
+			logger.Error("error starting scheduled operation", "id", op.ID, "database", r.Database, "err", err)
+			continue
+		}
+		due = append(due, &dueOperation{op, r})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, op := range due {
+		if err := s.start(op); err != nil {
+			logger.Error("error starting scheduled operation", "id", op.ID, "type", op.Type, "resource", op.Resource, "err", err)
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) start(op *dueOperation) error {
+	state := s.api.state
+	mw, err := loadWindow(state, op.uuid, op.ref.Tenant)
+	if err != nil {
+		return err
+	}
+	if mw != nil {
+		if runAt, open := mw.next(time.Now()); !open {
+			return state.Exec(`UPDATE scheduled_operations SET run_at = $1 WHERE id = $2`, runAt, op.ID)
+		}
+	}
+	fn, err := s.api.operationFunc(op.Type, op.ref, origin{Source: "scheduler", Requester: op.Requester}, op.params)
+	if err != nil {
+		return err
+	}
+	// a shutdown leaves the operation for the next process
+	if s.api.jobs.draining() {
+		return nil
+	}
+	// the operation is removed in a transaction committed once its job has
+	// started, so that only one instance starts it, and it stays scheduled
+	// if the job can't be started, e.g. because the queue is full
+	tx, err := state.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id string
+	if err := tx.QueryRow(`DELETE FROM scheduled_operations WHERE id = $1 RETURNING id`, op.ID).Scan(&id); err == pgx.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	j, started, err := s.api.jobs.startResumable(op.Type, op.Resource, op.ref.Tenant, op.Requester, op.ref.Backend.name, op.params, fn)
+	if err != nil {
+		return err
+	}
+	// a job of the same type already running on the resource is waited for
+	if !started {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.Info("started scheduled operation", "id", op.ID, "type", op.Type, "resource", op.Resource, "job", j.ID)
+	return nil
+}
+
+// operationFunc returns the function which runs an operation as a job, from
+// the params recorded when it was scheduled or started, so that it can be
+// started once its window opens or resumed after a shutdown.
+func (p *pgAPI) operationFunc(typ string, r *resourceRef, source origin, params string) (func(*jobRun) error, error) {
+	switch typ {
+	case "deprovision":
+		var d scheduledDrop
+		if err := json.Unmarshal([]byte(params), &d); err != nil {
+			return nil, err
+		}
+		retain, err := time.ParseDuration(d.Retain)
+		if err != nil {
+			return nil, err
+		}
+		return dropFunc(p.state, r, source, d.Archive, retain), nil
+	case "migrate":
+		var m scheduledMigration
+		if err := json.Unmarshal([]byte(params), &m); err != nil {
+			return nil, err
+		}
+		target, err := p.backends.forRegion(&m.Region)
+		if err != nil {
+			return nil, err
+		}
+		return func(run *jobRun) error {
+			err := migrate(p.state, r, target, &m, run)
+			audit(source, securityAdmin, "migrate", r.id(), err)
+			return err
+		}, nil
+	case "confirm_rotation":
+		return func(run *jobRun) error {
+			rot, err := loadRotation(p.state, r)
+			if err != nil || rot == nil {
+				// a nil rotation was completed meanwhile
+				return err
+			}
+			if err := r.Backend.checkPrimary(); err != nil {
+				return err
+			}
+			err = completeRotation(p.state, rot)
+			audit(source, securityAdmin, "confirm_rotation", r.id(), err)
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduled operation %q", typ)
+}
+
+// listScheduled lists the scheduled operations, soonest first, of the
+// resource in the path if there is one. Tenant scoped API keys only see
+// their tenant's.
+func (p *pgAPI) listScheduled(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var uuid string
+	if params, _ := ctxhelper.ParamsFromContext(ctx); params.ByName("id") != "" {
+		r, ok := p.lookupResource(ctx, w)
+		if !ok {
+			return
+		}
+		if r.UUID == "" {
+			httphelper.Error(w, errUntracked)
+			return
+		}
+		uuid = r.UUID
+	}
+	rows, err := p.state.Query(`SELECT `+scheduledColumns+` FROM scheduled_operations WHERE ($1 = '' OR resource::text = $1) AND ($2 = '' OR tenant = $2) ORDER BY run_at`,
+		uuid, callerTenant(ctx))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	ops := []*scheduledOperation{}
+	for rows.Next() {
+		op, err := scanScheduled(rows)
+		if err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		ops = append(ops, op)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, ops)
+}
+
+// lookupScheduled returns the scheduled operation in the path, if the
+// caller can see it.
+func (p *pgAPI) lookupScheduled(ctx context.Context, w http.ResponseWriter) (*scheduledOperation, bool) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	id := params.ByName("id")
+	if !uuidPattern.MatchString(id) {
+		httphelper.Error(w, errScheduledNotFound)
+		return nil, false
+	}
+	op, err := scanScheduled(p.state.QueryRow(`SELECT `+scheduledColumns+` FROM scheduled_operations WHERE id = $1 AND ($2 = '' OR tenant = $2)`, id, callerTenant(ctx)))
+	if err == pgx.ErrNoRows {
+		err = errScheduledNotFound
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return nil, false
+	}
+	return op, true
+}
+
+func (p *pgAPI) getScheduled(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if op, ok := p.lookupScheduled(ctx, w); ok {
+		httphelper.JSON(w, 200, op)
+	}
+}
+
+// cancelScheduled cancels a scheduled operation before it starts.
+func (p *pgAPI) cancelScheduled(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	op, ok := p.lookupScheduled(ctx, w)
+	if !ok {
+		return
+	}
+	err := p.state.Exec(`DELETE FROM scheduled_operations WHERE id = $1`, op.ID)
+	audit(requestOrigin(ctx, req), securityAdmin, "cancel_scheduled", op.Resource, err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+type windowResponse struct {
+	*maintenanceWindow
+	Open     bool      `json:"open"`
+	NextOpen time.Time `json:"next_open"`
+}
+
+func writeWindow(w http.ResponseWriter, mw *maintenanceWindow) {
+	next, open := mw.next(time.Now())
+	httphelper.JSON(w, 200, &windowResponse{maintenanceWindow: mw, Open: open, NextOpen: next})
+}
+
+// getMaintenanceWindow returns a resource's maintenance window, which is its
+// tenant's unless it has its own, with whether it is open and when it next
+// opens (or opened, if it is open).
+func (p *pgAPI) getMaintenanceWindow(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	mw, err := loadWindow(p.state, r.UUID, r.Tenant)
+	if err == nil && mw == nil {
+		err = errNoWindow
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	writeWindow(w, mw)
+}
+
+func decodeWindow(req *http.Request) (*maintenanceWindow, error) {
+	mw := &maintenanceWindow{}
+	if err := httphelper.DecodeJSON(req, mw); err != nil {
+		return nil, err
+	}
+	mw.Tenant = ""
+	return mw, mw.parse()
+}
+
+// setMaintenanceWindow sets a resource's own maintenance window, e.g.
+// {"days": ["sat", "sun"], "start": "02:00", "duration": "4h"}.
+func (p *pgAPI) setMaintenanceWindow(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	mw, err := decodeWindow(req)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	err = p.state.Exec(`
+INSERT INTO maintenance_windows (resource, days, start_minute, duration_seconds) VALUES ($1, $2, $3, $4)
+ON CONFLICT (resource) DO UPDATE SET days = $2, start_minute = $3, duration_seconds = $4, updated_at = now()`,
+		r.UUID, mw.Days, int(mw.start.Minutes()), int(mw.duration.Seconds()))
+	audit(requestOrigin(ctx, req), securityAdmin, "set_maintenance_window", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	writeWindow(w, mw)
+}
+
+// deleteMaintenanceWindow removes a resource's own maintenance window, which
+// leaves its tenant's, if any, in force.
+func (p *pgAPI) deleteMaintenanceWindow(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	err := p.state.Exec(`DELETE FROM maintenance_windows WHERE resource = $1`, r.UUID)
+	audit(requestOrigin(ctx, req), securityAdmin, "delete_maintenance_window", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// tenantParam returns the tenant in the path, writing an error response if
+// it is invalid or the caller can't see it.
+func tenantParam(ctx context.Context, w http.ResponseWriter) (string, bool) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	tenant := params.ByName("id")
+	if !validTenant.MatchString(tenant) {
+		httphelper.ValidationError(w, "id", "must be lowercase letters, digits, dashes and underscores")
+		return "", false
+	}
+	if !callerFromContext(ctx).sees(tenant) {
+		httphelper.JSON(w, 403, httphelper.JSONError{Code: forbiddenCode, Message: "the API key can only manage tenant " + callerTenant(ctx)})
+		return "", false
+	}
+	return tenant, true
+}
+
+// getTenantMaintenanceWindow returns a tenant's maintenance window, which
+// applies to its resources without one of their own.
+func (p *pgAPI) getTenantMaintenanceWindow(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	tenant, ok := tenantParam(ctx, w)
+	if !ok {
+		return
+	}
+	mw, err := scanWindow(p.state.QueryRow(`SELECT days, start_minute, duration_seconds, tenant FROM maintenance_windows WHERE tenant = $1`, tenant))
+	if err == pgx.ErrNoRows {
+		err = errNoWindow
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	writeWindow(w, mw)
+}
+
+func (p *pgAPI) setTenantMaintenanceWindow(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	tenant, ok := tenantParam(ctx, w)
+	if !ok {
+		return
+	}
+	mw, err := decodeWindow(req)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	mw.Tenant = tenant
+	err = p.state.Exec(`
+INSERT INTO maintenance_windows (tenant, days, start_minute, duration_seconds) VALUES ($1, $2, $3, $4)
+ON CONFLICT (tenant) DO UPDATE SET days = $2, start_minute = $3, duration_seconds = $4, updated_at = now()`,
+		tenant, mw.Days, int(mw.start.Minutes()), int(mw.duration.Seconds()))
+	audit(requestOrigin(ctx, req), securityAdmin, "set_maintenance_window", tenant, err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	writeWindow(w, mw)
+}
+
+func (p *pgAPI) deleteTenantMaintenanceWindow(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	tenant, ok := tenantParam(ctx, w)
+	if !ok {
+		return
+	}
+	err := p.state.Exec(`DELETE FROM maintenance_windows WHERE tenant = $1`, tenant)
+	audit(requestOrigin(ctx, req), securityAdmin, "delete_maintenance_window", tenant, err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
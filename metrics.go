@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// gauge writes a sample of a gauge, given its labels as name/value pairs.
+// The help text is written with the first sample of each metric.
+func (m *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	if !m.seen[name] {
+		fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		m.seen[name] = true
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m.w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// metrics serves the provider's metrics for Prometheus.
+func (p *pgAPI) metrics(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	counts := make(map[string]int64)
+	rows, err := p.state.Query(`SELECT status, count(*) FROM resources GROUP BY status`)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		counts[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := &metricsWriter{w: w, seen: make(map[string]bool)}
+	statuses := make([]string, 0, len(validStatus))
+	for s := range validStatus {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		m.gauge("pg_external_resources", "Number of resources by status.", float64(counts[s]), "status", s)
+	}
+	m.gauge("pg_external_job_queue_depth", "Number of jobs waiting for a worker.", float64(p.jobs.depth()))
+	m.gauge("pg_external_job_queue_capacity", "Maximum number of jobs waiting for a worker.", float64(p.jobs.queueSize))
+	for _, s := range driftSummaries() {
+		for _, d := range []struct {
+			kind string
+			n    int
+		}{
+			{"missing_database", s.MissingDatabases},
+			{"missing_role", s.MissingRoles},
+			{"untracked_database", s.UntrackedDatabases},
+			{"untracked_role", s.UntrackedRoles},
+		} {
+			m.gauge("pg_external_drift", "Differences between the state database and a backend found at startup.", float64(d.n), "backend", s.Backend, "kind", d.kind)
+		}
+	}
+	ready := p.readiness()
+	for _, s := range readyStatuses {
+		m.gauge("pg_external_readiness", "Whether the provider is ok, degraded or unavailable, as reported by /readyz.", boolGauge(ready.Status == s), "status", s)
+	}
+	for _, r := range ready.Backends {
+		for _, s := range backendStates {
+			m.gauge("pg_external_backend_state", "Whether a backend is up, degraded or down.", boolGauge(r.State == s), "backend", r.Name, "state", s)
+		}
+	}
+	for _, r := range ready.Backends {
+		m.gauge("pg_external_backend_consecutive_failures", "Number of operations on a backend which failed since the last success.", float64(r.ConsecutiveFailures), "backend", r.Name)
+	}
+	for _, r := range ready.Backends {
+		if r.LastSuccess != nil {
+			m.gauge("pg_external_backend_last_success_timestamp_seconds", "Time of the latest successful operation on a backend.", float64(r.LastSuccess.Unix()), "backend", r.Name)
+		}
+	}
+	if p.canary != nil {
+		results, _ := p.canary.status()
+		for _, r := range results {
+			m.gauge("pg_external_canary_success", "Whether the latest canary run passed.", boolGauge(r.OK), "region", r.Region)
+		}
+		for _, r := range results {
+			m.gauge("pg_external_canary_duration_seconds", "Duration of the latest canary run.", r.Duration, "region", r.Region)
+		}
+		for _, r := range results {
+			m.gauge("pg_external_canary_last_run_timestamp_seconds", "Time of the latest canary run.", float64(r.Time.Unix()), "region", r.Region)
+		}
+	}
+}
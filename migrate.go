@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"golang.org/x/net/context"
+)
+
+var pgDump = os.Getenv("PG_DUMP")
+var pgRestore = os.Getenv("PG_RESTORE")
+
+// errLogicalUnsupported is returned for logical migrations between backends
+// which can't replicate.
+var errLogicalUnsupported = httphelper.JSONError{
+	Code:    httphelper.PreconditionFailedErrorCode,
+	Message: "logical migration requires PostgreSQL 10 or later on both backends and wal_level = logical on the source",
+}
+
+var errPublished = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "databases with publications, replication slots or snapshots can't be migrated, delete them first"}
+
+type migrateRequest struct {
+	Region string `json:"region"`
+
+	// Method is "dump" (the default) or "logical"
+	Method string `json:"method"`
+}
+
+type migrateResponse struct {
+	Job       *job                `json:"job,omitempty"`
+	Scheduled *scheduledOperation `json:"scheduled,omitempty"`
+	Env       map[string]string   `json:"env"`
+}
+
+// migrateDatabase moves a resource to the backend of another region, e.g.
+// when a server is being retired, as a job. Writes are frozen while its data
+// is dumped and restored, or with the logical method only while replication
+// catches up at cutover. The env for the new backend is returned up front,
+// and works once the job succeeds.
+func (p *pgAPI) migrateDatabase(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	var config migrateRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var logical bool
+	switch config.Method {
+	case "", "dump":
+	case "logical":
+		logical = true
+	default:
+		httphelper.ValidationError(w, "method", "must be dump or logical")
+		return
+	}
+	target, ok := p.backends.lookupRegion(w, config.Region)
+	if !ok {
+		return
+	}
+	if target == r.Backend {
+		httphelper.ValidationError(w, "region", "is the resource's current region")
+		return
+	}
+	var pending, published bool
+	if err := p.state.QueryRow(`SELECT EXISTS (SELECT 1 FROM rotations WHERE resource = $1), EXISTS (SELECT 1 FROM publications WHERE resource = $1 UNION ALL SELECT 1 FROM slots WHERE resource = $1 UNION ALL SELECT 1 FROM snapshots WHERE resource = $1)`,
+		r.UUID).Scan(&pending, &published); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if pending {
+		httphelper.Error(w, errRotationInProgress)
+		return
+	}
+	if published {
+		httphelper.Error(w, errPublished)
+		return
+	}
+	if paused, err := isPaused(p.state, r.UUID); err != nil {
+		httphelper.Error(w, err)
+		return
+	} else if paused {
+		httphelper.Error(w, errPaused)
+		return
+	}
+	for _, b := range []*backend{r.Backend, target} {
+		if err := b.checkPrimary(); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+	if logical {
+		if err := checkLogical(r.Backend, target); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+
+	m := &scheduledMigration{
+		Region:           target.region,
+		Logical:          logical,
+		Password:         random.Hex(16),
+		ReadonlyPassword: random.Hex(16),
+		AppPassword:      random.Hex(16),
+	}
+	source := requestOrigin(ctx, req)
+	// the new credentials of a scheduled migration are kept with it until
+	// it runs, replacing those of a migration already scheduled
+	op, err := p.schedule(r, "migrate", source, m, req)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	} else if op != nil {
+		var m scheduledMigration
+		if err := json.Unmarshal([]byte(op.params), &m); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		env, err := migrationEnv(r, target, &m)
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		acceptScheduled(w, op, &migrateResponse{Scheduled: op, Env: env})
+		return
+	}
+	env, err := migrationEnv(r, target, m)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	j, started, err := p.startOperation("migrate", r, source, m)
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+	if !started {
+		// the env of the migration already running was returned when it
+		// was started
+		acceptJob(w, j)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	httphelper.JSON(w, 202, &migrateResponse{Job: j, Env: env})
+}
+
+// migrationEnv returns the env of r once it has been migrated to target with
+// m's credentials, including the URLs of the read only and tenant scoped
+// login roles if r has them.
+func migrationEnv(r *resourceRef, target *backend, m *scheduledMigration) (map[string]string, error) {
+	roles, err := backendRoles(r.Backend)
+	if err != nil {
+		return nil, err
+	}
+	env := rawResourceEnv(target, r.Username, m.Password, r.Database)
+	if _, ok := roles[readonlyUsername(r.Database)]; ok {
+		env["DATABASE_RO_URL"] = target.databaseURL(readonlyUsername(r.Database), m.ReadonlyPassword, r.Database)
+	}
+	if _, ok := roles[tenantUsername(r.Database)]; ok {
+		env["DATABASE_APP_URL"] = target.databaseURL(tenantUsername(r.Database), m.AppPassword, r.Database)
+	}
+	return renameEnv(env), nil
+}
+
+// migrate moves a resource's database to target, recreating its owner and
+// other login roles with m's passwords, then drops it from its old backend.
+// The database's settings, access roles and grants are recreated as
+// provisioning made them, and a database frozen for exceeding its quota stays
+// frozen. The data is copied with pg_dump and pg_restore, or with logical
+// replication. If the migration fails the source database is left as it was.
+func migrate(state *postgres.DB, r *resourceRef, target *backend, m *scheduledMigration, run *jobRun) (err error) {
+	logical := m.Logical
+	var quotaEnforced bool
+	var expiresAt *time.Time
+	if err := state.QueryRow(`SELECT quota_enforced, expires_at FROM resources WHERE uuid = $1`, r.UUID).Scan(&quotaEnforced, &expiresAt); err != nil {
+		return err
+	}
+	roles, err := backendRoles(r.Backend)
+	if err != nil {
+		return err
+	}
+	ro, _ := accessRoleNames(r.Database)
+	_, accessRoles := roles[ro]
+	_, readonlyUser := roles[readonlyUsername(r.Database)]
+	_, appUser := roles[tenantUsername(r.Database)]
+	if err := setStatus(state, r.UUID, statusMigrating, "migrating to region "+target.region); err != nil {
+		return err
+	}
+	source := r.Backend
+	defer func() {
+		if err == nil {
+			return
+		}
+		if !quotaEnforced {
+			source.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" RESET default_transaction_read_only`, r.Database))
+		}
+		if logical {
+			dropReplication(source, target, r.Database)
+		}
+		target.db.Exec(fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, r.Database))
+		if accessRoles {
+			dropAccessRoles(target, r.Database)
+		}
+		target.db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, r.Username))
+		setStatus(state, r.UUID, statusReady, "")
+	}()
+
+	if !logical {
+		if err := freezeWrites(source, r.Database, run); err != nil {
+			return err
+		}
+	}
+
+	if err := createLoginRole(target, r.Username, m.Password, expiresAt, ""); err != nil {
+		return err
+	}
+	if err := target.db.Exec(fmt.Sprintf(`CREATE DATABASE "%s" WITH OWNER = "%s"`, r.Database, r.Username)); err != nil {
+		return err
+	}
+	if err := revokePublic(target, r.Database); err != nil {
+		return err
+	}
+	if err := copyDatabaseSettings(source, target, r.Database); err != nil {
+		return err
+	}
+	if monitoringRole != "" {
+		if err := grantMonitoringAccess(target, r.Database); err != nil {
+			return err
+		}
+	}
+	// before the data is copied, so that the default privileges cover the
+	// objects restored as the owner
+	if accessRoles {
+		if err := createAccessRoles(target, r.Database, r.Username); err != nil {
+			return err
+		}
+	}
+	if readonlyUser {
+		if err := createReadonlyUser(target, r.Database, memberPassword(m.ReadonlyPassword), expiresAt); err != nil {
+			return err
+		}
+	}
+	if appUser {
+		_, rw := accessRoleNames(r.Database)
+		if err := createMemberUser(target, tenantUsername(r.Database), memberPassword(m.AppPassword), rw, expiresAt); err != nil {
+			return err
+		}
+	}
+	run.stage("target_created", "created database %s on backend %s", r.Database, target.name)
+
+	if logical {
+		err = replicate(source, target, r.Database, r.Username, run)
+	} else {
+		err = dumpRestore(source, target, r.Database, r.Username)
+	}
+	if err != nil {
+		return err
+	}
+	run.stage("data_copied", "copied database %s", r.Database)
+	if err := run.cancelled(); err != nil {
+		return err
+	}
+	// the freeze isn't copied with the other settings, as the source is
+	// frozen for the copy whether or not it's over quota
+	if quotaEnforced {
+		if err := target.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" SET default_transaction_read_only = on`, r.Database)); err != nil {
+			return err
+		}
+	}
+
+	if err := state.Exec(`UPDATE resources SET region = $1 WHERE uuid = $2`, target.region, r.UUID); err != nil {
+		return err
+	}
+	if err := setStatus(state, r.UUID, statusReady, ""); err != nil {
+		return err
+	}
+	run.stage("state_updated", "moved %s to region %s", r.id(), target.region)
+
+	// the resource now lives on target, so failing to clean up the source
+	// doesn't fail the migration
+	if err := dropResource(state, r, nil); err != nil {
+		logger.Error("error dropping migrated database from its old backend", "database", r.Database, "backend", source.name, "err", err)
+		run.logf("error dropping database %s from backend %s: %s", r.Database, source.name, err)
+		return nil
+	}
+	run.stage("source_dropped", "dropped database %s from backend %s", r.Database, source.name)
+	notify("resource.migrated", map[string]interface{}{
+		"id":       resourceID(r.UUID),
+		"database": r.Database,
+		"region":   target.region,
+	})
+	return nil
+}
+
+// copyDatabaseSettings gives database on target the parameter defaults set
+// for it on source, e.g. its search_path and those set when provisioning it,
+// other than default_transaction_read_only.
+func copyDatabaseSettings(source, target *backend, database string) error {
+	rows, err := source.db.Query(`
+SELECT unnest(s.setconfig) FROM pg_db_role_setting s JOIN pg_database d ON d.oid = s.setdatabase
+WHERE d.datname = $1 AND s.setrole = 0`, database)
+	if err != nil {
+		return err
+	}
+	var settings []string
+	for rows.Next() {
+		var setting string
+		if err := rows.Scan(&setting); err != nil {
+			rows.Close()
+			return err
+		}
+		settings = append(settings, setting)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || strings.EqualFold(parts[0], "default_transaction_read_only") {
+			continue
+		}
+		// search_path is stored as a list of quoted identifiers, which a
+		// string literal would turn into a single schema name
+		value := parts[1]
+		if !strings.EqualFold(parts[0], "search_path") {
+			value = "'" + strings.Replace(value, "'", "''", -1) + "'"
+		}
+		if err := target.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" SET %s = %s`, database, parts[0], value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberPassword returns password, or a random one for migrations scheduled
+// before their member roles' passwords were recorded.
+func memberPassword(password string) string {
+	if password == "" {
+		return random.Hex(16)
+	}
+	return password
+}
+
+// freezeWrites makes new sessions of a database read only and terminates the
+// existing ones.
+func freezeWrites(b *backend, database string, run *jobRun) error {
+	if err := b.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" SET default_transaction_read_only = on`, database)); err != nil {
+		return err
+	}
+	if err := b.db.Exec(disconnectConns, database); err != nil {
+		return err
+	}
+	run.stage("writes_frozen", "froze writes to database %s", database)
+	return run.cancelled()
+}
+
+// dumpRestore copies a database from source to target, where it is owned by
+// owner, by piping pg_dump into pg_restore. args are passed to pg_dump, e.g.
+// to copy only the schema.
+func dumpRestore(source, target *backend, database, owner string, args ...string) error {
+	dumpCmd, restoreCmd := pgDump, pgRestore
+	if dumpCmd == "" {
+		dumpCmd = "pg_dump"
+	}
+	if restoreCmd == "" {
+		restoreCmd = "pg_restore"
+	}
+	dump := exec.Command(dumpCmd, append([]string{"--format=custom", "--no-owner", "--no-acl"}, append(args, database)...)...)
+	dump.Env = libpqEnv(source)
+	restore := exec.Command(restoreCmd, "--no-owner", "--no-acl", "--exit-on-error", "--single-transaction", "--role="+owner, "--dbname="+database)
+	restore.Env = libpqEnv(target)
+
+	var dumpErr, restoreErr bytes.Buffer
+	dump.Stderr, restore.Stderr = &dumpErr, &restoreErr
+	pr, pw := io.Pipe()
+	dump.Stdout, restore.Stdin = pw, pr
+	if err := restore.Start(); err != nil {
+		return err
+	}
+	err := dump.Run()
+	pw.CloseWithError(err)
+	if err != nil {
+		restore.Wait()
+		return fmt.Errorf("pg_dump: %s: %s", err, strings.TrimSpace(dumpErr.String()))
+	}
+	if err := restore.Wait(); err != nil {
+		return fmt.Errorf("pg_restore: %s: %s", err, strings.TrimSpace(restoreErr.String()))
+	}
+	return nil
+}
+
+// libpqEnv returns the environment for running libpq based tools against b
+// as the service user.
+func libpqEnv(b *backend) []string {
+	host, port := b.addr()
+	env := []string{
+		"PGHOST=" + host,
+		"PGPORT=" + port,
+		"PGUSER=" + serviceUser,
+		"PGPASSWORD=" + servicePass,
+		"PGSSLMODE=" + servicePgSSL,
+	}
+	if serviceRootCert != "" {
+		env = append(env, "PGSSLROOTCERT="+serviceRootCert)
+	}
+	return env
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// maxIdentifierLength is PostgreSQL's NAMEDATALEN - 1.
+const maxIdentifierLength = 63
+
+// names are always quoted, so unlike plain SQL identifiers they may start
+// with a digit (as the random hex names do)
+var validIdentifier = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+var unsafeNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// reservedNames can never be used for provisioned roles or databases.
+var reservedNames = []string{
+	"postgres", "template0", "template1", "public", "none",
+	"current_user", "session_user", "current_role", "session_role",
+}
+
+// validateName checks that name may be used for a provisioned role or
+// database, returning a validation error describing the problem if not.
+func validateName(field, name string) error {
+	switch {
+	case len(name) == 0 || len(name) > maxIdentifierLength:
+		return nameError(field, name, "length", fmt.Sprintf("must be between 1 and %d characters", maxIdentifierLength))
+	case !validIdentifier.MatchString(name):
+		return nameError(field, name, "format", "must contain only lowercase letters, digits and underscores")
+	case strings.HasPrefix(name, "pg_"):
+		return nameError(field, name, "reserved", "must not start with pg_")
+	case isReservedName(name):
+		return nameError(field, name, "reserved", "is reserved")
+	}
+	return nil
+}
+
+func isReservedName(name string) bool {
+	if name == serviceUser || name == stateDatabase {
+		return true
+	}
+	for _, n := range reservedNames {
+		if name == n {
+			return true
+		}
+	}
+	for _, n := range nameBlocklist {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+func nameError(field, name, reason, message string) error {
+	detail, _ := json.Marshal(map[string]string{"field": field, "value": name, "reason": reason})
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: fmt.Sprintf("%s %s", field, message),
+		Detail:  detail,
+	}
+}
+
+// generateNames returns the role and database names for a new resource.
+// Names are random unless DERIVE_NAMES is set and the app is known, in which
+// case both are derived from the app and environment names with a random
+// suffix, e.g. "myapp_production_x7f3", checked against existing names on b.
+func generateNames(b *backend, app, env string) (username, database string, err error) {
+	if deriveNames && app != "" {
+		base := namePrefix + sanitizeName(app)
+		if env != "" {
+			base += "_" + sanitizeName(env)
+		}
+		if !validIdentifier.MatchString(base) {
+			base = "db_" + base
+		}
+		// leave room for the suffix
+		if len(base) > maxIdentifierLength-5 {
+			base = strings.TrimRight(base[:maxIdentifierLength-5], "_")
+		}
+		for i := 0; i < 5; i++ {
+			name := base + "_" + random.Hex(2)
+			var taken bool
+			if err := b.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1) OR EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, name).Scan(&taken); err != nil {
+				return "", "", err
+			}
+			if !taken {
+				return name, name, nil
+			}
+		}
+		// fall back to random names if the suffixes keep colliding
+	}
+	return namePrefix + random.Hex(16), namePrefix + random.Hex(16), nil
+}
+
+// sanitizeName lowercases s and replaces runs of anything but letters and
+// digits with an underscore.
+func sanitizeName(s string) string {
+	return strings.Trim(unsafeNameChars.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
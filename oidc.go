@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how long the issuer's keys are cached, and
+	// jwksMinRefresh how often they may be refetched for a token signed
+	// with an unknown key.
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+
+	// jwtLeeway allows for clock skew with the issuer.
+	jwtLeeway = time.Minute
+)
+
+// oidc verifies JWTs issued by OIDC_ISSUER, nil unless it is set.
+var oidc *oidcVerifier
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// oidcVerifier authenticates callers with JWTs signed by the keys an OIDC
+// issuer publishes, mapping the values of a claim to roles.
+type oidcVerifier struct {
+	issuer      string
+	audience    string
+	roleClaim   string
+	roles       map[string]string
+	tenantClaim string
+	client      *http.Client
+
+	mtx       sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// newOIDCVerifier checks the OIDC configuration. roles maps claim values to
+// roles, e.g. "pg-admins=operator,developers=provisioner".
+func newOIDCVerifier(issuer, audience, roleClaim, roles, tenantClaim string) (*oidcVerifier, error) {
+	if !strings.HasPrefix(issuer, "https://") && !strings.HasPrefix(issuer, "http://") {
+		return nil, fmt.Errorf("OIDC_ISSUER must be an http or https URL")
+	}
+	if audience == "" {
+		return nil, fmt.Errorf("OIDC_AUDIENCE must be set with OIDC_ISSUER")
+	}
+	if roleClaim == "" {
+		roleClaim = "groups"
+	}
+	v := &oidcVerifier{
+		issuer:      issuer,
+		audience:    audience,
+		roleClaim:   roleClaim,
+		roles:       make(map[string]string),
+		tenantClaim: tenantClaim,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, mapping := range strings.Split(roles, ",") {
+		if mapping = strings.TrimSpace(mapping); mapping == "" {
+			continue
+		}
+		i := strings.LastIndex(mapping, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("OIDC_ROLES entry %q must be of the form value=role", mapping)
+		}
+		value, role := mapping[:i], mapping[i+1:]
+		if _, ok := rolePermissions[role]; !ok {
+			return nil, fmt.Errorf("OIDC_ROLES entry %q has unknown role %q", mapping, role)
+		}
+		v.roles[value] = role
+	}
+	if len(v.roles) == 0 {
+		return nil, fmt.Errorf("OIDC_ROLES must map at least one %s claim value to a role", roleClaim)
+	}
+	return v, nil
+}
+
+// isJWT reports whether an API key is a JWT rather than a static key.
+func isJWT(key string) bool {
+	return strings.Count(key, ".") == 2
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks a JWT's signature and claims, returning the caller it
+// identifies.
+func (v *oidcVerifier) verify(token string) (*caller, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(key, header.Alg, hash, h.Sum(nil), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return nil, fmt.Errorf("token issuer %q is not %s", iss, v.issuer)
+	}
+	if !containsClaim(claims["aud"], v.audience) {
+		return nil, fmt.Errorf("token audience does not include %s", v.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+
+	sub, _ := claims["sub"].(string)
+	c := &caller{KeyID: "oidc:" + sub}
+	for value, role := range v.roles {
+		if containsClaim(claims[v.roleClaim], value) && (c.Role == "" || rolePermissions[role] > rolePermissions[c.Role]) {
+			c.Role = role
+		}
+	}
+	if c.Role == "" {
+		return nil, fmt.Errorf("token's %s claim doesn't map to a role", v.roleClaim)
+	}
+	if v.tenantClaim != "" {
+		if c.Tenant, _ = claims[v.tenantClaim].(string); c.Tenant != "" && !validTenant.MatchString(c.Tenant) {
+			return nil, fmt.Errorf("token's %s claim is not a valid tenant", v.tenantClaim)
+		}
+	}
+	return c, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	return nil
+}
+
+// containsClaim reports whether a claim, either a string or an array of
+// strings, contains value.
+func containsClaim(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, sig []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid token signature")
+}
+
+// key returns the issuer's signing key with the given ID, refetching the
+// issuer's keys when they are stale or don't include it.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) > jwksRefreshInterval
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && time.Since(v.fetchedAt) < jwksMinRefresh {
+		return nil, fmt.Errorf("token signed with unknown key %q", kid)
+	}
+	keys, err := v.fetchKeys()
+	if err != nil {
+		logger.Error("error fetching OIDC signing keys", "issuer", v.issuer, "err", err)
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("token signed with unknown key %q", kid)
+	}
+	v.keys, v.fetchedAt = keys, time.Now()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("token signed with unknown key %q", kid)
+	}
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// fetchKeys fetches the issuer's signing keys from the jwks_uri of its
+// discovery document.
+func (v *oidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document has no jwks_uri")
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) > 4 {
+				return nil, fmt.Errorf("key %q is invalid", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curve, ok := jwkCurves[k.Crv]
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if !ok || err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("key %q is invalid", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, out interface{}) error {
+	res, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("unexpected status code %d from %s", res.StatusCode, url)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errNotPausable = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "only ready or degraded resources can be paused"}
+	errNotPaused   = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "the resource is not paused"}
+	errPaused      = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "the resource is paused, resume it first"}
+)
+
+// isPaused reports whether a resource is paused.
+func isPaused(state *postgres.DB, uuid string) (bool, error) {
+	var paused bool
+	err := state.QueryRow(`SELECT status = $1 FROM resources WHERE uuid = $2`, statusPaused, uuid).Scan(&paused)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return paused, err
+}
+
+// pauseDatabase turns a resource's database off without dropping it, e.g. a
+// staging database which isn't needed for a while: new connections are
+// refused and current ones terminated until it is resumed.
+func (p *pgAPI) pauseDatabase(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var prev string
+	err := p.state.QueryRow(`SELECT status FROM resources WHERE uuid = $1`, r.UUID).Scan(&prev)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if prev != statusPaused {
+		// claim the resource first, so that the health monitor doesn't mark
+		// it degraded for refusing connections
+		err = p.state.QueryRow(`UPDATE resources SET status = $1, status_message = '', status_changed_at = now() WHERE uuid = $2 AND status IN ('ready', 'degraded') RETURNING status`,
+			statusPaused, r.UUID).Scan(&prev)
+		if err == pgx.ErrNoRows {
+			err = errNotPausable
+		}
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+
+	// pausing again retries terminating connections
+	err = r.Backend.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" ALLOW_CONNECTIONS false`, r.Database))
+	if err == nil {
+		err = r.Backend.db.Exec(disconnectConns, r.Database)
+	}
+	audit(requestOrigin(ctx, req), securityDestructive, "pause", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	notify("resource.paused", map[string]interface{}{
+		"id":        r.id(),
+		"database":  r.Database,
+		"requester": requester(ctx, req),
+	})
+	w.WriteHeader(200)
+}
+
+// resumeDatabase allows connections to a paused resource's database again.
+// The health monitor then checks it as usual.
+func (p *pgAPI) resumeDatabase(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	paused, err := isPaused(p.state, r.UUID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if !paused {
+		httphelper.Error(w, errNotPaused)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	err = r.Backend.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" ALLOW_CONNECTIONS true`, r.Database))
+	if err == nil {
+		err = p.state.Exec(`UPDATE resources SET status = $1, status_message = '', status_changed_at = now() WHERE uuid = $2 AND status = $3`,
+			statusReady, r.UUID, statusPaused)
+	}
+	audit(requestOrigin(ctx, req), securityAdmin, "resume", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	notify("resource.resumed", map[string]interface{}{
+		"id":        r.id(),
+		"database":  r.Database,
+		"requester": requester(ctx, req),
+	})
+	w.WriteHeader(200)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+)
+
+// suffixedName returns the name of a role belonging to a database. If it
+// wouldn't fit the identifier length limit, the end of the database name is
+// replaced by a hash of the whole name, so that databases whose names only
+// differ at the end, e.g. by the random tail of derived names, don't share
+// roles.
+func suffixedName(database, suffix string) string {
+	if len(database) > maxIdentifierLength-len(suffix) {
+		sum := sha256.Sum256([]byte(database))
+		hash := "_" + hex.EncodeToString(sum[:])[:8]
+		database = database[:maxIdentifierLength-len(suffix)-len(hash)] + hash
+	}
+	return database + suffix
+}
+
+// accessRoleNames returns the names of a database's group roles giving read
+// only and read write access to its data.
+func accessRoleNames(database string) (readonly, readwrite string) {
+	return suffixedName(database, "_readonly"), suffixedName(database, "_readwrite")
+}
+
+// createAccessRoles creates the readonly and readwrite group roles of a new
+// database, which other roles are granted membership of rather than being
+// granted privileges table by table. Existing objects (e.g. copied from a
+// template) are covered by grants, and those the owner creates later by
+// default privileges.
+func createAccessRoles(b *backend, database, owner string) error {
+	ro, rw := accessRoleNames(database)
+	for _, role := range []string{ro, rw} {
+		if err := b.db.Exec(fmt.Sprintf(`CREATE ROLE "%s" NOLOGIN`, role)); err != nil {
+			return err
+		}
+	}
+	if err := b.db.Exec(fmt.Sprintf(`GRANT CONNECT ON DATABASE "%s" TO "%s", "%s"`, database, ro, rw)); err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`GRANT USAGE ON SCHEMA public TO "%[1]s", "%[2]s"`,
+		`GRANT SELECT ON ALL TABLES IN SCHEMA public TO "%[1]s"`,
+		`GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO "%[2]s"`,
+		`GRANT SELECT ON ALL SEQUENCES IN SCHEMA public TO "%[1]s"`,
+		`GRANT USAGE, SELECT, UPDATE ON ALL SEQUENCES IN SCHEMA public TO "%[2]s"`,
+	} {
+		if _, err := tx.Exec(fmt.Sprintf(stmt, ro, rw)); err != nil {
+			return err
+		}
+	}
+	if err := grantDefaultPrivileges(tx, database, owner); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// grantDefaultPrivileges gives a database's access roles privileges on the
+// objects creator creates from now on, in any schema.
+func grantDefaultPrivileges(tx *pgx.Tx, database, creator string) error {
+	ro, rw := accessRoleNames(database)
+	for _, stmt := range []string{
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "%[1]s" GRANT USAGE ON SCHEMAS TO "%[2]s", "%[3]s"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "%[1]s" GRANT SELECT ON TABLES TO "%[2]s"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "%[1]s" GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO "%[3]s"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "%[1]s" GRANT SELECT ON SEQUENCES TO "%[2]s"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "%[1]s" GRANT USAGE, SELECT, UPDATE ON SEQUENCES TO "%[3]s"`,
+	} {
+		if _, err := tx.Exec(fmt.Sprintf(stmt, creator, ro, rw)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendDefaultPrivileges gives a database's access roles, if it has them,
+// privileges on the objects a new credential creates, since objects belong to
+// the role creating them rather than the database owner.
+func extendDefaultPrivileges(b *backend, database, creator string) error {
+	ro, _ := accessRoleNames(database)
+	var exists bool
+	if err := b.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, ro).Scan(&exists); err != nil || !exists {
+		return err
+	}
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := grantDefaultPrivileges(tx, database, creator); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// grantMonitoring makes MONITORING_ROLE a member of pg_monitor on b, so
+// monitoring agents logging in with it can read every session's statistics
+// and the server's settings. pg_monitor was added in PostgreSQL 10.
+func grantMonitoring(b *backend) error {
+	if caps := b.get(); caps == nil || caps.VersionNum < 100000 {
+		return fmt.Errorf("pg_monitor requires PostgreSQL 10 or later")
+	}
+	return b.db.Exec(fmt.Sprintf(`GRANT pg_monitor TO "%s"`, monitoringRole))
+}
+
+// grantMonitoringAccess lets MONITORING_ROLE connect to a new database, which
+// PUBLIC no longer can, to collect its per-database statistics.
+func grantMonitoringAccess(b *backend, database string) error {
+	return b.db.Exec(fmt.Sprintf(`GRANT CONNECT ON DATABASE "%s" TO "%s"`, database, monitoringRole))
+}
+
+// readonlyUsername returns the name of a database's read only login role.
+func readonlyUsername(database string) string {
+	return suffixedName(database, "_ro")
+}
+
+// createMemberUser creates a login role with the default attributes which
+// is a member of group, one of a database's access roles.
+func createMemberUser(b *backend, username, password, group string, validUntil *time.Time) error {
+	stmt := fmt.Sprintf(`CREATE ROLE "%s" WITH LOGIN %s PASSWORD '%s' IN ROLE "%s"`, username, strings.Join(defaultRoleAttributes, " "), password, group)
+	if roleValidUntilExpiry && validUntil != nil {
+		stmt += fmt.Sprintf(` VALID UNTIL '%s'`, validUntil.UTC().Format(time.RFC3339))
+	}
+	return b.db.Exec(stmt)
+}
+
+// createReadonlyUser creates a login role which is a member of a database's
+// readonly access role, for reporting and dashboarding tools which would
+// otherwise be given the owner's credentials. Its sessions are read only
+// too, in case it is granted more later.
+func createReadonlyUser(b *backend, database, password string, validUntil *time.Time) error {
+	ro, _ := accessRoleNames(database)
+	username := readonlyUsername(database)
+	if err := createMemberUser(b, username, password, ro, validUntil); err != nil {
+		return err
+	}
+	return b.db.Exec(fmt.Sprintf(`ALTER ROLE "%s" SET default_transaction_read_only = on`, username))
+}
+
+// memberUsernames returns the login roles which may have been created for a
+// database besides its owner.
+func memberUsernames(database string) []string {
+	return []string{readonlyUsername(database), tenantUsername(database)}
+}
+
+// createAppSchema creates a schema owned by a new database's owner for the
+// app's objects, makes it the database's search_path, and revokes PUBLIC's
+// remaining access to the public schema so objects don't end up there.
+func createAppSchema(b *backend, database, owner, schema string) error {
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		fmt.Sprintf(`CREATE SCHEMA "%s" AUTHORIZATION "%s"`, schema, owner),
+		`REVOKE ALL ON SCHEMA public FROM PUBLIC`,
+		fmt.Sprintf(`ALTER DATABASE "%s" SET search_path = "%s"`, database, schema),
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// databaseSettings are the parameters provision requests may set for a
+// database, overriding the server's defaults for apps with particular
+// expectations. lc_messages can only be set when the provider connects as a
+// superuser.
+var databaseSettings = map[string]bool{
+	"timezone":    true,
+	"datestyle":   true,
+	"lc_messages": true,
+}
+
+var validSettingValue = regexp.MustCompile(`^[A-Za-z0-9_/+:,. -]{1,64}$`)
+
+// validateSettings checks that settings only names supported parameters, with
+// plausible values. The server validates the values themselves.
+func validateSettings(settings map[string]string) error {
+	for name, value := range settings {
+		if !databaseSettings[name] {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("settings: %s can't be set, only timezone, datestyle and lc_messages can", name),
+				Detail:  json.RawMessage(`{"field":"settings"}`),
+			}
+		}
+		if !validSettingValue.MatchString(value) {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("settings: the value of %s is invalid", name),
+				Detail:  json.RawMessage(`{"field":"settings"}`),
+			}
+		}
+	}
+	return nil
+}
+
+// applySettings sets a database's parameter defaults.
+func applySettings(b *backend, database string, settings map[string]string) error {
+	for name, value := range settings {
+		err := b.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" SET %s = '%s'`, database, name, value))
+		// invalid_parameter_value
+		if postgres.IsPostgresCode(err, "22023") {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("settings: %s", err.(pgx.PgError).Message),
+				Detail:  json.RawMessage(`{"field":"settings"}`),
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropAccessRoles drops a database's access roles and the login roles which
+// are members of them, once the database has been dropped, if it has them.
+func dropAccessRoles(b *backend, database string) error {
+	ro, rw := accessRoleNames(database)
+	roles := append(memberUsernames(database), ro, rw)
+	return b.db.Exec(fmt.Sprintf(`DROP ROLE IF EXISTS "%s"`, strings.Join(roles, `", "`)))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSuffixedNameKeepsLongNamesDistinct(t *testing.T) {
+	prefix := strings.Repeat("a", 58)
+	a, b := prefix+"_1a2b", prefix+"_3c4d"
+	if len(a) != maxIdentifierLength || len(b) != maxIdentifierLength {
+		t.Fatalf("expected names of %d characters", maxIdentifierLength)
+	}
+	for _, suffix := range []string{"_readonly", "_readwrite", "_ro", "_app"} {
+		na, nb := suffixedName(a, suffix), suffixedName(b, suffix)
+		if na == nb {
+			t.Errorf("%s: both databases got role %s", suffix, na)
+		}
+		for _, name := range []string{na, nb} {
+			if len(name) > maxIdentifierLength {
+				t.Errorf("%s: %s is longer than %d characters", suffix, name, maxIdentifierLength)
+			}
+			if !strings.HasSuffix(name, suffix) {
+				t.Errorf("%s: %s lost its suffix", suffix, name)
+			}
+		}
+		if suffixedName(a, suffix) != na {
+			t.Errorf("%s: name is not stable", suffix)
+		}
+	}
+}
+
+func TestSuffixedNameShortNames(t *testing.T) {
+	if got := suffixedName("app_db", "_readonly"); got != "app_db_readonly" {
+		t.Errorf("got %s", got)
+	}
+}
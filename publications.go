@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errPublicationsUnsupported = httphelper.JSONError{Code: httphelper.PreconditionFailedErrorCode, Message: "publications require PostgreSQL 10 or later with wal_level = logical"}
+	errReplicationDenied       = httphelper.JSONError{Code: httphelper.PreconditionFailedErrorCode, Message: "the backend doesn't allow the provider to create replication roles"}
+	errPublicationExists       = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "publication already exists"}
+	errPublicationNotFound     = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "publication not found"}
+)
+
+// validTableName matches a table, optionally qualified with its schema.
+var validTableName = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+type publicationRequest struct {
+	Name string `json:"name"`
+
+	// Tables are the tables to publish, all of them if empty
+	Tables []string `json:"tables"`
+}
+
+// publication is a logical replication publication of a resource's database,
+// with the login role change data capture consumers replicate it as.
+type publication struct {
+	Name      string    `json:"name"`
+	Tables    []string  `json:"tables"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type publicationResponse struct {
+	*publication
+	Env map[string]string `json:"env"`
+}
+
+// quoteTable quotes a table name matching validTableName.
+func quoteTable(table string) string {
+	return `"` + strings.Replace(table, ".", `"."`, 1) + `"`
+}
+
+// createPublication creates a publication of some or all of the tables of a
+// resource's database, and a login role with the REPLICATION attribute which
+// can read them, for change data capture consumers.
+func (p *pgAPI) createPublication(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	var config publicationRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := validateName("name", config.Name); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	for _, t := range config.Tables {
+		if !validTableName.MatchString(t) {
+			httphelper.ValidationError(w, "tables", fmt.Sprintf("%q is not a valid table name", t))
+			return
+		}
+	}
+	var exists bool
+	if err := p.state.QueryRow(`SELECT EXISTS (SELECT 1 FROM publications WHERE resource = $1 AND name = $2)`, r.UUID, config.Name).Scan(&exists); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if exists {
+		httphelper.Error(w, errPublicationExists)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := checkPublications(r.Backend); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	pub := &publication{
+		Name:     config.Name,
+		Tables:   config.Tables,
+		Username: suffixedName(r.Database, "_cdc_"+random.Hex(3)),
+	}
+	if pub.Tables == nil {
+		pub.Tables = []string{}
+	}
+	password := random.Hex(16)
+	err := createPublication(p.state, r, pub, password)
+	audit(requestOrigin(ctx, req), securityAdmin, "create_publication", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 201, &publicationResponse{
+		publication: pub,
+		Env:         rawResourceEnv(r.Backend, pub.Username, password, r.Database),
+	})
+}
+
+// checkPublications verifies that b supports logical replication.
+func checkPublications(b *backend) error {
+	if caps := b.get(); caps == nil || caps.VersionNum < 100000 {
+		return errPublicationsUnsupported
+	}
+	var walLevel string
+	if err := b.db.QueryRow(`SELECT current_setting('wal_level')`).Scan(&walLevel); err != nil {
+		return err
+	}
+	if walLevel != "logical" {
+		return errPublicationsUnsupported
+	}
+	return nil
+}
+
+// createPublication creates a publication and its replication role, which
+// can read the published tables for the initial snapshot, and records them.
+// Publishing every table requires the provider to connect as a superuser.
+func createPublication(state *postgres.DB, r *resourceRef, pub *publication, password string) (err error) {
+	b := r.Backend
+	attrs := strings.Replace(strings.Join(defaultRoleAttributes, " "), "NOREPLICATION", "REPLICATION", 1)
+	err = b.db.Exec(fmt.Sprintf(`CREATE ROLE "%s" WITH LOGIN %s PASSWORD '%s'`, pub.Username, attrs, password))
+	// insufficient_privilege
+	if postgres.IsPostgresCode(err, "42501") {
+		return errReplicationDenied
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			b.db.Exec(fmt.Sprintf(`REVOKE CONNECT ON DATABASE "%s" FROM "%s"`, r.Database, pub.Username))
+			b.db.Exec(fmt.Sprintf(`DROP ROLE IF EXISTS "%s"`, pub.Username))
+		}
+	}()
+	if err := b.db.Exec(fmt.Sprintf(`GRANT CONNECT ON DATABASE "%s" TO "%s"`, r.Database, pub.Username)); err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(b.connConfig(r.Database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var stmts []string
+	if len(pub.Tables) == 0 {
+		stmts = append(stmts, fmt.Sprintf(`CREATE PUBLICATION "%s" FOR ALL TABLES`, pub.Name))
+		// members of the readonly access role can read tables created later
+		// too, otherwise grant access to the existing ones
+		ro, _ := accessRoleNames(r.Database)
+		var accessRoles bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, ro).Scan(&accessRoles); err != nil {
+			return err
+		}
+		if accessRoles {
+			stmts = append(stmts, fmt.Sprintf(`GRANT "%s" TO "%s"`, ro, pub.Username))
+		} else {
+			rows, err := tx.Query(`SELECT nspname::text FROM pg_namespace WHERE nspname NOT LIKE 'pg\_%' AND nspname <> 'information_schema'`)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var schema string
+				if err := rows.Scan(&schema); err != nil {
+					rows.Close()
+					return err
+				}
+				stmts = append(stmts,
+					fmt.Sprintf(`GRANT USAGE ON SCHEMA "%s" TO "%s"`, schema, pub.Username),
+					fmt.Sprintf(`GRANT SELECT ON ALL TABLES IN SCHEMA "%s" TO "%s"`, schema, pub.Username),
+				)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+	} else {
+		tables := make([]string, len(pub.Tables))
+		for i, t := range pub.Tables {
+			tables[i] = quoteTable(t)
+			// unqualified names are looked up in the search_path, and
+			// regnamespace quotes the schema if needed
+			var schema string
+			err := tx.QueryRow(`SELECT relnamespace::regnamespace::text FROM pg_class WHERE oid = $1::regclass`, tables[i]).Scan(&schema)
+			// undefined_table and invalid_schema_name
+			if postgres.IsPostgresCode(err, "42P01") || postgres.IsPostgresCode(err, "3F000") {
+				return httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "tables: " + err.(pgx.PgError).Message}
+			}
+			if err != nil {
+				return err
+			}
+			stmts = append(stmts, fmt.Sprintf(`GRANT USAGE ON SCHEMA %s TO "%s"`, schema, pub.Username))
+		}
+		list := strings.Join(tables, ", ")
+		stmts = append(stmts,
+			fmt.Sprintf(`CREATE PUBLICATION "%s" FOR TABLE %s`, pub.Name, list),
+			fmt.Sprintf(`GRANT SELECT ON TABLE %s TO "%s"`, list, pub.Username),
+		)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	err = state.QueryRow(`INSERT INTO publications (resource, name, tables, username) VALUES ($1, $2, $3, $4) RETURNING created_at`,
+		r.UUID, pub.Name, pub.Tables, pub.Username).Scan(&pub.CreatedAt)
+	if err != nil {
+		conn.Exec(fmt.Sprintf(`DROP PUBLICATION IF EXISTS "%s"`, pub.Name))
+		conn.Exec(fmt.Sprintf(`DROP OWNED BY "%s"`, pub.Username))
+	}
+	return err
+}
+
+// getPublications lists the publications of a resource's database.
+func (p *pgAPI) getPublications(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	rows, err := p.state.Query(`SELECT name, tables, username, created_at FROM publications WHERE resource = $1 ORDER BY name`, r.UUID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	pubs := []*publication{}
+	for rows.Next() {
+		pub := &publication{}
+		if err := rows.Scan(&pub.Name, &pub.Tables, &pub.Username, &pub.CreatedAt); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		pubs = append(pubs, pub)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, pubs)
+}
+
+// deletePublication drops a publication and its replication role,
+// terminating the role's sessions.
+func (p *pgAPI) deletePublication(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	name := params.ByName("name")
+	var username string
+	err := p.state.QueryRow(`SELECT username FROM publications WHERE resource = $1 AND name = $2`, r.UUID, name).Scan(&username)
+	if err == pgx.ErrNoRows {
+		httphelper.Error(w, errPublicationNotFound)
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	err = dropPublication(p.state, r, name, username)
+	audit(requestOrigin(ctx, req), securityAdmin, "delete_publication", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// dropPublication drops a publication and its replication role, and forgets
+// them.
+func dropPublication(state *postgres.DB, r *resourceRef, name, username string) error {
+	b := r.Backend
+	if err := b.db.Exec(fmt.Sprintf(`ALTER ROLE "%s" NOLOGIN`, username)); err != nil {
+		return err
+	}
+	if err := b.db.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1`, username); err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(b.connConfig(r.Database))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(fmt.Sprintf(`DROP PUBLICATION IF EXISTS "%s"`, name))
+	if err == nil {
+		_, err = conn.Exec(fmt.Sprintf(`DROP OWNED BY "%s"`, username))
+	}
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	// DROP OWNED also revoked its privileges on the database
+	if err := b.db.Exec(fmt.Sprintf(`DROP ROLE IF EXISTS "%s"`, username)); err != nil {
+		return err
+	}
+	return state.Exec(`DELETE FROM publications WHERE resource = $1 AND name = $2`, r.UUID, name)
+}
+
+// dropPublicationRoles drops the replication roles of a resource's
+// publications once its database has been dropped.
+func dropPublicationRoles(state *postgres.DB, r *resourceRef) error {
+	rows, err := state.Query(`SELECT username FROM publications WHERE resource = $1`, r.UUID)
+	if err != nil {
+		return err
+	}
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			rows.Close()
+			return err
+		}
+		usernames = append(usernames, username)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if err := r.Backend.db.Exec(fmt.Sprintf(`DROP ROLE IF EXISTS "%s"`, username)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+const topQueries = `
+SELECT s.query, s.calls, s.%[1]s, s.%[2]s, s.rows
+FROM pg_stat_statements s
+JOIN pg_database d ON d.oid = s.dbid
+JOIN pg_roles r ON r.oid = s.userid
+WHERE d.datname = $1 AND r.rolname = $2
+ORDER BY %[3]s DESC
+LIMIT $3`
+
+type queryStats struct {
+	Query     string  `json:"query"`
+	Calls     int64   `json:"calls"`
+	TotalTime float64 `json:"total_time_ms"`
+	MeanTime  float64 `json:"mean_time_ms"`
+	Rows      int64   `json:"rows"`
+}
+
+func (p *pgAPI) getQueries(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+
+	limit := 20
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			httphelper.ValidationError(w, "limit", "must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	caps := r.Backend.get()
+	if !caps.StatStatements {
+		httphelper.Error(w, httphelper.PreconditionFailedErr("pg_stat_statements is not available on the backend"))
+		return
+	}
+
+	// the timing columns were renamed in PostgreSQL 13
+	totalCol, meanCol := "total_time", "mean_time"
+	if caps.VersionNum >= 130000 {
+		totalCol, meanCol = "total_exec_time", "mean_exec_time"
+	}
+
+	var order string
+	switch req.FormValue("sort") {
+	case "", "total_time":
+		order = totalCol
+	case "calls":
+		order = "calls"
+	default:
+		httphelper.ValidationError(w, "sort", "must be one of total_time, calls")
+		return
+	}
+
+	rows, err := r.Backend.db.Query(fmt.Sprintf(topQueries, totalCol, meanCol, order), r.Database, r.Username, limit)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var queries []*queryStats
+	for rows.Next() {
+		q := &queryStats{}
+		if err := rows.Scan(&q.Query, &q.Calls, &q.TotalTime, &q.MeanTime, &q.Rows); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		queries = append(queries, q)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, queries)
+}
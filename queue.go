@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+const (
+	// queueReadTimeout is how long the connection may stay silent, which
+	// is longer than the interval between the server's pings.
+	queueReadTimeout = 5 * time.Minute
+	queueMaxBackoff  = time.Minute
+)
+
+var errQueueBacklog = httphelper.JSONError{Code: httphelper.RatelimitedErrorCode, Message: "too many queued requests are waiting, retry later", Retry: true}
+
+// parseQueueURL checks QUEUE_URL, a NATS server given as nats://host:port,
+// or tls://host:port to always use TLS, with optional credentials or token
+// as the user info.
+func parseQueueURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+	case "amqp", "amqps":
+		return nil, fmt.Errorf("AMQP is not supported, only NATS (nats:// or tls://)")
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, must be nats or tls", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("the NATS server address must be set")
+	}
+	u.Host = withDefaultPort(u.Host, "4222")
+	return u, nil
+}
+
+// withDefaultPort adds port to a URL host which doesn't have one.
+func withDefaultPort(host, port string) string {
+	if h, p, err := net.SplitHostPort(host); err == nil && p != "" {
+		return host
+	} else if err == nil {
+		host = h
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+// queueRequest is a message asking for a resource to be provisioned, the
+// default, or deprovisioned. Config is the provision request, as posted to
+// /databases.
+type queueRequest struct {
+	Action    string          `json:"action"`
+	ID        string          `json:"id"`
+	Config    json.RawMessage `json:"config"`
+	Requester string          `json:"requester"`
+	Version   int             `json:"version"`
+}
+
+// queueReply is published to the reply subject of a request, with the status
+// and body the equivalent HTTP request would have been answered with.
+type queueReply struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// queueConsumer serves provisioning requests consumed from a NATS subject,
+// as a member of a queue group so each request is handled by one provider.
+// Requests are dispatched to the HTTP handlers, so they are validated and
+// handled exactly like API requests, and at most JOB_WORKERS are handled at
+// a time. At most JOB_QUEUE_SIZE more wait for a worker, further requests
+// are refused until the backlog clears.
+type queueConsumer struct {
+	url     *url.URL
+	subject string
+	group   string
+	handler http.Handler
+	sem     chan struct{}
+	backlog chan struct{}
+
+	// mtx guards writes to conn, which is replaced on reconnection
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+func newQueueConsumer(u *url.URL, subject, group string, handler http.Handler) *queueConsumer {
+	return &queueConsumer{
+		url:     u,
+		subject: subject,
+		group:   group,
+		handler: httphelper.ContextInjector("pg-external", recoverPanics(handler)),
+		sem:     make(chan struct{}, jobWorkers),
+		backlog: make(chan struct{}, jobWorkers+jobQueueSize),
+	}
+}
+
+// run consumes requests, reconnecting with backoff whenever the connection
+// is lost.
+func (q *queueConsumer) run() {
+	backoff := time.Second
+	for {
+		connected, err := q.consume()
+		if connected {
+			backoff = time.Second
+		}
+		logger.Error("error consuming from NATS, reconnecting", "server", q.url.Host, "err", err, "backoff", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > queueMaxBackoff {
+			backoff = queueMaxBackoff
+		}
+	}
+}
+
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// consume connects to the server and handles messages until the connection
+// fails, returning whether it got as far as subscribing.
+func (q *queueConsumer) consume() (bool, error) {
+	host, _, _ := net.SplitHostPort(q.url.Host)
+	conn, err := net.DialTimeout("tcp", q.url.Host, 10*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if q.url.Scheme == "tls" {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return false, fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		return false, err
+	}
+	if info.TLSRequired && q.url.Scheme != "tls" {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+		r = bufio.NewReader(conn)
+	}
+
+	connect := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "pg-external",
+		"lang":     "go",
+		"version":  "1",
+	}
+	if u := q.url.User; u != nil {
+		if password, ok := u.Password(); ok {
+			connect["user"], connect["pass"] = u.Username(), password
+		} else {
+			connect["auth_token"] = u.Username()
+		}
+	}
+	data, _ := json.Marshal(connect)
+	q.mtx.Lock()
+	q.conn = conn
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s %s 1\r\nPING\r\n", data, q.subject, q.group)
+	q.mtx.Unlock()
+	if err != nil {
+		return false, err
+	}
+	logger.Info("consuming provisioning requests from NATS", "server", q.url.Host, "subject", q.subject, "group", q.group)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(queueReadTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return true, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			if err := q.write("PONG\r\n"); err != nil {
+				return true, err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return true, fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) != 4 && len(fields) != 5 {
+				return true, fmt.Errorf("malformed message %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return true, fmt.Errorf("malformed message %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return true, err
+			}
+			var reply string
+			if len(fields) == 5 {
+				reply = fields[3]
+			}
+			// wait for a worker without blocking the connection, so
+			// the server's pings are still answered, unless too many
+			// requests are waiting already
+			select {
+			case q.backlog <- struct{}{}:
+				go func() {
+					defer func() { <-q.backlog }()
+					q.sem <- struct{}{}
+					defer func() { <-q.sem }()
+					q.handle(reply, payload[:size])
+				}()
+			default:
+				q.reply(reply, errorReply(429, errQueueBacklog))
+			}
+		}
+	}
+}
+
+func (q *queueConsumer) write(s string) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	_, err := io.WriteString(q.conn, s)
+	return err
+}
+
+// handle serves a request and publishes the outcome to its reply subject.
+// Requests without one are still served, as a fire and forget deprovision
+// is reasonable, but the outcome is only logged.
+func (q *queueConsumer) handle(reply string, payload []byte) {
+	q.reply(reply, q.serve(payload))
+}
+
+// reply publishes the outcome of a request to its reply subject, or logs it
+// if it failed and there is none.
+func (q *queueConsumer) reply(reply string, res *queueReply) {
+	if reply == "" {
+		if res.Status >= 300 {
+			logger.Error("queued request failed", "status", res.Status, "body", string(res.Body))
+		}
+		return
+	}
+	data, _ := json.Marshal(res)
+	if err := q.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", reply, len(data), data)); err != nil {
+		logger.Error("error publishing queue reply", "subject", reply, "err", err)
+	}
+}
+
+// serve dispatches a request to the HTTP handlers.
+func (q *queueConsumer) serve(payload []byte) *queueReply {
+	var msg queueRequest
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return errorReply(400, httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "the message is not a valid JSON request"})
+	}
+	var req *http.Request
+	switch msg.Action {
+	case "", "provision":
+		body := msg.Config
+		if len(body) == 0 {
+			body = json.RawMessage("{}")
+		}
+		req, _ = http.NewRequest("POST", "/databases", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	case "deprovision":
+		if msg.ID == "" {
+			return errorReply(400, httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "id must be set to deprovision"})
+		}
+		req, _ = http.NewRequest("DELETE", "/databases?id="+url.QueryEscape(msg.ID), nil)
+	default:
+		return errorReply(400, httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "action must be provision or deprovision"})
+	}
+	req.RemoteAddr = "queue"
+	if msg.Requester != "" {
+		req.Header.Set(requesterHeader, msg.Requester)
+	}
+	if msg.Version != 0 {
+		req.Header.Set("Accept", resourceMediaTypeFor(msg.Version))
+	}
+	rec := httptest.NewRecorder()
+	q.handler.ServeHTTP(rec, req)
+	res := &queueReply{Status: rec.Code, Body: json.RawMessage(bytes.TrimSpace(rec.Body.Bytes()))}
+	if len(res.Body) == 0 {
+		res.Body = json.RawMessage("null")
+	} else if err := json.Unmarshal(res.Body, new(json.RawMessage)); err != nil {
+		res.Body, _ = json.Marshal(string(res.Body))
+	}
+	return res
+}
+
+func errorReply(status int, err httphelper.JSONError) *queueReply {
+	body, _ := json.Marshal(err)
+	return &queueReply{Status: status, Body: body}
+}
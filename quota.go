@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a byte count such as "512MB" or "10GB" (units are powers
+// of 1024, a bare number is taken as bytes).
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// parseThresholds parses a comma separated list of quota percentages.
+func parseThresholds(s string) ([]int, error) {
+	var thresholds []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid quota threshold %q", f)
+		}
+		thresholds = append(thresholds, n)
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+type quotaMonitor struct {
+	backends   *backendSet
+	state      *postgres.DB
+	thresholds []int
+	enforce    bool
+}
+
+func (m *quotaMonitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.check(); err != nil {
+			logger.Error("error checking quotas", "err", err)
+		}
+	}
+}
+
+type quotaStatus struct {
+	uuid     string
+	database string
+	quota    int64
+	level    int
+	enforced bool
+	backend  *backend
+}
+
+func (m *quotaMonitor) check() error {
+	rows, err := m.state.Query(`SELECT uuid, database, quota_bytes, quota_level, quota_enforced, region FROM resources WHERE quota_bytes IS NOT NULL AND status IN ('ready', 'degraded')`)
+	if err != nil {
+		return err
+	}
+	var resources []*quotaStatus
+	for rows.Next() {
+		r := &quotaStatus{}
+		var region *string
+		if err := rows.Scan(&r.uuid, &r.database, &r.quota, &r.level, &r.enforced, &region); err != nil {
+			rows.Close()
+			return err
+		}
+		if r.backend, err = m.backends.forRegion(region); err != nil {
+			logger.Error("error checking quota", "database", r.database, "err", err)
+			continue
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range resources {
+		if err := m.checkResource(r); err != nil {
+			logger.Error("error checking quota", "database", r.database, "err", err)
+		}
+	}
+	return nil
+}
+
+func (m *quotaMonitor) checkResource(r *quotaStatus) error {
+	var size int64
+	if err := r.backend.db.QueryRow(`SELECT pg_database_size($1::name)`, r.database).Scan(&size); err != nil {
+		return err
+	}
+	info := map[string]interface{}{
+		"id":       resourceID(r.uuid),
+		"database": r.database,
+		"size":     size,
+		"quota":    r.quota,
+	}
+
+	level := 0
+	for _, t := range m.thresholds {
+		if size*100 >= r.quota*int64(t) {
+			level = t
+		}
+	}
+	if level != r.level {
+		if err := m.state.Exec(`UPDATE resources SET quota_level = $1 WHERE database = $2`, level, r.database); err != nil {
+			return err
+		}
+		if level > r.level {
+			info["threshold"] = level
+			notify("quota.warning", info)
+		}
+	}
+
+	if !m.enforce {
+		return nil
+	}
+	switch exceeded := size >= r.quota; {
+	case exceeded && !r.enforced:
+		if err := r.backend.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" SET default_transaction_read_only = on`, r.database)); err != nil {
+			return err
+		}
+		// existing sessions keep the old setting, so drop them
+		if err := r.backend.db.Exec(disconnectConns, r.database); err != nil {
+			return err
+		}
+		if err := m.state.Exec(`UPDATE resources SET quota_enforced = true WHERE database = $1`, r.database); err != nil {
+			return err
+		}
+		notify("quota.enforced", info)
+	case !exceeded && r.enforced:
+		if err := r.backend.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" RESET default_transaction_read_only`, r.database)); err != nil {
+			return err
+		}
+		if err := m.state.Exec(`UPDATE resources SET quota_enforced = false WHERE database = $1`, r.database); err != nil {
+			return err
+		}
+		notify("quota.released", info)
+	}
+	return nil
+}
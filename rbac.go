@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+// permission is what a route requires of the caller's role.
+type permission int
+
+const (
+	// permRead reads resources, jobs and the server's state
+	permRead permission = iota
+	// permProvision creates resources and changes them without losing data
+	permProvision
+	// permDelete deletes resources or parts of them, and interrupts work
+	permDelete
+	// permAdmin runs admin endpoints affecting every tenant, which tenant
+	// scoped API keys never may
+	permAdmin
+)
+
+var permissionNames = map[permission]string{
+	permRead:      "read",
+	permProvision: "provision",
+	permDelete:    "delete",
+	permAdmin:     "admin",
+}
+
+// Roles of API keys, each allowed everything the previous one is.
+const (
+	roleViewer      = "viewer"
+	roleProvisioner = "provisioner"
+	roleOperator    = "operator"
+)
+
+// rolePermissions is the most powerful permission granted by each role.
+var rolePermissions = map[string]permission{
+	roleViewer:      permRead,
+	roleProvisioner: permProvision,
+	roleOperator:    permAdmin,
+}
+
+// can reports whether the caller's role grants perm.
+func (c *caller) can(perm permission) bool {
+	if c == nil {
+		return true
+	}
+	if perm == permAdmin && !c.admin() {
+		return false
+	}
+	max, ok := rolePermissions[c.Role]
+	return ok && perm <= max
+}
+
+// authorize declares the permission a route requires, refusing callers
+// whose role doesn't grant it with 403 and auditing the refusal.
+func authorize(perm permission, h httphelper.HandlerFunc) httphelper.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+		if c := callerFromContext(ctx); !c.can(perm) {
+			err := httphelper.JSONError{Code: forbiddenCode, Message: "the API key's role doesn't have the " + permissionNames[perm] + " permission"}
+			if perm == permAdmin && c.Role == roleOperator {
+				err.Message = "this endpoint requires an API key which isn't scoped to a tenant"
+			}
+			audit(requestOrigin(ctx, req), securityAuthzFailure, "authorize", req.Method+" "+req.URL.Path, err)
+			httphelper.JSON(w, 403, err)
+			return
+		}
+		h(ctx, w, req)
+	}
+}
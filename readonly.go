@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// readOnlyHandler refuses requests other than GET and HEAD, which are the
+// only ones that don't change resources, for an inspector instance started
+// with READ_ONLY=true.
+func readOnlyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			httphelper.JSON(w, 403, httphelper.JSONError{
+				Code:    "forbidden",
+				Message: "the provider is running in read-only mode",
+			})
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
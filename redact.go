@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const redacted = "[REDACTED]"
+
+// redactPatterns match credentials embedded in text: passwords in SQL
+// statements, the password in a URL, key=value pairs with a sensitive key
+// and bearer tokens. The credential between the first and second groups is
+// replaced.
+var redactPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(password\s+)'[^']*'`),
+	regexp.MustCompile(`(?i)([a-z][a-z0-9+.-]*://[^:/@\s]+:)[^@\s]+(@)`),
+	regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api_?key)\s*[=:]\s*)(?:"[^"]*"|'[^']*'|[^\s&,;]+)`),
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),
+}
+
+// sensitiveKey matches the names of log fields holding credentials.
+var sensitiveKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|api_?key)`)
+
+var secrets struct {
+	sync.RWMutex
+	values []string
+}
+
+// registerSecret adds a value, such as the admin password, which is redacted
+// wherever it appears.
+func registerSecret(s string) {
+	if len(s) < 4 {
+		return
+	}
+	secrets.Lock()
+	secrets.values = append(secrets.values, s)
+	secrets.Unlock()
+}
+
+// redact removes credentials from a message before it is logged or returned.
+func redact(s string) string {
+	secrets.RLock()
+	for _, v := range secrets.values {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	secrets.RUnlock()
+	for _, p := range redactPatterns {
+		s = p.ReplaceAllString(s, "${1}"+redacted+"${2}")
+	}
+	return s
+}
+
+// redactValue redacts a value named key, entirely if the key is sensitive.
+func redactValue(key, value string) string {
+	if sensitiveKey.MatchString(key) {
+		return redacted
+	}
+	return redact(value)
+}
+
+// redactHandler redacts log records before passing them to h.
+func redactHandler(h log15.Handler) log15.Handler {
+	return log15.FuncHandler(func(r *log15.Record) error {
+		r.Msg = redact(r.Msg)
+		for i := 1; i < len(r.Ctx); i += 2 {
+			key, _ := r.Ctx[i-1].(string)
+			switch v := r.Ctx[i].(type) {
+			case string:
+				r.Ctx[i] = redactValue(key, v)
+			case error:
+				r.Ctx[i] = redactValue(key, v.Error())
+			case fmt.Stringer:
+				r.Ctx[i] = redactValue(key, v.String())
+			}
+		}
+		return h.Log(r)
+	})
+}
+
+// recoverPanics logs panics in handlers, redacted, instead of letting the
+// HTTP server print them, and responds with an error.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				var reqID string
+				if rw, ok := w.(*httphelper.ResponseWriter); ok {
+					reqID, _ = ctxhelper.RequestIDFromContext(rw.Context())
+				}
+				logger.Error("panic in handler", "req_id", reqID, "method", req.Method, "path", req.URL.Path, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+				httphelper.Error(w, fmt.Errorf("panic: %s", redact(fmt.Sprint(v))))
+			}
+		}()
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// regionConfig is an additional backend configured in REGIONS.
+type regionConfig struct {
+	Region   string
+	Host     string
+	Port     string
+	Discover discoverFunc
+	Name     string
+}
+
+// parseRegions parses REGIONS, a comma separated list of region=address
+// pairs where the address is host[:port] or a DISCOVERY specification, e.g.
+// "eu-west=pg-eu.example.com,us-east=srv:_postgresql._tcp.us.example.com".
+func parseRegions(s string) ([]*regionConfig, error) {
+	var regions []*regionConfig
+	seen := map[string]bool{region: true}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid region %q, must be region=address", f)
+		}
+		r := &regionConfig{Region: parts[0], Name: parts[1]}
+		if seen[r.Region] {
+			return nil, fmt.Errorf("region %q is configured more than once", r.Region)
+		}
+		seen[r.Region] = true
+		switch {
+		case strings.HasPrefix(parts[1], "srv:"), strings.HasPrefix(parts[1], "consul:"), strings.HasPrefix(parts[1], "etcd:"):
+			discover, err := parseDiscovery(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("region %q: %s", r.Region, err)
+			}
+			r.Discover = discover
+		default:
+			host, port, err := parseBackendAddr(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("region %q: %s", r.Region, err)
+			}
+			r.Host, r.Port, r.Name = host, port, net.JoinHostPort(host, port)
+		}
+		regions = append(regions, r)
+	}
+	return regions, nil
+}
+
+// backendSet holds the backend configured with PGHOST or DISCOVERY, which
+// also holds the state database, and any additional regional backends.
+type backendSet struct {
+	main    *backend
+	regions map[string]*backend
+}
+
+func newBackendSet(main *backend) *backendSet {
+	return &backendSet{main: main, regions: map[string]*backend{main.region: main}}
+}
+
+func (s *backendSet) add(b *backend) {
+	s.regions[b.region] = b
+}
+
+// forRegion returns the backend for region, with resources created before
+// regions were recorded living on the main backend.
+func (s *backendSet) forRegion(region *string) (*backend, error) {
+	if region == nil {
+		return s.main, nil
+	}
+	b, ok := s.regions[*region]
+	if !ok {
+		return nil, fmt.Errorf("region %q is not configured", *region)
+	}
+	return b, nil
+}
+
+// all returns the backends ordered by region.
+func (s *backendSet) all() []*backend {
+	names := make([]string, 0, len(s.regions))
+	for name := range s.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	backends := make([]*backend, len(names))
+	for i, name := range names {
+		backends[i] = s.regions[name]
+	}
+	return backends
+}
+
+// lookupRegion returns the backend for a region requested by a client,
+// writing a validation error and returning ok == false if it is unknown.
+func (s *backendSet) lookupRegion(w http.ResponseWriter, region string) (*backend, bool) {
+	b, ok := s.regions[region]
+	if !ok {
+		httphelper.ValidationError(w, "region", "is not configured")
+	}
+	return b, ok
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+const (
+	// replicationPollInterval is how often the progress of a logical
+	// migration is checked
+	replicationPollInterval = 5 * time.Second
+
+	// cutoverLag is the replication lag in bytes below which writes are
+	// frozen and the migration cut over
+	cutoverLag = 16 << 20
+
+	// cutoverTimeout bounds how long writes stay frozen waiting for the lag
+	// to reach zero before the migration is abandoned
+	cutoverTimeout = 5 * time.Minute
+)
+
+// checkLogical verifies that a database can be replicated from source to
+// target.
+func checkLogical(source, target *backend) error {
+	for _, b := range []*backend{source, target} {
+		if caps := b.get(); caps == nil || caps.VersionNum < 100000 {
+			return errLogicalUnsupported
+		}
+	}
+	var walLevel string
+	if err := source.db.QueryRow(`SELECT current_setting('wal_level')`).Scan(&walLevel); err != nil {
+		return err
+	}
+	if walLevel != "logical" {
+		return errLogicalUnsupported
+	}
+	return nil
+}
+
+// replicationName returns the name of the publication, subscription and
+// replication slot used to migrate a database.
+func replicationName(database string) string {
+	return suffixedName(database, "_migrate")
+}
+
+// replicate copies a database from source to target, where it is owned by
+// owner, with logical replication: the schema is copied with pg_dump, then a
+// subscription on target copies the tables and streams changes until the
+// lag is small enough to freeze writes and cut over. Sequences aren't
+// replicated, so their values are copied once writes are frozen.
+func replicate(source, target *backend, database, owner string, run *jobRun) error {
+	name := replicationName(database)
+	src, err := pgx.Connect(source.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := pgx.Connect(target.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// updates and deletes of tables without a replica identity would fail
+	// on the source once they are published
+	var missing []string
+	rows, err := src.Query(`
+SELECT c.oid::regclass::text FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r' AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+AND (c.relreplident = 'n' OR (c.relreplident = 'd' AND NOT EXISTS (
+  SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisprimary)))
+ORDER BY 1`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, table)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("tables without a primary key or replica identity can't be replicated: %s", strings.Join(missing, ", "))
+	}
+
+	if err := dumpRestore(source, target, database, owner, "--schema-only"); err != nil {
+		return err
+	}
+	run.stage("schema_copied", "copied the schema of database %s", database)
+	if err := run.cancelled(); err != nil {
+		return err
+	}
+
+	if _, err := src.Exec(fmt.Sprintf(`CREATE PUBLICATION "%s" FOR ALL TABLES`, name)); err != nil {
+		return err
+	}
+	if _, err := dst.Exec(fmt.Sprintf(`CREATE SUBSCRIPTION "%s" CONNECTION '%s' PUBLICATION "%s"`, name, sourceConninfo(source, database), name)); err != nil {
+		return err
+	}
+	run.stage("replication_started", "started replicating database %s", database)
+
+	// wait for the initial copy of every table
+	var copied int64 = -1
+	for {
+		var total, ready int64
+		if err := dst.QueryRow(`SELECT count(*), count(*) FILTER (WHERE srsubstate IN ('s', 'r')) FROM pg_subscription_rel`).Scan(&total, &ready); err != nil {
+			return err
+		}
+		if ready != copied {
+			run.logf("copied %d of %d tables", ready, total)
+			copied = ready
+		}
+		if ready == total {
+			break
+		}
+		if err := sleepUnlessCancelled(run); err != nil {
+			return err
+		}
+	}
+	run.stage("tables_copied", "copied the tables of database %s", database)
+
+	// let the subscription catch up with the writes made meanwhile
+	var reported int64 = -1
+	for {
+		var lag int64
+		if err := src.QueryRow(`SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn)::bigint FROM pg_replication_slots WHERE slot_name = $1`, name).Scan(&lag); err != nil {
+			return err
+		}
+		if lag < cutoverLag {
+			break
+		}
+		if lag != reported {
+			run.logf("replication lag is %d bytes", lag)
+			reported = lag
+		}
+		if err := sleepUnlessCancelled(run); err != nil {
+			return err
+		}
+	}
+
+	if err := freezeWrites(source, database, run); err != nil {
+		return err
+	}
+	var lsn string
+	if err := src.QueryRow(`SELECT pg_current_wal_lsn()::text`).Scan(&lsn); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(cutoverTimeout)
+	for {
+		var caughtUp bool
+		if err := src.QueryRow(`SELECT confirmed_flush_lsn >= $1::pg_lsn FROM pg_replication_slots WHERE slot_name = $2`, lsn, name).Scan(&caughtUp); err != nil {
+			return err
+		}
+		if caughtUp {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("replication didn't catch up within %s of freezing writes", cutoverTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+	run.stage("replication_caught_up", "replicated all writes to database %s", database)
+
+	if err := copySequences(src, dst); err != nil {
+		return err
+	}
+	run.stage("sequences_copied", "copied the sequences of database %s", database)
+
+	if err := dropReplication(source, target, database); err != nil {
+		return err
+	}
+	run.stage("replication_stopped", "stopped replicating database %s", database)
+	return nil
+}
+
+// sleepUnlessCancelled waits before the progress of a replication is
+// checked again, returning early if the job is cancelled.
+func sleepUnlessCancelled(run *jobRun) error {
+	if run == nil {
+		time.Sleep(replicationPollInterval)
+		return nil
+	}
+	select {
+	case <-run.ctx.Done():
+		return errJobCancelled
+	case <-time.After(replicationPollInterval):
+		return nil
+	}
+}
+
+// copySequences sets the sequences of dst to the values of those of src.
+func copySequences(src, dst *pgx.Conn) error {
+	rows, err := src.Query(`SELECT format('%I.%I', schemaname, sequencename), last_value FROM pg_sequences WHERE last_value IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	type sequence struct {
+		name  string
+		value int64
+	}
+	var sequences []sequence
+	for rows.Next() {
+		var s sequence
+		if err := rows.Scan(&s.name, &s.value); err != nil {
+			rows.Close()
+			return err
+		}
+		sequences = append(sequences, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range sequences {
+		if _, err := dst.Exec(`SELECT setval($1::regclass, $2)`, s.name, s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropReplication drops the subscription, which also drops its replication
+// slot, and publication used to migrate a database, if they exist.
+func dropReplication(source, target *backend, database string) error {
+	name := replicationName(database)
+	dst, err := pgx.Connect(target.connConfig(database))
+	if err != nil {
+		return err
+	}
+	_, err = dst.Exec(fmt.Sprintf(`DROP SUBSCRIPTION IF EXISTS "%s"`, name))
+	dst.Close()
+	if err != nil {
+		return err
+	}
+	src, err := pgx.Connect(source.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = src.Exec(fmt.Sprintf(`DROP PUBLICATION IF EXISTS "%s"`, name))
+	return err
+}
+
+// sourceConninfo returns the connection string a subscription on another
+// backend uses to replicate database from b, as the service user.
+func sourceConninfo(b *backend, database string) string {
+	host, port := b.addr()
+	params := []string{
+		"host=" + conninfoValue(host),
+		"port=" + conninfoValue(port),
+		"dbname=" + conninfoValue(database),
+		"user=" + conninfoValue(serviceUser),
+		"password=" + conninfoValue(servicePass),
+		"sslmode=" + conninfoValue(servicePgSSL),
+	}
+	if serviceRootCert != "" {
+		params = append(params, "sslrootcert="+conninfoValue(serviceRootCert))
+	}
+	// the connection string is itself quoted in CREATE SUBSCRIPTION
+	return strings.Replace(strings.Join(params, " "), "'", "''", -1)
+}
+
+// conninfoValue quotes a libpq connection string value.
+func conninfoValue(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `'` + strings.Replace(s, `'`, `\'`, -1) + `'`
+}
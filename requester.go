@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// maxRequesterLength bounds the requester given in REQUESTER_HEADER.
+const maxRequesterLength = 200
+
+// origin is where a request came from: the client address and who made it.
+// It is empty for actions the provider takes by itself.
+type origin struct {
+	Source    string
+	Requester string
+}
+
+func requestOrigin(ctx context.Context, req *http.Request) origin {
+	return origin{Source: requestSource(req), Requester: requester(ctx, req)}
+}
+
+// identity names the API key or token a caller authenticated with.
+func (c *caller) identity() string {
+	if c.KeyID == "" {
+		return "api-key:admin"
+	}
+	if strings.HasPrefix(c.KeyID, "oidc:") {
+		return c.KeyID
+	}
+	return "api-key:" + c.Name
+}
+
+// requester identifies who made a request: the user named in
+// REQUESTER_HEADER, which the Flynn controller sets to the user it acts for,
+// and the API key or token it authenticated with, e.g.
+// "alice@example.com via api-key:flynn". Either may be missing.
+func requester(ctx context.Context, req *http.Request) string {
+	user := strings.TrimSpace(req.Header.Get(requesterHeader))
+	if len(user) > maxRequesterLength {
+		user = user[:maxRequesterLength]
+	}
+	c := callerFromContext(ctx)
+	switch {
+	case c == nil:
+		return user
+	case user == "":
+		return c.identity()
+	default:
+		return user + " via " + c.identity()
+	}
+}
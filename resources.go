@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+const managedResource = `
+SELECT EXISTS (
+  SELECT 1 FROM pg_database d
+  JOIN pg_roles o ON o.oid = d.datdba
+  JOIN pg_auth_members m ON m.roleid = o.oid
+  JOIN pg_roles s ON s.oid = m.member
+  WHERE d.datname = $1 AND o.rolname = $2 AND s.rolname = $3
+)`
+
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_.:/=-]{1,128}$`)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+var (
+	errResourceNotFound = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "database not found"}
+	errInvalidID        = httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: "id is invalid", Detail: json.RawMessage(`{"field":"id"}`)}
+)
+
+// resourceRef identifies a provisioned database and its owning role, and the
+// backend it lives on. UUID is empty for legacy resources created before the
+// state store existed. Tenant is empty for resources without one.
+type resourceRef struct {
+	UUID     string
+	Username string
+	Database string
+	Tenant   string
+	Backend  *backend
+}
+
+// id returns the resource's ID.
+func (r *resourceRef) id() string {
+	if r.UUID == "" {
+		return "/databases/" + r.Username + ":" + r.Database
+	}
+	return resourceID(r.UUID)
+}
+
+// validateTags checks that tags are safe to use in query strings and names.
+func validateTags(tags []string) error {
+	for _, tag := range tags {
+		if !validTag.MatchString(tag) {
+			detail, _ := json.Marshal(map[string]string{"field": "tags", "value": tag})
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: "tags must be at most 128 letters, digits or any of _.:/=-",
+				Detail:  detail,
+			}
+		}
+	}
+	return nil
+}
+
+func resourceID(uuid string) string {
+	return "/databases/" + uuid
+}
+
+// parseID splits a legacy resource ID of the form
+// "/databases/<user>:<database>" (the prefix is optional) into its username
+// and database.
+func parseID(id string) (username, database string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(id, "/databases/"), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// resolveID resolves a resource ID, either "/databases/<uuid>" or the legacy
+// "/databases/<user>:<database>" (the prefix is optional), to a database
+// created by this provider. Resources of other tenants are not found for
+// callers with a tenant scoped API key.
+func (p *pgAPI) resolveID(ctx context.Context, id string) (*resourceRef, error) {
+	r, err := p.resolveAnyID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !callerFromContext(ctx).sees(r.Tenant) {
+		return nil, errResourceNotFound
+	}
+	return r, nil
+}
+
+// resolveAnyID resolves a resource ID regardless of the caller's tenant.
+func (p *pgAPI) resolveAnyID(id string) (*resourceRef, error) {
+	id = strings.TrimPrefix(id, "/databases/")
+	if uuidPattern.MatchString(id) {
+		r := &resourceRef{UUID: strings.ToLower(id)}
+		var region *string
+		err := p.state.QueryRow(`SELECT username, database, coalesce(tenant, ''), region FROM resources WHERE uuid = $1`, r.UUID).Scan(&r.Username, &r.Database, &r.Tenant, &region)
+		if err == pgx.ErrNoRows {
+			return nil, errResourceNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		r.Backend, err = p.backends.forRegion(region)
+		return r, err
+	}
+
+	username, database, ok := parseID(id)
+	if !ok {
+		return nil, errInvalidID
+	}
+	// legacy IDs are only trusted if they refer to a role and database
+	// created by the provider, and always live on the main backend
+	var exists bool
+	if err := p.db.QueryRow(managedResource, database, username, serviceUser).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errResourceNotFound
+	}
+	r := &resourceRef{Username: username, Database: database, Backend: p.backend}
+	err := p.state.QueryRow(`SELECT uuid, coalesce(tenant, '') FROM resources WHERE database = $1 AND username = $2`, database, username).Scan(&r.UUID, &r.Tenant)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lookupResource resolves the :id route parameter, writing an error response
+// and returning ok == false if it doesn't refer to a provisioned database.
+func (p *pgAPI) lookupResource(ctx context.Context, w http.ResponseWriter) (*resourceRef, bool) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	r, err := p.resolveID(ctx, params.ByName("id"))
+	if err != nil {
+		httphelper.Error(w, err)
+		return nil, false
+	}
+	return r, true
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+// reviewAppTag marks databases forked for review apps, alongside a
+// "branch:<name>" tag.
+const reviewAppTag = "review-app"
+
+func branchTag(branch string) string {
+	return "branch:" + branch
+}
+
+var errParentInUse = httphelper.JSONError{
+	Code:    httphelper.ConflictErrorCode,
+	Message: "the parent database has active connections, which prevent copying it (retry with terminate_connections to close them)",
+	Retry:   true,
+}
+
+type forkRequest struct {
+	Parent               string   `json:"parent"`
+	Branch               string   `json:"branch"`
+	App                  string   `json:"app"`
+	Scrub                []string `json:"scrub"`
+	TTL                  string   `json:"ttl"`
+	TerminateConnections bool     `json:"terminate_connections"`
+}
+
+// forkReviewApp creates a copy of a parent resource's database for a
+// branch, with its own role, runs the scrub statements in it and tags it
+// with the branch so the forks can be destroyed together once the branch is
+// merged.
+func (p *pgAPI) forkReviewApp(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	version, ok := negotiateResource(w, req)
+	if !ok {
+		return
+	}
+	var config forkRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.Branch == "" {
+		httphelper.ValidationError(w, "branch", "must be set")
+		return
+	}
+	tags := []string{reviewAppTag, branchTag(config.Branch)}
+	if err := validateTags(tags); err != nil {
+		httphelper.ValidationError(w, "branch", "is invalid")
+		return
+	}
+	var ttl *float64
+	if config.TTL != "" {
+		d, err := parseTTL(config.TTL)
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		secs := d.Seconds()
+		ttl = &secs
+	}
+	parent, err := p.resolveID(ctx, config.Parent)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if parent.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+
+	var exists bool
+	if err := p.state.QueryRow(`SELECT EXISTS (SELECT 1 FROM resources WHERE parent = $1 AND tags @> $2)`, parent.UUID, tags).Scan(&exists); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if exists {
+		httphelper.ConflictError(w, fmt.Sprintf("a fork of this database already exists for branch %q", config.Branch))
+		return
+	}
+
+	// forks belong to the parent's tenant
+	var tenant *string
+	if err := p.state.QueryRow(`SELECT tenant FROM resources WHERE uuid = $1`, parent.UUID).Scan(&tenant); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	b := parent.Backend
+	if err := b.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if !checkCapacity(w, b) {
+		return
+	}
+	spec := &provisionSpec{
+		App:       config.App,
+		Env:       config.Branch,
+		TTL:       ttl,
+		Tags:      tags,
+		Template:  parent.Database,
+		Parent:    parent.UUID,
+		Scrub:     config.Scrub,
+		Requester: requester(ctx, req),
+	}
+	if tenant != nil {
+		spec.Tenant = *tenant
+		if err := p.checkTenantSize(spec.Tenant); err != nil {
+			provisionError(w, err)
+			return
+		}
+	}
+	if config.TerminateConnections {
+		if err := b.db.Exec(disconnectConns, parent.Database); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+	res, err := p.provision(b, spec)
+	if postgres.IsPostgresCode(err, "55006") {
+		// object_in_use, someone is connected to the template
+		err = errParentInUse
+	}
+	if err != nil {
+		provisionError(w, err)
+		return
+	}
+	writeResource(w, version, res)
+}
+
+type destroyResult struct {
+	Deleted []string          `json:"deleted"`
+	Failed  map[string]string `json:"failed,omitempty"`
+	// Scheduled are the deprovisions deferred to maintenance windows.
+	Scheduled []*scheduledOperation `json:"scheduled,omitempty"`
+}
+
+// destroyReviewApps deprovisions every review app fork for ?branch=, as a
+// purge job with ?async=true. Tenant scoped API keys only destroy their
+// tenant's forks.
+func (p *pgAPI) destroyReviewApps(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	branch := req.FormValue("branch")
+	if branch == "" {
+		httphelper.ValidationError(w, "branch", "must be set")
+		return
+	}
+	tenant := callerTenant(ctx)
+	rows, err := p.state.Query(`SELECT uuid, username, database, region, coalesce(tenant, '') FROM resources WHERE tags @> $1 AND ($2 = '' OR tenant = $2)`, []string{reviewAppTag, branchTag(branch)}, tenant)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	var forks []*resourceRef
+	for rows.Next() {
+		r := &resourceRef{}
+		var region *string
+		if err := rows.Scan(&r.UUID, &r.Username, &r.Database, &region, &r.Tenant); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		if r.Backend, err = p.backends.forRegion(region); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		forks = append(forks, r)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	source := requestOrigin(ctx, req)
+	forks, scheduled, err := p.scheduleDrops(forks, source, req)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if async, _ := strconv.ParseBool(req.FormValue("async")); async {
+		resource := branchTag(branch)
+		if tenant != "" {
+			resource += "&tenant=" + tenant
+		}
+		j, _, err := p.jobs.start("purge", resource, tenant, source.Requester, purgeBackend(forks), func(run *jobRun) error {
+			_, err := purge(p.state, forks, run)
+			audit(source, securityDestructive, "destroy_review_apps", branchTag(branch), err)
+			return err
+		})
+		if err != nil {
+			jobError(w, err)
+			return
+		}
+		acceptJob(w, j)
+		return
+	}
+	res, err := purge(p.state, forks, nil)
+	res.Scheduled = scheduled
+	audit(source, securityDestructive, "destroy_review_apps", branchTag(branch), err)
+	httphelper.JSON(w, 200, res)
+}
+
+// prepareCopy hands the objects in a database copied from a template over
+// to its new owner and runs the scrub statements as that owner.
+func prepareCopy(b *backend, database, owner, password string, scrub []string) error {
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// the copied objects belong to the roles owning them in the template.
+	// REASSIGN OWNED also moves the databases those roles own, so those are
+	// handed back within the same transaction.
+	rows, err := tx.Query(`
+SELECT r.rolname::text, coalesce(array_agg(d.datname::text) FILTER (WHERE d.datname IS NOT NULL), '{}')
+FROM pg_roles r
+LEFT JOIN pg_database d ON d.datdba = r.oid AND d.datname <> $3
+WHERE r.oid IN (
+    SELECT relowner FROM pg_class
+    UNION SELECT nspowner FROM pg_namespace
+    UNION SELECT proowner FROM pg_proc
+    UNION SELECT typowner FROM pg_type
+  )
+  AND NOT r.rolsuper AND r.rolname NOT LIKE 'pg\_%' AND r.rolname <> $1 AND r.rolname <> $2
+GROUP BY r.rolname`, owner, serviceUser, database)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string][]string)
+	for rows.Next() {
+		var role string
+		var dbs []string
+		if err := rows.Scan(&role, &dbs); err != nil {
+			rows.Close()
+			return err
+		}
+		owned[role] = dbs
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for role, dbs := range owned {
+		if _, err := tx.Exec(fmt.Sprintf(`REASSIGN OWNED BY "%s" TO "%s"`, role, owner)); err != nil {
+			return err
+		}
+		for _, db := range dbs {
+			if _, err := tx.Exec(fmt.Sprintf(`ALTER DATABASE "%s" OWNER TO "%s"`, db, role)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return scrubCopy(b, database, owner, password, scrub)
+}
+
+// scrubCopy runs the scrub statements in a session logged in as the fork's
+// owner, so they can't do anything the owner couldn't.
+func scrubCopy(b *backend, database, owner, password string, scrub []string) error {
+	if len(scrub) == 0 {
+		return nil
+	}
+	conf := b.connConfig(database)
+	conf.User, conf.Password = owner, password
+	conn, err := pgx.Connect(conf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range scrub {
+		if _, err := tx.Exec(stmt); err != nil {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("scrub statement failed: %s", redact(err.Error())),
+			}
+		}
+	}
+	return tx.Commit()
+}
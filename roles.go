@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+)
+
+// defaultRoleAttributes are given to every login role explicitly, rather
+// than relying on the server's defaults, which differ between managed
+// services and may be changed by templates or extensions.
+var defaultRoleAttributes = []string{"NOSUPERUSER", "NOCREATEDB", "NOCREATEROLE", "NOREPLICATION", "NOBYPASSRLS", "INHERIT"}
+
+// roleAttributeOverrides are the attributes ROLE_ATTRIBUTES may set, each
+// replacing the default it names.
+var roleAttributeOverrides = map[string]string{
+	"CREATEDB":   "NOCREATEDB",
+	"CREATEROLE": "NOCREATEROLE",
+	"NOINHERIT":  "INHERIT",
+}
+
+// parseRoleAttributes parses a comma separated list of attributes to give
+// provisioned roles, e.g. "CREATEDB,CONNECTION LIMIT 20", into the full list
+// of attributes for CREATE ROLE.
+func parseRoleAttributes(s string) (string, error) {
+	attrs := append([]string(nil), defaultRoleAttributes...)
+	for _, a := range strings.Split(s, ",") {
+		a = strings.ToUpper(strings.Join(strings.Fields(a), " "))
+		if a == "" {
+			continue
+		}
+		if n := strings.TrimPrefix(a, "CONNECTION LIMIT "); n != a {
+			if limit, err := strconv.Atoi(n); err != nil || limit < -1 {
+				return "", fmt.Errorf("invalid connection limit %q", n)
+			}
+			attrs = append(attrs, a)
+			continue
+		}
+		def, ok := roleAttributeOverrides[a]
+		if !ok {
+			return "", fmt.Errorf("unsupported attribute %q", a)
+		}
+		for i, d := range attrs {
+			if d == def {
+				attrs[i] = a
+			}
+		}
+	}
+	return strings.Join(attrs, " "), nil
+}
+
+// validPassword matches the passwords callers may supply: printable ASCII
+// without whitespace, quotes or backslashes, which would need escaping in
+// SQL and connection strings.
+var validPassword = regexp.MustCompile(`^[A-Za-z0-9!#$%&()*+,\-./:;<=>?@\[\]^_{|}~]+$`)
+
+// validatePassword checks a caller supplied password against the policy. The
+// password itself is never included in the error.
+func validatePassword(password string) error {
+	var msg string
+	switch {
+	case len(password) < passwordMinLength || len(password) > 128:
+		msg = fmt.Sprintf("password must be between %d and 128 characters", passwordMinLength)
+	case !validPassword.MatchString(password):
+		msg = "password must contain only printable ASCII characters other than whitespace, quotes and backslashes"
+	default:
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: msg,
+		Detail:  json.RawMessage(`{"field":"password"}`),
+	}
+}
+
+// createRoleSQL returns the statement creating a login role with the
+// configured attributes, expiring at validUntil if set and
+// ROLE_VALID_UNTIL_EXPIRY is enabled.
+func createRoleSQL(username, password string, validUntil *time.Time) string {
+	return fmt.Sprintf(`CREATE ROLE "%s" WITH %s`, username, loginRoleOptions(password, validUntil))
+}
+
+// createLoginRole creates a login role, a member of inRole if set, and makes
+// the provider a member of it in a single transaction, so that a failure or
+// crash between the two leaves no role behind.
+func createLoginRole(b *backend, username, password string, validUntil *time.Time, inRole string) error {
+	create := createRoleSQL(username, password, validUntil)
+	if inRole != "" {
+		create += fmt.Sprintf(` IN ROLE "%s"`, inRole)
+	}
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Exec(create); err != nil {
+		return err
+	}
+	if err := tx.Exec(fmt.Sprintf(`GRANT "%s" TO "%s"`, username, serviceUser)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// alterRoleSQL returns the statement making an existing role a login role
+// as createRoleSQL would have created it.
+func alterRoleSQL(username, password string, validUntil *time.Time) string {
+	return fmt.Sprintf(`ALTER ROLE "%s" WITH %s`, username, loginRoleOptions(password, validUntil))
+}
+
+func loginRoleOptions(password string, validUntil *time.Time) string {
+	opts := fmt.Sprintf(`LOGIN %s PASSWORD '%s'`, roleAttributes, password)
+	if roleValidUntilExpiry && validUntil != nil {
+		opts += fmt.Sprintf(` VALID UNTIL '%s'`, validUntil.UTC().Format(time.RFC3339))
+	}
+	return opts
+}
+
+// extendRoleValidity moves the expiry of a resource's login roles, including
+// the new role of a credential rotation and the members of its access roles,
+// to its new expiry.
+func extendRoleValidity(state *postgres.DB, b *backend, resource, username, database string, validUntil time.Time) error {
+	if !roleValidUntilExpiry {
+		return nil
+	}
+	roles := []string{username}
+	var rotated string
+	if err := state.QueryRow(`SELECT new_username FROM rotations WHERE resource = $1`, resource).Scan(&rotated); err == nil {
+		roles = append(roles, rotated)
+	} else if err != pgx.ErrNoRows {
+		return err
+	}
+	for _, role := range memberUsernames(database) {
+		var exists bool
+		if err := b.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, role).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			roles = append(roles, role)
+		}
+	}
+	for _, role := range roles {
+		if err := b.db.Exec(fmt.Sprintf(`ALTER ROLE "%s" VALID UNTIL '%s'`, role, validUntil.UTC().Format(time.RFC3339))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errRotationInProgress = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "a credential rotation is already in progress"}
+	errNoRotation         = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "no credential rotation in progress"}
+	errUntracked          = httphelper.JSONError{Code: httphelper.PreconditionFailedErrorCode, Message: "the resource is not tracked in the state database"}
+)
+
+// rotation is an in progress credential rotation. Both roles can log in
+// until it completes, when the database is handed over to the new role and
+// the old one is dropped.
+type rotation struct {
+	PreviousUsername string    `json:"previous_username"`
+	Username         string    `json:"username"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	CreatedAt        time.Time `json:"created_at"`
+
+	resource string
+	database string
+	backend  *backend
+}
+
+type rotateRequest struct {
+	Overlap string `json:"overlap"`
+}
+
+type rotateResponse struct {
+	ID       string            `json:"id"`
+	Env      map[string]string `json:"env"`
+	Rotation *rotation         `json:"rotation"`
+}
+
+// rotateCredentials starts a credential rotation by creating a second login
+// role which is a member of the current one, so it has the same privileges.
+// The env for the new role is returned, and the old role keeps working until
+// the rotation is confirmed or the overlap window lapses, giving every app
+// instance the chance to pick up the new credentials.
+func (p *pgAPI) rotateCredentials(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	var config rotateRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil && err != io.EOF {
+		httphelper.Error(w, err)
+		return
+	}
+	overlap := rotationOverlap
+	if config.Overlap != "" {
+		d, err := time.ParseDuration(config.Overlap)
+		if err != nil || d <= 0 {
+			httphelper.ValidationError(w, "overlap", "is invalid")
+			return
+		}
+		overlap = d
+	}
+
+	res, err := startRotation(p.state, r, overlap, nil)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	audit(requestOrigin(ctx, req), securityAdmin, "rotate_credentials", r.id(), nil)
+	httphelper.JSON(w, 200, res)
+}
+
+// startRotation creates the new role of a rotation of r's credentials, which
+// overlap with the old ones for the given duration. store, if given, is
+// called with the new credentials before the role is created, and returns a
+// function undoing it, called if the rotation can't be started.
+func startRotation(state *postgres.DB, r *resourceRef, overlap time.Duration, store func(*rotateResponse) (func(), error)) (*rotateResponse, error) {
+	var pending bool
+	if err := state.QueryRow(`SELECT EXISTS (SELECT 1 FROM rotations WHERE resource = $1)`, r.UUID).Scan(&pending); err != nil {
+		return nil, err
+	}
+	if pending {
+		return nil, errRotationInProgress
+	}
+	b := r.Backend
+	if err := b.checkPrimary(); err != nil {
+		return nil, err
+	}
+
+	username, _, err := generateNames(b, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateName("username", username); err != nil {
+		return nil, err
+	}
+	var expiresAt *time.Time
+	if err := state.QueryRow(`SELECT expires_at FROM resources WHERE uuid = $1`, r.UUID).Scan(&expiresAt); err != nil {
+		return nil, err
+	}
+	password := random.Hex(16)
+	res := &rotateResponse{
+		ID:       resourceID(r.UUID),
+		Env:      resourceEnv(b, username, password, r.Database),
+		Rotation: &rotation{PreviousUsername: r.Username, Username: username},
+	}
+	undo := func() {}
+	if store != nil {
+		if undo, err = store(res); err != nil {
+			return nil, err
+		}
+	}
+	if err := createLoginRole(b, username, password, expiresAt, r.Username); err != nil {
+		undo()
+		return nil, err
+	}
+	if err := extendDefaultPrivileges(b, r.Database, username); err != nil {
+		dropRotationRole(b, r.Database, username)
+		undo()
+		return nil, err
+	}
+	rot := res.Rotation
+	if err := state.QueryRow(`INSERT INTO rotations (resource, old_username, new_username, expires_at) VALUES ($1, $2, $3, now() + make_interval(secs => $4)) RETURNING expires_at, created_at`,
+		r.UUID, r.Username, username, overlap.Seconds()).Scan(&rot.ExpiresAt, &rot.CreatedAt); err != nil {
+		dropRotationRole(b, r.Database, username)
+		undo()
+		return nil, err
+	}
+	return res, nil
+}
+
+// abortRotation undoes a rotation of r's credentials to username which has
+// been started but not delivered.
+func abortRotation(state *postgres.DB, r *resourceRef, username string) error {
+	if err := state.Exec(`DELETE FROM rotations WHERE resource = $1 AND new_username = $2`, r.UUID, username); err != nil {
+		return err
+	}
+	return dropRotationRole(r.Backend, r.Database, username)
+}
+
+// dropRotationRole drops the new role of a rotation, along with the default
+// privileges granted for it in database.
+func dropRotationRole(b *backend, database, username string) error {
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(fmt.Sprintf(`DROP OWNED BY "%s"`, username))
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	return b.db.Exec(fmt.Sprintf(`DROP USER "%s"`, username))
+}
+
+// confirmRotation completes a credential rotation once all apps have moved to
+// the new credentials, without waiting for the overlap window to lapse.
+func (p *pgAPI) confirmRotation(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	rot, err := loadRotation(p.state, r)
+	if err == nil && rot == nil {
+		err = errNoRotation
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	// completing the rotation terminates the old role's sessions
+	source := requestOrigin(ctx, req)
+	if op, err := p.schedule(r, "confirm_rotation", source, struct{}{}, req); err != nil {
+		httphelper.Error(w, err)
+		return
+	} else if op != nil {
+		acceptScheduled(w, op, op)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	err = completeRotation(p.state, rot)
+	audit(source, securityAdmin, "confirm_rotation", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, rot)
+}
+
+// loadRotation returns the rotation in progress for r, nil if there isn't
+// one.
+func loadRotation(state *postgres.DB, r *resourceRef) (*rotation, error) {
+	rot := &rotation{resource: r.UUID, database: r.Database, backend: r.Backend}
+	err := state.QueryRow(`SELECT old_username, new_username, expires_at, created_at FROM rotations WHERE resource = $1`, r.UUID).Scan(
+		&rot.PreviousUsername, &rot.Username, &rot.ExpiresAt, &rot.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return rot, nil
+}
+
+// completeRotation hands the database and everything in it over to the new
+// role, drops the old role after terminating its sessions, and records the
+// new role as the resource's owner. It is safe to repeat if interrupted.
+func completeRotation(state *postgres.DB, rot *rotation) error {
+	b := rot.backend
+	var exists bool
+	if err := b.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, rot.PreviousUsername).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		conn, err := pgx.Connect(b.connConfig(rot.database))
+		if err != nil {
+			return err
+		}
+		// REASSIGN OWNED also covers the database itself
+		_, err = conn.Exec(fmt.Sprintf(`REASSIGN OWNED BY "%s" TO "%s"`, rot.PreviousUsername, rot.Username))
+		if err == nil {
+			_, err = conn.Exec(fmt.Sprintf(`DROP OWNED BY "%s"`, rot.PreviousUsername))
+		}
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		if err := reassignSnapshots(state, b, rot.resource, rot.PreviousUsername, rot.Username); err != nil {
+			return err
+		}
+		if err := b.db.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1`, rot.PreviousUsername); err != nil {
+			return err
+		}
+		if err := b.db.Exec(fmt.Sprintf(`DROP USER "%s"`, rot.PreviousUsername)); err != nil {
+			return err
+		}
+	}
+
+	tx, err := state.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.Exec(`UPDATE resources SET username = $1, rotated_at = now() WHERE uuid = $2`, rot.Username, rot.resource); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Exec(`DELETE FROM rotations WHERE resource = $1`, rot.resource); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	notify("credentials.rotated", map[string]interface{}{
+		"id":                resourceID(rot.resource),
+		"database":          rot.database,
+		"username":          rot.Username,
+		"previous_username": rot.PreviousUsername,
+	})
+	return nil
+}
+
+// rotationMonitor completes rotations whose overlap window has lapsed.
+type rotationMonitor struct {
+	state    *postgres.DB
+	backends *backendSet
+}
+
+func (m *rotationMonitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.check(); err != nil {
+			logger.Error("error checking credential rotations", "err", err)
+		}
+	}
+}
+
+func (m *rotationMonitor) check() error {
+	rows, err := m.state.Query(`
+SELECT r.resource, s.database, s.region, r.old_username, r.new_username, r.expires_at, r.created_at
+FROM rotations r JOIN resources s ON s.uuid = r.resource
+WHERE r.expires_at <= now()`)
+	if err != nil {
+		return err
+	}
+	var expired []*rotation
+	for rows.Next() {
+		rot := &rotation{}
+		var region *string
+		if err := rows.Scan(&rot.resource, &rot.database, &region, &rot.PreviousUsername, &rot.Username, &rot.ExpiresAt, &rot.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		if rot.backend, err = m.backends.forRegion(region); err != nil {
+			logger.Error("error completing credential rotation", "database", rot.database, "err", err)
+			continue
+		}
+		expired = append(expired, rot)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rot := range expired {
+		if err := completeRotation(m.state, rot); err != nil {
+			logger.Error("error completing credential rotation", "database", rot.database, "err", err)
+		}
+	}
+	return m.startScheduled()
+}
+
+// startScheduled starts the rotations due under the resources' rotation
+// policies, and delivers the new credentials.
+func (m *rotationMonitor) startScheduled() error {
+	rows, err := m.state.Query(`
+SELECT uuid, username, database, region, rotation_overlap_seconds
+FROM resources s
+WHERE rotation_interval_seconds IS NOT NULL AND status IN ('ready', 'degraded')
+  AND coalesce(rotated_at, created_at) + make_interval(secs => rotation_interval_seconds) <= now()
+  AND NOT EXISTS (SELECT 1 FROM rotations WHERE resource = s.uuid)`)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		ref     *resourceRef
+		overlap *float64
+	}
+	var scheduled []due
+	for rows.Next() {
+		r := &resourceRef{}
+		var region *string
+		var overlap *float64
+		if err := rows.Scan(&r.UUID, &r.Username, &r.Database, &region, &overlap); err != nil {
+			rows.Close()
+			return err
+		}
+		if r.Backend, err = m.backends.forRegion(region); err != nil {
+			logger.Error("error starting scheduled credential rotation", "database", r.Database, "err", err)
+			continue
+		}
+		scheduled = append(scheduled, due{r, overlap})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range scheduled {
+		overlap := rotationOverlap
+		if d.overlap != nil {
+			overlap = time.Duration(*d.overlap * float64(time.Second))
+		}
+		var store func(*rotateResponse) (func(), error)
+		if vault != nil {
+			store = storeCredentials
+		}
+		res, err := startRotation(m.state, d.ref, overlap, store)
+		if err == nil {
+			if err = deliverCredentials(res); err != nil {
+				if err := abortRotation(m.state, d.ref, res.Rotation.Username); err != nil {
+					logger.Error("error undoing undelivered credential rotation", "database", d.ref.Database, "err", err)
+				}
+			}
+		}
+		audit(origin{}, securityAdmin, "scheduled_rotation", d.ref.id(), err)
+		if err != nil {
+			logger.Error("error starting scheduled credential rotation", "database", d.ref.Database, "err", err)
+		}
+	}
+	return nil
+}
+
+// storeCredentials writes the new credentials of a scheduled rotation to
+// Vault, returning a function restoring the previous version of the secret.
+func storeCredentials(res *rotateResponse) (func(), error) {
+	name := strings.TrimPrefix(res.ID, "/databases/")
+	prev, err := vault.read(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := vault.write(name, res.Env); err != nil {
+		return nil, err
+	}
+	return func() {
+		if prev != nil {
+			_, err = vault.write(name, prev)
+		} else {
+			err = vault.delete(name)
+		}
+		if err != nil {
+			logger.Error("error restoring credentials in vault", "path", vault.secretPath(name), "err", err)
+		}
+	}, nil
+}
+
+// deliverCredentials hands the new credentials of a scheduled rotation to
+// the app's owners. When VAULT_ADDR is set they have already been stored
+// there and a webhook says where, otherwise they are sent in the webhook
+// itself, which has to be accepted for the rotation to go ahead.
+func deliverCredentials(res *rotateResponse) error {
+	data := map[string]interface{}{
+		"id":       res.ID,
+		"rotation": res.Rotation,
+	}
+	if vault != nil {
+		data["vault_path"] = vault.secretPath(strings.TrimPrefix(res.ID, "/databases/"))
+		notify("credentials.rotation_started", data)
+		return nil
+	}
+	data["env"] = res.Env
+	return notifySync("credentials.rotation_started", data)
+}
+
+// errNoCredentialDelivery is returned for rotation policies when the new
+// credentials would have nowhere to go.
+var errNoCredentialDelivery = httphelper.JSONError{
+	Code:    httphelper.PreconditionFailedErrorCode,
+	Message: "rotation policies require WEBHOOK_URL or VAULT_ADDR to deliver the new credentials",
+}
+
+// checkCredentialDelivery fails if resources have rotation policies but
+// neither WEBHOOK_URL nor VAULT_ADDR is set.
+func checkCredentialDelivery(state *postgres.DB) error {
+	if webhookURL != "" || vault != nil {
+		return nil
+	}
+	var policies int
+	if err := state.QueryRow(`SELECT count(*) FROM resources WHERE rotation_interval_seconds IS NOT NULL`).Scan(&policies); err != nil {
+		return err
+	}
+	if policies > 0 {
+		return fmt.Errorf("%d resources have rotation policies, which require WEBHOOK_URL or VAULT_ADDR to deliver the new credentials", policies)
+	}
+	return nil
+}
+
+type rotationPolicy struct {
+	Interval string `json:"interval"`
+	Overlap  string `json:"overlap,omitempty"`
+}
+
+// setRotationPolicy has a resource's credentials rotated automatically every
+// interval, e.g. {"interval": "2160h"} for 90 days.
+func (p *pgAPI) setRotationPolicy(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	if webhookURL == "" && vault == nil {
+		httphelper.Error(w, errNoCredentialDelivery)
+		return
+	}
+	var policy rotationPolicy
+	if err := httphelper.DecodeJSON(req, &policy); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	interval, err := time.ParseDuration(policy.Interval)
+	if err != nil || interval < time.Hour {
+		httphelper.ValidationError(w, "interval", "must be a duration of at least 1h")
+		return
+	}
+	var overlap *float64
+	if policy.Overlap != "" {
+		d, err := time.ParseDuration(policy.Overlap)
+		if err != nil || d <= 0 || d >= interval {
+			httphelper.ValidationError(w, "overlap", "must be a positive duration shorter than the interval")
+			return
+		}
+		secs := d.Seconds()
+		overlap = &secs
+	}
+	if err := p.state.Exec(`UPDATE resources SET rotation_interval_seconds = $1, rotation_overlap_seconds = $2 WHERE uuid = $3`,
+		interval.Seconds(), overlap, r.UUID); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	audit(requestOrigin(ctx, req), securityAdmin, "set_rotation_policy", r.id(), nil)
+	httphelper.JSON(w, 200, policy)
+}
+
+// deleteRotationPolicy stops rotating a resource's credentials automatically.
+func (p *pgAPI) deleteRotationPolicy(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	if err := p.state.Exec(`UPDATE resources SET rotation_interval_seconds = NULL, rotation_overlap_seconds = NULL WHERE uuid = $1`, r.UUID); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	audit(requestOrigin(ctx, req), securityAdmin, "delete_rotation_policy", r.id(), nil)
+	w.WriteHeader(200)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchDocument is the text searched for each resource, including its
+// owners, the tenant and requester. The simple configuration is used as names
+// aren't natural language. It must match the expression of the
+// resources_search index created by state migration 30, for the index to be
+// used.
+const searchDocument = `to_tsvector('simple', coalesce(database, '') || ' ' || coalesce(username, '') || ' ' || coalesce(app, '') || ' ' || coalesce(env, '') || ' ' || coalesce(comment, '') || ' ' || coalesce(tenant, '') || ' ' || coalesce(created_by, '') || ' ' || search_tags(tags))`
+
+var searchWordChars = regexp.MustCompile(`[[:alnum:]]+`)
+
+// getDatabase returns a resource from the state database. httprouter
+// doesn't allow a static segment next to the :id wildcard, so
+// /databases/search is dispatched from here.
+func (p *pgAPI) getDatabase(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	if params.ByName("id") == "search" {
+		p.searchDatabases(ctx, w, req)
+		return
+	}
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	info, err := scanResourceInfo(p.state.QueryRow(`SELECT `+resourceInfoColumns+` FROM resources WHERE uuid = $2`, p.backend.region, r.UUID))
+	if err == pgx.ErrNoRows {
+		err = errResourceNotFound
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, info)
+}
+
+// searchDatabases finds resources whose names, app, env, comment, tags,
+// tenant or requester contain words starting with those in ?q=, best matches first. Tenant
+// scoped API keys only find their tenant's resources.
+func (p *pgAPI) searchDatabases(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	words := searchWordChars.FindAllString(strings.ToLower(req.FormValue("q")), -1)
+	if len(words) == 0 {
+		httphelper.ValidationError(w, "q", "must contain at least one letter or digit")
+		return
+	}
+	limit := defaultSearchLimit
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			httphelper.ValidationError(w, "limit", fmt.Sprintf("must be between 1 and %d", maxSearchLimit))
+			return
+		}
+		limit = n
+	}
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	query := strings.Join(words, " & ")
+
+	rows, err := p.state.Query(`
+SELECT `+resourceInfoColumns+` FROM resources
+WHERE `+searchDocument+` @@ to_tsquery('simple', $2) AND ($4 = '' OR tenant = $4)
+ORDER BY ts_rank(`+searchDocument+`, to_tsquery('simple', $2)) DESC, created_at DESC
+LIMIT $3`, p.backend.region, query, limit, callerTenant(ctx))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	resources := []*resourceInfo{}
+	for rows.Next() {
+		r, err := scanResourceInfo(rows)
+		if err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, resources)
+}
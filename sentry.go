@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// sentryReporter sends errors to a Sentry compatible service, using the
+// store endpoint of its HTTP API. Reports are sent in the background on a
+// best effort basis, and dropped if they can't keep up.
+type sentryReporter struct {
+	endpoint    string
+	auth        string
+	environment string
+	serverName  string
+	client      *http.Client
+	events      chan *sentryEvent
+}
+
+type sentryEvent struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Logger      string                 `json:"logger"`
+	Platform    string                 `json:"platform"`
+	Message     string                 `json:"message"`
+	ServerName  string                 `json:"server_name,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+}
+
+// newSentryReporter parses a DSN of the form
+// https://<key>[:<secret>]@<host>[/<path>]/<project>.
+func newSentryReporter(dsn, environment string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("missing public key")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || u.Path[i+1:] == "" {
+		return nil, fmt.Errorf("missing project ID")
+	}
+	project, path := u.Path[i+1:], u.Path[:i]
+	auth := "Sentry sentry_version=7, sentry_client=pg-external/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+		registerSecret(secret)
+	}
+	hostname, _ := os.Hostname()
+	return &sentryReporter{
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path, project),
+		auth:        auth,
+		environment: environment,
+		serverName:  hostname,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		events:      make(chan *sentryEvent, 100),
+	}, nil
+}
+
+// handler reports the error and critical records logged, which include
+// handler errors and panics. Records are expected to be redacted already.
+func (s *sentryReporter) handler() log15.Handler {
+	return log15.FuncHandler(func(r *log15.Record) error {
+		if r.Lvl > log15.LvlError {
+			return nil
+		}
+		e := &sentryEvent{
+			EventID:     strings.Replace(random.UUID(), "-", "", -1),
+			Timestamp:   r.Time.UTC().Format("2006-01-02T15:04:05"),
+			Level:       "error",
+			Logger:      "pg-external",
+			Platform:    "go",
+			Message:     r.Msg,
+			ServerName:  s.serverName,
+			Environment: s.environment,
+			Tags:        make(map[string]string),
+			Extra:       make(map[string]interface{}),
+		}
+		if r.Lvl == log15.LvlCrit {
+			e.Level = "fatal"
+		}
+		for i := 1; i < len(r.Ctx); i += 2 {
+			key, _ := r.Ctx[i-1].(string)
+			value := fmt.Sprint(r.Ctx[i])
+			switch key {
+			case "component", "req_id", "method", "path", "database", "backend", "job":
+				e.Tags[key] = value
+			case "err", "panic":
+				e.Message += ": " + value
+			default:
+				e.Extra[key] = value
+			}
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+		return nil
+	})
+}
+
+func (s *sentryReporter) run() {
+	for e := range s.events {
+		if err := s.send(e); err != nil {
+			// logged at warning level so that it isn't itself reported
+			logger.Warn("error sending error report", "err", err)
+		}
+	}
+}
+
+func (s *sentryReporter) send(e *sentryEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
-	"crypto/tls"
+	"time"
 
 	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
@@ -15,143 +22,1452 @@ import (
 	"github.com/jackc/pgx"
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/net/context"
+	"gopkg.in/inconshreveable/log15.v2"
 )
 
 const (
-	disallowConns   = `UPDATE pg_database SET datallowconn = FALSE WHERE datname = $1`
 	disconnectConns = `
 SELECT pg_terminate_backend(pg_stat_activity.pid)
 FROM pg_stat_activity
 WHERE pg_stat_activity.datname = $1
   AND pid <> pg_backend_pid();`
+	connectedPids = `SELECT pid FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid() ORDER BY pid`
+
+	// dropLockTimeout bounds how long DROP DATABASE waits for a lock, and
+	// dropAttempts how many times connections which reappear are
+	// terminated before giving up.
+	dropLockTimeout = "5s"
+	dropAttempts    = 5
 )
 
 var serviceUser = os.Getenv("PGUSER")
 var serviceHost = os.Getenv("PGHOST")
+var servicePort = os.Getenv("PGPORT")
 var servicePass = os.Getenv("PGPASSWORD")
 var servicePgSSL = os.Getenv("PGSSLMODE")
+var serviceRootCert = os.Getenv("PGSSLROOTCERT")
+var resourceRootCert = os.Getenv("RESOURCE_PGSSLROOTCERT")
+var connFormats = os.Getenv("CONNECTION_FORMATS")
+var envNames = os.Getenv("ENV_NAMES")
+var envNamesReplace = os.Getenv("ENV_NAMES_REPLACE") == "true"
+var namePrefix = os.Getenv("NAME_PREFIX")
+var blocklist = os.Getenv("NAME_BLOCKLIST")
+var deriveNames = os.Getenv("DERIVE_NAMES") == "true"
+var backendName = os.Getenv("BACKEND_NAME")
+var apiSocket = os.Getenv("API_SOCKET")
+var apiDisableTCP = os.Getenv("API_DISABLE_TCP") == "true"
+var apiTLSCert = os.Getenv("API_TLS_CERT")
+var apiTLSKey = os.Getenv("API_TLS_KEY")
+var apiH2C = os.Getenv("API_H2C") == "true"
+var apiH2CCIDRs = os.Getenv("API_H2C_CIDRS")
+var apiAdminKey = os.Getenv("API_ADMIN_KEY")
+var requesterHeader = os.Getenv("REQUESTER_HEADER")
+var queueSubject = os.Getenv("QUEUE_SUBJECT")
+var queueGroup = os.Getenv("QUEUE_GROUP")
+var resourceResponseVersion = resourceVersionLegacy
+var queueURL *url.URL
+var apiAllowedCIDRs = os.Getenv("API_ALLOWED_CIDRS")
+var apiTrustedProxies = os.Getenv("API_TRUSTED_PROXIES")
+var oidcIssuer = os.Getenv("OIDC_ISSUER")
+var oidcAudience = os.Getenv("OIDC_AUDIENCE")
+var oidcRoleClaim = os.Getenv("OIDC_ROLE_CLAIM")
+var oidcRoles = os.Getenv("OIDC_ROLES")
+var oidcTenantClaim = os.Getenv("OIDC_TENANT_CLAIM")
+var apiKeepAlive = os.Getenv("API_KEEPALIVE") != "false"
+var apiIdleTimeout = durationEnv("API_IDLE_TIMEOUT", 2*time.Minute)
+var apiReadHeaderTimeout = durationEnv("API_READ_HEADER_TIMEOUT", 10*time.Second)
 var systemPgsql = os.Getenv("FLYNN_POSTGRES")
+var stateDatabase = os.Getenv("STATE_DATABASE")
+var webhookURL = os.Getenv("WEBHOOK_URL")
+var defaultQuota = os.Getenv("DEFAULT_QUOTA")
+var quotaThresholds = os.Getenv("QUOTA_THRESHOLDS")
+var quotaInterval = durationEnv("QUOTA_CHECK_INTERVAL", time.Minute)
+var quotaEnforce = os.Getenv("QUOTA_ENFORCE") == "true"
+var slowQueryThreshold = durationEnv("SLOW_QUERY_THRESHOLD", 5*time.Second)
+var slowQueryInterval = durationEnv("SLOW_QUERY_SAMPLE_INTERVAL", 10*time.Second)
+var slowQueryWebhook = os.Getenv("SLOW_QUERY_WEBHOOK") == "true"
+var backendInterval = durationEnv("BACKEND_CHECK_INTERVAL", 5*time.Minute)
+var discovery = os.Getenv("DISCOVERY")
+var discoveryInterval = durationEnv("DISCOVERY_INTERVAL", 30*time.Second)
+var consulAddr = os.Getenv("CONSUL_HTTP_ADDR")
+var consulToken = os.Getenv("CONSUL_HTTP_TOKEN")
+var etcdEndpoint = os.Getenv("ETCD_ENDPOINT")
+var region = os.Getenv("REGION")
+var regions = os.Getenv("REGIONS")
+var defaultRegion = os.Getenv("DEFAULT_REGION")
+var rotationOverlap = durationEnv("ROTATION_OVERLAP", 24*time.Hour)
+var rotationInterval = durationEnv("ROTATION_CHECK_INTERVAL", time.Minute)
+var healthInterval = durationEnv("HEALTH_CHECK_INTERVAL", time.Minute)
+var expiryInterval = durationEnv("EXPIRY_CHECK_INTERVAL", time.Minute)
+var expiryWarning = durationEnv("EXPIRY_WARNING", time.Hour)
+var slotInterval = durationEnv("SLOT_CHECK_INTERVAL", time.Minute)
+var capacityInterval = durationEnv("CAPACITY_CHECK_INTERVAL", time.Minute)
+var poolInterval = durationEnv("POOL_REFILL_INTERVAL", time.Minute)
+var archiveOnDeprovision = os.Getenv("ARCHIVE_ON_DEPROVISION") == "true"
+var archiveRetention = durationEnv("ARCHIVE_RETENTION", 90*24*time.Hour)
+var maintenanceInterval = durationEnv("MAINTENANCE_CHECK_INTERVAL", time.Minute)
+var provisionTimeout = durationEnv("PROVISION_TIMEOUT", 30*time.Minute)
+var janitorInterval = durationEnv("JANITOR_INTERVAL", 5*time.Minute)
+var jobDrainTimeout = durationEnv("JOB_DRAIN_TIMEOUT", time.Minute)
+var probeInterval = durationEnv("BACKEND_PROBE_INTERVAL", 10*time.Second)
+var probeMaxBackoff = durationEnv("BACKEND_PROBE_MAX_BACKOFF", 2*time.Minute)
+var maxLifetime = durationEnv("MAX_LIFETIME", 0)
+var sloWindowList = os.Getenv("SLO_WINDOWS")
+var siemURL = os.Getenv("SIEM_URL")
+var siemFormat = os.Getenv("SIEM_FORMAT")
+var logSinks = os.Getenv("LOG_SINKS")
+var sentryDSN = os.Getenv("SENTRY_DSN")
+var sentryEnvironment = os.Getenv("SENTRY_ENVIRONMENT")
+var canaryInterval = durationEnv("CANARY_INTERVAL", 0)
+var maxRenewals = os.Getenv("MAX_RENEWALS")
+var readOnly = os.Getenv("READ_ONLY") == "true"
+var accessRoles = os.Getenv("ACCESS_ROLES") == "true"
+var readonlyCredentials = os.Getenv("READONLY_CREDENTIALS") == "true"
+var roleAttributeList = os.Getenv("ROLE_ATTRIBUTES")
+var monitoringRole = os.Getenv("MONITORING_ROLE")
+var appSchema = os.Getenv("APP_SCHEMA")
+var extensionList = os.Getenv("ALLOWED_EXTENSIONS")
+var vaultAddr = os.Getenv("VAULT_ADDR")
+var vaultToken = os.Getenv("VAULT_TOKEN")
+var vaultMount = os.Getenv("VAULT_MOUNT")
+var vaultPath = os.Getenv("VAULT_PATH")
+var passwordMinLength = 16
+var roleValidUntilExpiry = os.Getenv("ROLE_VALID_UNTIL_EXPIRY") == "true"
+
+var logger = log15.New("app", "pg-external")
+
+var validPrefix = regexp.MustCompile(`^([a-z][a-z0-9_]*)?$`)
 
-func init() {
+var rootCertPEM []byte
+var rootCertPool *x509.CertPool
+var enabledFormats []string
+var envRules []envRule
+var nameBlocklist []string
+var apiSocketMode os.FileMode = 0660
+var apiMaxHeaderBytes = http.DefaultMaxHeaderBytes
+var jobWorkers = 4
+var jobBackendWorkers int
+var jobQueueSize = 100
+var backendDownAfter = 3
+var poolSize int
+var slotWarningSize int64 = 1 << 30
+var slotDropSize int64
+var capacityDiskLimit int64
+var capacityConnectionsPercent int
+var capacityMaxDatabases int
+var maxManagedDatabases int
+var tenantMaxDatabases int
+var tenantMaxSize int64
+var backendDiscover discoverFunc
+var regionConfigs []*regionConfig
+var maxRenewalCount int
+var sloWindows []sloPeriod
+var roleAttributes string
+var sentry *sentryReporter
+
+// loadConfig checks the configuration and fills in defaults, panicking if
+// it is invalid. It is called first thing in main rather than from init, so
+// that tests don't need a configured environment.
+func loadConfig() {
+	logHandler := log15.StdoutHandler
+	if logSinks != "" {
+		var err error
+		if logHandler, err = parseLogSinks(logSinks); err != nil {
+			panic(fmt.Sprintf("LOG_SINKS is invalid: %s", err))
+		}
+	}
+	if sentryDSN != "" {
+		var err error
+		if sentry, err = newSentryReporter(sentryDSN, sentryEnvironment); err != nil {
+			panic(fmt.Sprintf("SENTRY_DSN is invalid: %s", err))
+		}
+		logHandler = log15.MultiHandler(logHandler, sentry.handler())
+	}
+	log15.Root().SetHandler(redactHandler(logHandler))
 	if serviceUser == "" {
 		serviceUser = "flynn"
 	}
-	if serviceHost == "" {
-		panic("PGHOST must be set to the target database server hostname")
+	if serviceHost == "" && discovery == "" {
+		panic("PGHOST must be set to the target database server hostname or Unix socket directory")
+	}
+	// accept bracketed IPv6 literals as used in URLs
+	serviceHost = strings.TrimSuffix(strings.TrimPrefix(serviceHost, "["), "]")
+	if servicePort == "" {
+		servicePort = "5432"
+	}
+	if _, err := strconv.ParseUint(servicePort, 10, 16); err != nil {
+		panic("PGPORT must be a valid port number")
 	}
 	if servicePass == "" {
 		panic("PGPASSWORD must be set to the database admin user password")
 	}
-	if servicePgSSL == "" {
-		servicePgSSL = ""
+	registerSecret(servicePass)
+	registerSecret(consulToken)
+	registerSecret(apiAdminKey)
+	switch servicePgSSL {
+	case "":
+		// TLS has always been required, but without verification
+		servicePgSSL = "require"
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		panic("PGSSLMODE must be one of disable, allow, prefer, require, verify-ca or verify-full")
+	}
+	if serviceRootCert != "" {
+		var err error
+		rootCertPEM, err = ioutil.ReadFile(serviceRootCert)
+		if err != nil {
+			panic(fmt.Sprintf("error reading PGSSLROOTCERT: %s", err))
+		}
+		rootCertPool = x509.NewCertPool()
+		if !rootCertPool.AppendCertsFromPEM(rootCertPEM) {
+			panic("PGSSLROOTCERT does not contain any PEM encoded certificates")
+		}
 	}
 	if systemPgsql == "" {
 		systemPgsql = "postgres"
 	}
+	for _, name := range strings.Split(connFormats, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := connectionFormats[name]; !ok {
+			panic(fmt.Sprintf("CONNECTION_FORMATS contains unknown format %q", name))
+		}
+		enabledFormats = append(enabledFormats, name)
+	}
+	var err error
+	if envRules, err = parseEnvRules(envNames); err != nil {
+		panic(fmt.Sprintf("ENV_NAMES is invalid: %s", err))
+	}
+	// generated names are 32 characters, leaving 31 of the 63 available
+	// for the prefix
+	if len(namePrefix) > 31 || !validPrefix.MatchString(namePrefix) {
+		panic("NAME_PREFIX must be at most 31 lowercase letters, digits or underscores, starting with a letter")
+	}
+	for _, name := range strings.Split(blocklist, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			nameBlocklist = append(nameBlocklist, name)
+		}
+	}
+	if discovery != "" {
+		if backendDiscover, err = parseDiscovery(discovery); err != nil {
+			panic(fmt.Sprintf("DISCOVERY is invalid: %s", err))
+		}
+	}
+	if consulAddr == "" {
+		consulAddr = "127.0.0.1:8500"
+	}
+	if etcdEndpoint == "" {
+		etcdEndpoint = "127.0.0.1:2379"
+	}
+	if backendName == "" {
+		if serviceHost != "" {
+			backendName = net.JoinHostPort(serviceHost, servicePort)
+		} else {
+			backendName = discovery
+		}
+	}
+	if m := os.Getenv("API_SOCKET_MODE"); m != "" {
+		mode, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			panic("API_SOCKET_MODE must be an octal file mode such as 0660")
+		}
+		apiSocketMode = os.FileMode(mode)
+	}
+	if n := os.Getenv("API_MAX_HEADER_BYTES"); n != "" {
+		var err error
+		if apiMaxHeaderBytes, err = strconv.Atoi(n); err != nil || apiMaxHeaderBytes <= 0 {
+			panic("API_MAX_HEADER_BYTES must be a positive number")
+		}
+	}
+	if n := os.Getenv("JOB_WORKERS"); n != "" {
+		var err error
+		if jobWorkers, err = strconv.Atoi(n); err != nil || jobWorkers <= 0 {
+			panic("JOB_WORKERS must be a positive number")
+		}
+	}
+	if n := os.Getenv("JOB_BACKEND_WORKERS"); n != "" {
+		var err error
+		if jobBackendWorkers, err = strconv.Atoi(n); err != nil || jobBackendWorkers <= 0 {
+			panic("JOB_BACKEND_WORKERS must be a positive number")
+		}
+	} else {
+		jobBackendWorkers = jobWorkers
+	}
+	if n := os.Getenv("BACKEND_DOWN_AFTER"); n != "" {
+		var err error
+		if backendDownAfter, err = strconv.Atoi(n); err != nil || backendDownAfter <= 0 {
+			panic("BACKEND_DOWN_AFTER must be a positive number")
+		}
+	}
+	if n := os.Getenv("POOL_SIZE"); n != "" {
+		var err error
+		if poolSize, err = strconv.Atoi(n); err != nil || poolSize < 0 {
+			panic("POOL_SIZE must be a number")
+		}
+	}
+	if n := os.Getenv("JOB_QUEUE_SIZE"); n != "" {
+		var err error
+		if jobQueueSize, err = strconv.Atoi(n); err != nil || jobQueueSize <= 0 {
+			panic("JOB_QUEUE_SIZE must be a positive number")
+		}
+	}
+	if (apiTLSCert == "") != (apiTLSKey == "") {
+		panic("API_TLS_CERT and API_TLS_KEY must be set together")
+	}
+	if apiDisableTCP && apiSocket == "" {
+		panic("API_SOCKET must be set when API_DISABLE_TCP is true")
+	}
+	if region == "" {
+		region = "default"
+	}
+	if regionConfigs, err = parseRegions(regions); err != nil {
+		panic(fmt.Sprintf("REGIONS is invalid: %s", err))
+	}
+	if defaultRegion == "" {
+		defaultRegion = region
+	}
+	known := defaultRegion == region
+	for _, r := range regionConfigs {
+		known = known || r.Region == defaultRegion
+	}
+	if !known {
+		panic("DEFAULT_REGION must be REGION or one of the regions in REGIONS")
+	}
+	if maxRenewals != "" {
+		if maxRenewalCount, err = strconv.Atoi(maxRenewals); err != nil || maxRenewalCount < 0 {
+			panic("MAX_RENEWALS must be a number")
+		}
+	}
+	if stateDatabase == "" {
+		stateDatabase = "pg_external"
+	}
+	if quotaThresholds == "" {
+		quotaThresholds = "80,90,100"
+	}
+	if sloWindowList == "" {
+		sloWindowList = "1h,24h,168h,720h"
+	}
+	if sloWindows, err = parseWindows(sloWindowList); err != nil {
+		panic(fmt.Sprintf("SLO_WINDOWS is invalid: %s", err))
+	}
+	if readonlyCredentials {
+		accessRoles = true
+	}
+	if s := os.Getenv("CAPACITY_DISK_LIMIT"); s != "" {
+		if capacityDiskLimit, err = parseSize(s); err != nil {
+			panic(fmt.Sprintf("CAPACITY_DISK_LIMIT is invalid: %s", err))
+		}
+	}
+	if n := os.Getenv("CAPACITY_CONNECTIONS_PERCENT"); n != "" {
+		if capacityConnectionsPercent, err = strconv.Atoi(n); err != nil || capacityConnectionsPercent < 1 || capacityConnectionsPercent > 100 {
+			panic("CAPACITY_CONNECTIONS_PERCENT must be a number between 1 and 100")
+		}
+	}
+	if n := os.Getenv("CAPACITY_MAX_DATABASES"); n != "" {
+		if capacityMaxDatabases, err = strconv.Atoi(n); err != nil || capacityMaxDatabases < 1 {
+			panic("CAPACITY_MAX_DATABASES must be a positive number")
+		}
+	}
+	if n := os.Getenv("MAX_DATABASES_PER_BACKEND"); n != "" {
+		if maxManagedDatabases, err = strconv.Atoi(n); err != nil || maxManagedDatabases < 1 {
+			panic("MAX_DATABASES_PER_BACKEND must be a positive number")
+		}
+	}
+	if n := os.Getenv("TENANT_MAX_DATABASES"); n != "" {
+		if tenantMaxDatabases, err = strconv.Atoi(n); err != nil || tenantMaxDatabases < 0 {
+			panic("TENANT_MAX_DATABASES must be a number")
+		}
+	}
+	if s := os.Getenv("TENANT_MAX_SIZE"); s != "" {
+		if tenantMaxSize, err = parseSize(s); err != nil {
+			panic(fmt.Sprintf("TENANT_MAX_SIZE is invalid: %s", err))
+		}
+	}
+	if s := os.Getenv("SLOT_WARNING_SIZE"); s != "" {
+		if slotWarningSize, err = parseSize(s); err != nil {
+			panic(fmt.Sprintf("SLOT_WARNING_SIZE is invalid: %s", err))
+		}
+	}
+	if s := os.Getenv("SLOT_DROP_SIZE"); s != "" {
+		if slotDropSize, err = parseSize(s); err != nil {
+			panic(fmt.Sprintf("SLOT_DROP_SIZE is invalid: %s", err))
+		}
+		if slotDropSize < slotWarningSize {
+			panic("SLOT_DROP_SIZE must not be less than SLOT_WARNING_SIZE")
+		}
+	}
+	if n := os.Getenv("PASSWORD_MIN_LENGTH"); n != "" {
+		if passwordMinLength, err = strconv.Atoi(n); err != nil || passwordMinLength < 8 || passwordMinLength > 128 {
+			panic("PASSWORD_MIN_LENGTH must be a number between 8 and 128")
+		}
+	}
+	if appSchema != "" {
+		if err := validateName("APP_SCHEMA", appSchema); err != nil {
+			panic(err.Error())
+		}
+	}
+	if monitoringRole != "" && !validIdentifier.MatchString(monitoringRole) {
+		panic("MONITORING_ROLE must contain only lowercase letters, digits and underscores")
+	}
+	if roleAttributes, err = parseRoleAttributes(roleAttributeList); err != nil {
+		panic(fmt.Sprintf("ROLE_ATTRIBUTES is invalid: %s", err))
+	}
+	for _, name := range strings.Split(extensionList, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowedExtensions[name] = true
+		}
+	}
+	if vaultAddr != "" {
+		if vault, err = newVaultClient(vaultAddr, vaultToken, vaultMount, vaultPath); err != nil {
+			panic(err.Error())
+		}
+	}
+	if v := os.Getenv("RESOURCE_RESPONSE_VERSION"); v != "" {
+		if resourceResponseVersion, err = strconv.Atoi(v); err != nil || resourceResponseVersion < resourceVersionLegacy || resourceResponseVersion > maxResourceVersion {
+			panic(fmt.Sprintf("RESOURCE_RESPONSE_VERSION must be between %d and %d", resourceVersionLegacy, maxResourceVersion))
+		}
+	}
+	if s := os.Getenv("QUEUE_URL"); s != "" {
+		if queueURL, err = parseQueueURL(s); err != nil {
+			panic(fmt.Sprintf("QUEUE_URL is invalid: %s", err))
+		}
+		if p, ok := queueURL.User.Password(); ok {
+			registerSecret(p)
+		} else if queueURL.User != nil {
+			registerSecret(queueURL.User.Username())
+		}
+	}
+	if queueSubject == "" {
+		queueSubject = "pg-external.requests"
+	}
+	if queueGroup == "" {
+		queueGroup = "pg-external"
+	}
+	if requesterHeader == "" {
+		requesterHeader = "X-Requester"
+	}
+	if allowedNets, err = parseCIDRs(apiAllowedCIDRs); err != nil {
+		panic(fmt.Sprintf("API_ALLOWED_CIDRS is invalid: %s", err))
+	}
+	if trustedProxies, err = parseCIDRs(apiTrustedProxies); err != nil {
+		panic(fmt.Sprintf("API_TRUSTED_PROXIES is invalid: %s", err))
+	}
+	if apiH2CCIDRs == "" {
+		apiH2CCIDRs = "127.0.0.0/8,::1"
+	}
+	if h2cNets, err = parseCIDRs(apiH2CCIDRs); err != nil {
+		panic(fmt.Sprintf("API_H2C_CIDRS is invalid: %s", err))
+	}
+	if oidcIssuer != "" {
+		if oidc, err = newOIDCVerifier(oidcIssuer, oidcAudience, oidcRoleClaim, oidcRoles, oidcTenantClaim); err != nil {
+			panic(err.Error())
+		}
+	}
+	if costPricing, err = parsePricing(); err != nil {
+		panic(err.Error())
+	}
+	if siemURL != "" {
+		if siem, err = newSIEMSink(siemURL, siemFormat); err != nil {
+			panic(fmt.Sprintf("SIEM_URL or SIEM_FORMAT is invalid: %s", err))
+		}
+	}
+}
+
+// durationEnv reads a duration such as "30s" from the named environment
+// variable, returning def if it isn't set.
+func durationEnv(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic(fmt.Sprintf("%s must be a valid duration: %s", name, err))
+	}
+	return d
+}
+
+// isSocket reports whether host refers to a Unix socket directory rather
+// than a network host, following libpq.
+func isSocket(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
+
+func (b *backend) connConfig(database string) pgx.ConnConfig {
+	host, port := b.addr()
+	portNum, _ := strconv.ParseUint(port, 10, 16)
+	conf := pgx.ConnConfig{
+		Host:     host,
+		Port:     uint16(portNum),
+		User:     serviceUser,
+		Password: servicePass,
+		Database: database,
+	}
+	conf.TLSConfig, conf.UseFallbackTLS = b.tlsConfig()
+	// pgx doesn't bracket IPv6 literals when building the dial address, and
+	// a discovered address may change after the pool is created, so dial the
+	// current address directly
+	if !isSocket(host) {
+		conf.Dial = func(network, _ string) (net.Conn, error) {
+			host, port := b.addr()
+			return (&net.Dialer{KeepAlive: 5 * time.Minute}).Dial(network, net.JoinHostPort(host, port))
+		}
+	}
+	return conf
+}
+
+// escapeCredential percent-encodes everything but unreserved characters.
+// url.UserPassword leaves sub-delimiters such as "+", "&" and "=" as they are,
+// which several client libraries fail to parse in the userinfo.
+func escapeCredential(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func (b *backend) databaseURL(username, password, database string) string {
+	u := &url.URL{
+		Scheme: "postgres",
+		Path:   "/" + database,
+	}
+	q := url.Values{}
+	host, port := b.appAddr()
+	if isSocket(host) {
+		q.Set("host", host)
+		if port != "5432" {
+			q.Set("port", port)
+		}
+	} else {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	// only pass on modes which enforce TLS, allow and prefer aren't
+	// understood by every client and prefer is libpq's default anyway
+	switch mode := b.appSSLMode(); mode {
+	case "require", "verify-ca", "verify-full":
+		q.Set("sslmode", mode)
+		if mode != "require" && resourceRootCert != "" {
+			q.Set("sslrootcert", resourceRootCert)
+		}
+	}
+	u.RawQuery = q.Encode()
+	userinfo := escapeCredential(username) + ":" + escapeCredential(password) + "@"
+	return strings.Replace(u.String(), "postgres://", "postgres://"+userinfo, 1)
+}
+
+// openBackends connects to the main backend and those of any other regions.
+func openBackends() (*backendSet, error) {
+	backend, err := newBackend(backendName, region, serviceHost, servicePort, backendDiscover)
+	if err != nil {
+		return nil, err
+	}
+	backends := newBackendSet(backend)
+	for _, r := range regionConfigs {
+		b, err := newBackend(r.Name, r.Region, r.Host, r.Port, r.Discover)
+		if err != nil {
+			return nil, err
+		}
+		backends.add(b)
+	}
+	return backends, nil
 }
 
 func main() {
 	defer shutdown.Exit()
 
-	// Don't use Wait wrapper, establish conn directly and wrap in DB
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig: pgx.ConnConfig{
-			Host:     serviceHost,
-			User:     serviceUser,
-			Password: servicePass,
-			Database: "postgres",
-			TLSConfig: &tls.Config{ServerName: serviceHost, InsecureSkipVerify: true},
-		},
-	})
+	loadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		if err := runGC(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			shutdown.Fatal(err)
+		}
+		return
+	}
+
+	backends, err := openBackends()
 	if err != nil {
 		shutdown.Fatal(err)
 	}
-	db := postgres.New(pgxpool, nil)
-	api := &pgAPI{db}
+	backend := backends.main
+	for _, b := range backends.all() {
+		go b.run(backendInterval)
+		go b.probe(probeInterval, probeMaxBackoff)
+		if b.discover != nil {
+			go b.watch(discoveryInterval)
+		}
+	}
+	db := backend.db
+	state, err := openState(backend)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+
+	thresholds, err := parseThresholds(quotaThresholds)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	jobs := newJobRunner(state, jobWorkers, jobBackendWorkers, jobQueueSize)
+
+	if siem != nil {
+		go siem.run()
+	}
+	if sentry != nil {
+		go sentry.run()
+	}
+
+	// an inspector leaves the monitors which change resources, or the
+	// state, to the instance managing them
+	if !readOnly {
+		if err := jobs.failInterrupted(); err != nil {
+			shutdown.Fatal(err)
+		}
+		// on SIGTERM, jobs running are given a chance to finish, and those
+		// which don't are checkpointed to be resumed
+		shutdown.BeforeExit(func() { jobs.drain(jobDrainTimeout) })
+
+		go pruneOperations(state, time.Hour)
+
+		if monitoringRole != "" {
+			for _, b := range backends.all() {
+				if err := grantMonitoring(b); err != nil {
+					logger.Error("error granting pg_monitor", "backend", b.name, "role", monitoringRole, "err", err)
+				}
+			}
+		}
+
+		health := &healthMonitor{state: state, backends: backends}
+		go checkConsistency(state, backends, health)
+		go health.run(healthInterval)
+
+		monitor := &quotaMonitor{backends: backends, state: state, thresholds: thresholds, enforce: quotaEnforce}
+		go monitor.run(quotaInterval)
+
+		// scheduled rotations would otherwise replace credentials nobody
+		// is told about
+		if err := checkCredentialDelivery(state); err != nil {
+			shutdown.Fatal(err)
+		}
+		rotations := &rotationMonitor{state: state, backends: backends}
+		go rotations.run(rotationInterval)
+
+		expiry := &expiryMonitor{state: state, backends: backends, warning: expiryWarning}
+		go expiry.run(expiryInterval)
+
+		capacity := &capacityMonitor{backends: backends}
+		go capacity.run(capacityInterval)
+
+		slots := &slotMonitor{state: state, backends: backends, warned: make(map[string]bool)}
+		go slots.run(slotInterval)
+
+		janitor := &provisionJanitor{state: state, backends: backends, timeout: provisionTimeout}
+		go janitor.run(janitorInterval)
+
+		if poolSize > 0 {
+			pool := &poolMonitor{backends: backends}
+			go pool.run(poolInterval)
+		}
+	}
+
+	slowLog := newSlowLog(backends.all(), slowQueryThreshold, slowQueryWebhook)
+	go slowLog.run(slowQueryInterval)
+
+	api := &pgAPI{db: db, state: state, backend: backend, backends: backends, slowLog: slowLog, jobs: jobs}
+	if canaryInterval > 0 && !readOnly {
+		api.canary = newCanary(api, canaryInterval)
+		go api.canary.run()
+	}
+	if !readOnly {
+		if err := api.resumeJobs(); err != nil {
+			shutdown.Fatal(err)
+		}
+		go (&scheduler{api: api}).run(maintenanceInterval)
+	}
 
 	router := httprouter.New()
-	router.POST("/databases", httphelper.WrapHandler(api.createDatabase))
-	router.DELETE("/databases", httphelper.WrapHandler(api.dropDatabase))
+	router.POST("/databases", httphelper.WrapHandler(authorize(permProvision, api.createDatabase)))
+	router.GET("/databases", httphelper.WrapHandler(authorize(permRead, api.listDatabases)))
+	router.DELETE("/databases", httphelper.WrapHandler(authorize(permDelete, api.dropDatabase)))
+	router.POST("/databases/:id/rotate", httphelper.WrapHandler(authorize(permProvision, api.rotateCredentials)))
+	router.POST("/databases/:id/rotate/confirm", httphelper.WrapHandler(authorize(permProvision, api.confirmRotation)))
+	router.PUT("/databases/:id/rotation-policy", httphelper.WrapHandler(authorize(permProvision, api.setRotationPolicy)))
+	router.DELETE("/databases/:id/rotation-policy", httphelper.WrapHandler(authorize(permDelete, api.deleteRotationPolicy)))
+	router.GET("/databases/:id/extensions", httphelper.WrapHandler(authorize(permRead, api.getDatabaseExtensions)))
+	router.POST("/databases/:id/extensions/:name/upgrade", httphelper.WrapHandler(authorize(permProvision, api.upgradeExtension)))
+	router.GET("/databases/:id/publications", httphelper.WrapHandler(authorize(permRead, api.getPublications)))
+	router.POST("/databases/:id/publications", httphelper.WrapHandler(authorize(permProvision, api.createPublication)))
+	router.DELETE("/databases/:id/publications/:name", httphelper.WrapHandler(authorize(permDelete, api.deletePublication)))
+	router.GET("/databases/:id/slots", httphelper.WrapHandler(authorize(permRead, api.getSlots)))
+	router.POST("/databases/:id/slots", httphelper.WrapHandler(authorize(permProvision, api.createSlot)))
+	router.DELETE("/databases/:id/slots/:name", httphelper.WrapHandler(authorize(permDelete, api.deleteSlot)))
+	router.GET("/databases/:id/snapshots", httphelper.WrapHandler(authorize(permRead, api.getSnapshots)))
+	router.POST("/databases/:id/snapshots", httphelper.WrapHandler(authorize(permProvision, api.createSnapshot)))
+	router.DELETE("/databases/:id/snapshots/:name", httphelper.WrapHandler(authorize(permDelete, api.deleteSnapshot)))
+	router.POST("/databases/:id/snapshots/:name/restore", httphelper.WrapHandler(authorize(permProvision, api.restoreSnapshot)))
+	router.DELETE("/databases/:id/credentials/:name", httphelper.WrapHandler(authorize(permDelete, api.revokeCredential)))
+	router.POST("/databases/:id/migrate", httphelper.WrapHandler(authorize(permAdmin, api.migrateDatabase)))
+	router.POST("/databases/:id/pause", httphelper.WrapHandler(authorize(permDelete, api.pauseDatabase)))
+	router.POST("/databases/:id/resume", httphelper.WrapHandler(authorize(permProvision, api.resumeDatabase)))
+	router.POST("/databases/:id/renew", httphelper.WrapHandler(authorize(permProvision, api.renewDatabase)))
+	router.POST("/review-apps", httphelper.WrapHandler(authorize(permProvision, api.forkReviewApp)))
+	router.DELETE("/review-apps", httphelper.WrapHandler(authorize(permDelete, api.destroyReviewApps)))
+	router.GET("/databases/:id", httphelper.WrapHandler(authorize(permRead, api.getDatabase)))
+	router.GET("/databases/:id/cost", httphelper.WrapHandler(authorize(permRead, api.getCost)))
+	router.GET("/databases/:id/connections", httphelper.WrapHandler(authorize(permRead, api.getConnections)))
+	router.POST("/databases/:id/connections/:pid/terminate", httphelper.WrapHandler(authorize(permDelete, api.terminateConnections)))
+	router.GET("/databases/:id/queries", httphelper.WrapHandler(authorize(permRead, api.getQueries)))
+	router.GET("/databases/:id/slow-queries", httphelper.WrapHandler(authorize(permRead, api.getSlowQueries)))
+	router.GET("/databases/:id/connection-errors", httphelper.WrapHandler(authorize(permRead, api.getConnectionErrors)))
+	router.GET("/costs", httphelper.WrapHandler(authorize(permRead, api.getCostReport)))
+	router.GET("/databases/:id/maintenance-window", httphelper.WrapHandler(authorize(permRead, api.getMaintenanceWindow)))
+	router.PUT("/databases/:id/maintenance-window", httphelper.WrapHandler(authorize(permDelete, api.setMaintenanceWindow)))
+	router.DELETE("/databases/:id/maintenance-window", httphelper.WrapHandler(authorize(permDelete, api.deleteMaintenanceWindow)))
+	router.GET("/databases/:id/scheduled", httphelper.WrapHandler(authorize(permRead, api.listScheduled)))
+	router.GET("/scheduled", httphelper.WrapHandler(authorize(permRead, api.listScheduled)))
+	router.GET("/scheduled/:id", httphelper.WrapHandler(authorize(permRead, api.getScheduled)))
+	router.DELETE("/scheduled/:id", httphelper.WrapHandler(authorize(permDelete, api.cancelScheduled)))
+	router.GET("/tenants/:id/maintenance-window", httphelper.WrapHandler(authorize(permRead, api.getTenantMaintenanceWindow)))
+	router.PUT("/tenants/:id/maintenance-window", httphelper.WrapHandler(authorize(permAdmin, api.setTenantMaintenanceWindow)))
+	router.DELETE("/tenants/:id/maintenance-window", httphelper.WrapHandler(authorize(permAdmin, api.deleteTenantMaintenanceWindow)))
+	router.GET("/tenants/:id/quota", httphelper.WrapHandler(authorize(permRead, api.getTenantQuota)))
+	router.PUT("/tenants/:id/quota", httphelper.WrapHandler(authorize(permAdmin, api.setTenantQuota)))
+	router.GET("/jobs", httphelper.WrapHandler(authorize(permRead, api.listJobs)))
+	router.GET("/jobs/:id", httphelper.WrapHandler(authorize(permRead, api.getJob)))
+	router.GET("/jobs/:id/logs", httphelper.WrapHandler(authorize(permRead, api.getJobLogs)))
+	router.GET("/jobs/:id/events", httphelper.WrapHandler(authorize(permRead, api.streamJobEvents)))
+	router.POST("/jobs/:id/cancel", httphelper.WrapHandler(authorize(permDelete, api.cancelJob)))
+	router.GET("/admin/dashboard", httphelper.WrapHandler(authorize(permAdmin, api.getDashboard)))
+	router.GET("/admin/audit", httphelper.WrapHandler(authorize(permAdmin, api.getAuditEvents)))
+	router.GET("/admin/slo", httphelper.WrapHandler(authorize(permAdmin, api.getSLO)))
+	router.POST("/admin/selftest", httphelper.WrapHandler(authorize(permAdmin, api.selfTest)))
+	router.GET("/admin/api-keys", httphelper.WrapHandler(authorize(permAdmin, api.listAPIKeys)))
+	router.POST("/admin/api-keys", httphelper.WrapHandler(authorize(permAdmin, api.createAPIKey)))
+	router.DELETE("/admin/api-keys/:id", httphelper.WrapHandler(authorize(permAdmin, api.revokeAPIKey)))
+	router.GET("/server", httphelper.WrapHandler(authorize(permRead, api.getServer)))
+	router.GET("/server/extensions", httphelper.WrapHandler(authorize(permRead, api.getExtensions)))
+	router.GET("/archives", httphelper.WrapHandler(authorize(permAdmin, api.getArchives)))
+	router.DELETE("/archives/:name", httphelper.WrapHandler(authorize(permAdmin, api.deleteArchive)))
+	router.GET("/export", httphelper.WrapHandler(authorize(permAdmin, api.exportInventory)))
+	router.GET("/export/terraform", httphelper.WrapHandler(authorize(permAdmin, api.exportTerraform)))
 	router.GET("/ping", httphelper.WrapHandler(api.ping))
+	router.GET("/readyz", httphelper.WrapHandler(api.readyz))
+	router.GET("/metrics", httphelper.WrapHandler(authorize(permAdmin, api.metrics)))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+	// queued requests come from whoever may publish to the subject, so they
+	// skip API authentication and the allow list
+	if queueURL != nil && !readOnly {
+		go newQueueConsumer(queueURL, queueSubject, queueGroup, router).run()
 	}
-	addr := ":" + port
 
-	handler := httphelper.ContextInjector("pg-external", httphelper.NewRequestLogger(router))
-	shutdown.Fatal(http.ListenAndServe(addr, handler))
+	listeners, err := listen()
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	var handler http.Handler = router
+	if apiAdminKey != "" || oidc != nil {
+		handler = authHandler(state, handler)
+	}
+	if readOnly {
+		handler = readOnlyHandler(handler)
+	}
+	if len(allowedNets) > 0 {
+		handler = allowListHandler(handler)
+	}
+	if apiH2C {
+		handler = h2cHandler(handler)
+	}
+	srv := newServer(httphelper.ContextInjector("pg-external", httphelper.NewRequestLogger(recoverPanics(handler))))
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { errs <- serve(srv, l) }(l)
+	}
+	shutdown.Fatal(<-errs)
 }
 
 type pgAPI struct {
-	db *postgres.DB
+	db       *postgres.DB
+	state    *postgres.DB
+	backend  *backend
+	backends *backendSet
+	slowLog  *slowLog
+	jobs     *jobRunner
+	canary   *canary
+}
+
+// resourceResponse extends the Flynn resource with metadata, which is only
+// returned to clients asking for it, see negotiateResource.
+type resourceResponse struct {
+	resource.Resource
+	Meta *resourceMeta `json:"meta"`
+
+	// the credentials issued, as given in Env
+	username, password, database string
+}
+
+type resourceMeta struct {
+	UUID          string     `json:"uuid"`
+	Backend       string     `json:"backend"`
+	Region        string     `json:"region"`
+	ServerVersion string     `json:"server_version"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Tags          []string   `json:"tags"`
+	Status        string     `json:"status"`
+	CreatedBy     string     `json:"created_by,omitempty"`
+}
+
+type provisionRequest struct {
+	Quota   string   `json:"quota"`
+	App     string   `json:"app"`
+	Env     string   `json:"env"`
+	Region  string   `json:"region"`
+	TTL     string   `json:"ttl"`
+	Tags    []string `json:"tags"`
+	Comment string   `json:"comment"`
+	Tenancy bool     `json:"tenancy"`
+	Schema  *string  `json:"schema"`
+	// Password is used for the owner's role instead of a generated one.
+	Password   string             `json:"password"`
+	Settings   map[string]string  `json:"settings"`
+	Extensions []extensionRequest `json:"extensions"`
+	// Tenant owns the resource, counting it against the tenant's quota.
+	Tenant string `json:"tenant"`
 }
 
 func (p *pgAPI) createDatabase(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	username, password, database := random.Hex(16), random.Hex(16), random.Hex(16)
+	version, ok := negotiateResource(w, req)
+	if !ok {
+		return
+	}
+	var config provisionRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil && err != io.EOF {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.Quota == "" {
+		config.Quota = defaultQuota
+	}
+	var quota *int64
+	if config.Quota != "" {
+		n, err := parseSize(config.Quota)
+		if err != nil {
+			httphelper.ValidationError(w, "quota", "is invalid")
+			return
+		}
+		quota = &n
+	}
+	var ttl *float64
+	if config.TTL != "" {
+		d, err := parseTTL(config.TTL)
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		secs := d.Seconds()
+		ttl = &secs
+	}
 
-	if err := p.db.Exec(fmt.Sprintf(`CREATE USER "%s" WITH PASSWORD '%s'`, username, password)); err != nil {
+	if err := validateTags(config.Tags); err != nil {
 		httphelper.Error(w, err)
 		return
 	}
-	if err := p.db.Exec(fmt.Sprintf(`GRANT "%s" TO "%s"`, username, serviceUser)); err != nil {
-		p.db.Exec(fmt.Sprintf(`DROP USER "%s"`, username))
+
+	if config.App == "" {
+		config.App = req.Header.Get("X-Flynn-App")
+	}
+	if config.Env == "" {
+		config.Env = req.Header.Get("X-Flynn-Env")
+	}
+	if err := validateSettings(config.Settings); err != nil {
 		httphelper.Error(w, err)
 		return
 	}
-	if err := p.db.Exec(fmt.Sprintf(`CREATE DATABASE "%s" WITH OWNER = "%s"`, database, username)); err != nil {
-		p.db.Exec(fmt.Sprintf(`DROP USER "%s"`, username))
+	if config.Password != "" {
+		if err := validatePassword(config.Password); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+	if err := validateExtensions(config.Extensions); err != nil {
 		httphelper.Error(w, err)
 		return
 	}
 
-	url := fmt.Sprintf("postgres://%s:%s@%s:5432/%s", username, password, serviceHost, database)
-	httphelper.JSON(w, 200, resource.Resource{
-		ID: fmt.Sprintf("/databases/%s:%s", username, database),
-		Env: map[string]string{
-			"FLYNN_POSTGRES": systemPgsql,
-			"PGHOST":         serviceHost,
-			"PGUSER":         username,
-			"PGPASSWORD":     password,
-			"PGDATABASE":     database,
-			"DATABASE_URL":   url,
-		},
+	schema := appSchema
+	if config.Schema != nil {
+		// an empty schema opts out of APP_SCHEMA
+		if schema = *config.Schema; schema != "" {
+			if err := validateName("schema", schema); err != nil {
+				httphelper.Error(w, err)
+				return
+			}
+			if schema == "public" || schema == "tenancy" {
+				httphelper.ValidationError(w, "schema", "is reserved")
+				return
+			}
+		}
+	}
+
+	if config.Region == "" {
+		config.Region = defaultRegion
+	}
+	b, ok := p.backends.lookupRegion(w, config.Region)
+	if !ok {
+		return
+	}
+	if err := b.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if !checkCapacity(w, b) {
+		return
+	}
+	// tenant scoped API keys can only provision for their own tenant
+	if t := callerTenant(ctx); t != "" {
+		if config.Tenant != "" && config.Tenant != t {
+			httphelper.JSON(w, 403, httphelper.JSONError{Code: forbiddenCode, Message: "the API key can only provision databases for tenant " + t})
+			return
+		}
+		config.Tenant = t
+	}
+	if config.Tenant != "" {
+		if !validTenant.MatchString(config.Tenant) {
+			httphelper.ValidationError(w, "tenant", "must be lowercase letters, digits, dashes and underscores")
+			return
+		}
+		if err := p.checkTenantSize(config.Tenant); err != nil {
+			provisionError(w, err)
+			return
+		}
+	}
+
+	res, err := p.provision(b, &provisionSpec{
+		App:        config.App,
+		Env:        config.Env,
+		Quota:      quota,
+		TTL:        ttl,
+		Tags:       config.Tags,
+		Comment:    config.Comment,
+		Tenancy:    config.Tenancy,
+		Schema:     schema,
+		Password:   config.Password,
+		Settings:   config.Settings,
+		Extensions: config.Extensions,
+		Tenant:     config.Tenant,
+		Requester:  requester(ctx, req),
 	})
+	if err != nil {
+		provisionError(w, err)
+		return
+	}
+	writeResource(w, version, res)
+}
+
+// provisionSpec describes a resource to create.
+type provisionSpec struct {
+	App     string
+	Env     string
+	Quota   *int64
+	TTL     *float64
+	Tags    []string
+	Comment string
+
+	// Template is copied to create the database, and Parent is the ID of
+	// the resource it belongs to.
+	Template string
+	Parent   string
+	// Scrub is run in the new database as its owner before it is handed
+	// out, to remove sensitive data copied from Template.
+	Scrub []string
+	// Tenancy sets up the row level security scaffold and a tenant scoped
+	// role for the app.
+	Tenancy bool
+	// Schema is created for the app's objects and made the search_path.
+	Schema string
+	// Settings are parameter defaults for the database.
+	Settings map[string]string
+	// Password is the caller's choice of password for the owner's role.
+	Password string
+	// Extensions are installed in the database.
+	Extensions []extensionRequest
+	// Tenant owns the resource, and must be within its quota of databases.
+	Tenant string
+	// Requester is who asked for the resource, see requester.
+	Requester string
+}
+
+// provision creates a role and database on b and records them in the state
+// database, returning the resource for the controller.
+func (p *pgAPI) provision(b *backend, spec *provisionSpec) (_ *resourceResponse, err error) {
+	start := time.Now()
+	username, database, err := generateNames(b, spec.App, spec.Env)
+	if err != nil {
+		return nil, err
+	}
+	password := spec.Password
+	if password == "" {
+		password = random.Hex(16)
+	}
+	if err := validateName("username", username); err != nil {
+		return nil, err
+	}
+	if err := validateName("database", database); err != nil {
+		return nil, err
+	}
+
+	meta := &resourceMeta{
+		UUID:          random.UUID(),
+		Backend:       b.name,
+		Region:        b.region,
+		ServerVersion: b.get().Version,
+		Tags:          spec.Tags,
+		Status:        statusProvisioning,
+		CreatedBy:     spec.Requester,
+	}
+	if meta.Tags == nil {
+		meta.Tags = []string{}
+	}
+	var parent, tenant *string
+	if spec.Parent != "" {
+		parent = &spec.Parent
+	}
+	if spec.Tenant != "" {
+		tenant = &spec.Tenant
+	}
+	// record the resource first so that it is visible while provisioning,
+	// and remains visible as failed if provisioning doesn't complete, along
+	// with an intent for the janitor in case the provision dies mid-flight
+	tx, err := p.state.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if maxManagedDatabases > 0 {
+		// concurrent provisions on the backend wait for each other here, so
+		// they can't exceed the limit together
+		if err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('provision ' || $1))`, b.region); err != nil {
+			return nil, err
+		}
+		n, err := managedDatabases(tx, p.backends.main.region, b.region)
+		if err != nil {
+			return nil, err
+		}
+		if n >= maxManagedDatabases {
+			return nil, httphelper.JSONError{
+				Code:    httphelper.ServiceUnavailableErrorCode,
+				Message: fmt.Sprintf("backend %s has reached the limit of %d databases, provision in another region", b.name, maxManagedDatabases),
+			}
+		}
+	}
+	if tenant != nil {
+		if err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('tenant ' || $1))`, spec.Tenant); err != nil {
+			return nil, err
+		}
+		t, err := loadTenantQuota(tx, spec.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		if t.MaxDatabases > 0 && t.Databases >= t.MaxDatabases {
+			return nil, errTenantQuota(t, "has reached its quota of databases")
+		}
+	}
+	if err := tx.QueryRow(`INSERT INTO resources (uuid, database, username, quota_bytes, region, expires_at, ttl_seconds, tags, parent, app, env, comment, status, tenant, created_by) VALUES ($1, $2, $3, $4, $5, now() + make_interval(secs => $6), $6, $7, $8, $9, $10, $11, $12, $13, nullif($14, '')) RETURNING created_at, expires_at`,
+		meta.UUID, database, username, spec.Quota, b.region, spec.TTL, meta.Tags, parent, spec.App, spec.Env, spec.Comment, meta.Status, tenant, spec.Requester).Scan(&meta.CreatedAt, &meta.ExpiresAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Exec(`INSERT INTO provision_intents (resource) VALUES ($1)`, meta.UUID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	defer func() { recordOperation(p.state, "provision", start, err) }()
+	// failed is used until the role exists, since nothing has been created
+	// on the backend, and rollback once it may have been
+	failed := func(err error) (*resourceResponse, error) {
+		setStatus(p.state, meta.UUID, statusFailed, err.Error())
+		clearIntent(p.state, meta.UUID)
+		return nil, err
+	}
+	rollback := func(err error) (*resourceResponse, error) {
+		setStatus(p.state, meta.UUID, statusFailed, err.Error())
+		rollbackProvision(p.state, &resourceRef{UUID: meta.UUID, Username: username, Database: database, Backend: b})
+		return nil, err
+	}
+
+	// copies can't come from the pool, which only holds blank databases
+	var claimed bool
+	if spec.Template == "" {
+		if claimed, err = claimPooled(b, username, database, password, meta.ExpiresAt); err != nil {
+			return failed(err)
+		}
+	}
+	if !claimed {
+		if err := createLoginRole(b, username, password, meta.ExpiresAt, ""); err != nil {
+			return failed(err)
+		}
+		// CREATE DATABASE can't run in a transaction, so the role is
+		// rolled back if it fails
+		create := fmt.Sprintf(`CREATE DATABASE "%s" WITH OWNER = "%s"`, database, username)
+		if spec.Template != "" {
+			create += fmt.Sprintf(` TEMPLATE = "%s"`, spec.Template)
+		}
+		if err := b.db.Exec(create); err != nil {
+			return rollback(err)
+		}
+	}
+	if spec.Template != "" {
+		if err := prepareCopy(b, database, username, password, spec.Scrub); err != nil {
+			return rollback(err)
+		}
+	}
+	if err := revokePublic(b, database); err != nil {
+		return rollback(err)
+	}
+	if monitoringRole != "" {
+		if err := grantMonitoringAccess(b, database); err != nil {
+			return rollback(err)
+		}
+	}
+	if accessRoles || spec.Tenancy {
+		if err := createAccessRoles(b, database, username); err != nil {
+			return rollback(err)
+		}
+	}
+	if err := applySettings(b, database, spec.Settings); err != nil {
+		return rollback(err)
+	}
+	if spec.Schema != "" {
+		if err := createAppSchema(b, database, username, spec.Schema); err != nil {
+			return rollback(err)
+		}
+	}
+	if err := createExtensions(p.state, b, meta.UUID, database, spec.Extensions); err != nil {
+		return rollback(err)
+	}
+	env := rawResourceEnv(b, username, password, database)
+	if readonlyCredentials {
+		roPassword := random.Hex(16)
+		if err := createReadonlyUser(b, database, roPassword, meta.ExpiresAt); err != nil {
+			return rollback(err)
+		}
+		env["DATABASE_RO_URL"] = b.databaseURL(readonlyUsername(database), roPassword, database)
+	}
+	if spec.Tenancy {
+		appPassword := random.Hex(16)
+		if err := createTenancy(b, database, username, appPassword, meta.ExpiresAt); err != nil {
+			return rollback(err)
+		}
+		env["DATABASE_APP_URL"] = b.databaseURL(tenantUsername(database), appPassword, database)
+	}
+	meta.Status = statusReady
+	if err := completeProvision(p.state, meta.UUID); err != nil {
+		return nil, err
+	}
+
+	return &resourceResponse{
+		Resource: resource.Resource{
+			ID:  resourceID(meta.UUID),
+			Env: renameEnv(env),
+		},
+		Meta:     meta,
+		username: username,
+		password: password,
+		database: database,
+	}, nil
+}
+
+// revokePublic stops roles other than the owner from connecting to a new
+// database or creating objects in its public schema, both of which PUBLIC
+// may do by default, since the backend is shared by many tenants.
+func revokePublic(b *backend, database string) error {
+	if err := b.db.Exec(fmt.Sprintf(`REVOKE ALL ON DATABASE "%s" FROM PUBLIC`, database)); err != nil {
+		return err
+	}
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`REVOKE CREATE ON SCHEMA public FROM PUBLIC`)
+	return err
+}
+
+// resourceEnv returns the env given to apps to connect to database on b.
+func resourceEnv(b *backend, username, password, database string) map[string]string {
+	return renameEnv(rawResourceEnv(b, username, password, database))
+}
+
+// rawResourceEnv returns the env for database on b before ENV_NAMES is
+// applied.
+func rawResourceEnv(b *backend, username, password, database string) map[string]string {
+	host, port := b.appAddr()
+	env := map[string]string{
+		"FLYNN_POSTGRES": systemPgsql,
+		"PGHOST":         host,
+		"PGPORT":         port,
+		"PGSSLMODE":      b.appSSLMode(),
+		"PGUSER":         username,
+		"PGPASSWORD":     password,
+		"PGDATABASE":     database,
+		"DATABASE_URL":   b.databaseURL(username, password, database),
+	}
+	if resourceRootCert != "" {
+		env["PGSSLROOTCERT"] = resourceRootCert
+	}
+	if rootCertPEM != nil {
+		env["PGSSLROOTCERT_PEM"] = string(rootCertPEM)
+	}
+	addConnectionFormats(b, env, username, password, database)
+	return env
 }
 
 func (p *pgAPI) dropDatabase(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	id := strings.SplitN(strings.TrimPrefix(req.FormValue("id"), "/databases/"), ":", 2)
-	if len(id) != 2 || id[1] == "" {
-		httphelper.ValidationError(w, "id", "is invalid")
+	id := req.FormValue("id")
+	if id == "" {
+		p.bulkDelete(ctx, w, req)
 		return
 	}
-
-	// disable new connections to the target database
-	if err := p.db.Exec(disallowConns, id[1]); err != nil {
+	r, err := p.resolveID(ctx, id)
+	if err != nil {
 		httphelper.Error(w, err)
 		return
 	}
-
-	// terminate current connections
-	if err := p.db.Exec(disconnectConns, id[1]); err != nil {
+	// with ?archive=true, or ARCHIVE_ON_DEPROVISION unless ?archive=false,
+	// the database is archived for ?retain= rather than dropped
+	archive, retain := archiveOnDeprovision, archiveRetention
+	if s := req.FormValue("archive"); s != "" {
+		var err error
+		if archive, err = strconv.ParseBool(s); err != nil {
+			httphelper.ValidationError(w, "archive", "must be true or false")
+			return
+		}
+	}
+	if s := req.FormValue("retain"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			httphelper.ValidationError(w, "retain", "must be a positive duration, e.g. 2160h")
+			return
+		}
+		retain = d
+	}
+	source := requestOrigin(ctx, req)
+	op, err := p.schedule(r, "deprovision", source, &scheduledDrop{Archive: archive, Retain: retain.String()}, req)
+	if err != nil {
 		httphelper.Error(w, err)
 		return
+	} else if op != nil {
+		acceptScheduled(w, op, op)
+		return
 	}
-
-	if err := p.db.Exec(fmt.Sprintf(`DROP DATABASE "%s"`, id[1])); err != nil {
+	drop := dropFunc(p.state, r, source, archive, retain)
+	// a drop may outlast the client's timeout, so with ?async=true it runs
+	// as a job. Either way, a request for a resource already being dropped
+	// by a job returns that job rather than racing with it.
+	async, _ := strconv.ParseBool(req.FormValue("async"))
+	if async {
+		j, _, err := p.startOperation("deprovision", r, source, &scheduledDrop{Archive: archive, Retain: retain.String()})
+		if err != nil {
+			jobError(w, err)
+			return
+		}
+		acceptJob(w, j)
+		return
+	}
+	j, err := p.jobs.running("deprovision", r.id())
+	if err == nil {
+		acceptJob(w, j)
+		return
+	} else if err != pgx.ErrNoRows {
 		httphelper.Error(w, err)
 		return
 	}
-
-	if err := p.db.Exec(fmt.Sprintf(`DROP USER "%s"`, id[0])); err != nil {
+	if err := drop(nil); err != nil {
 		httphelper.Error(w, err)
 		return
 	}
-
 	w.WriteHeader(200)
 }
 
+// dropFunc returns the function which deprovisions or archives r, for
+// running directly or as a job.
+func dropFunc(state *postgres.DB, r *resourceRef, source origin, archive bool, retain time.Duration) func(*jobRun) error {
+	return func(run *jobRun) error {
+		if archive {
+			err := archiveResource(state, r, retain, source.Requester, run)
+			audit(source, securityDestructive, "archive", r.id(), err)
+			if err == nil {
+				notify("resource.archived", map[string]interface{}{
+					"id":        r.id(),
+					"database":  r.Database,
+					"requester": source.Requester,
+				})
+			}
+			return err
+		}
+		err := deprovision(state, r, run)
+		deprovisioned(source, r, err)
+		return err
+	}
+}
+
+// deprovision drops a resource's database and role and removes it from the
+// state database. The resource is marked as deleting meanwhile, and as failed
+// if it couldn't be dropped. Progress is logged to run when it's done as a job.
+func deprovision(state *postgres.DB, r *resourceRef, run *jobRun) (err error) {
+	start := time.Now()
+	defer func() { recordOperation(state, "deprovision", start, err) }()
+	if r.UUID != "" {
+		if err := setStatus(state, r.UUID, statusDeleting, ""); err != nil {
+			return err
+		}
+	}
+	if err := dropResource(state, r, run); err != nil {
+		if r.UUID != "" {
+			setStatus(state, r.UUID, statusFailed, err.Error())
+		}
+		return err
+	}
+	if err := state.Exec(`DELETE FROM resources WHERE database = $1`, r.Database); err != nil {
+		return err
+	}
+	run.stage("state_removed", "removed %s from the state database", r.id())
+	return nil
+}
+
+// deprovisioned audits a deprovision requested through the API, and
+// announces the deletion if it succeeded.
+func deprovisioned(source origin, r *resourceRef, err error) {
+	audit(source, securityDestructive, "deprovision", r.id(), err)
+	if err == nil {
+		notify("resource.deleted", map[string]interface{}{
+			"id":        r.id(),
+			"database":  r.Database,
+			"requester": source.Requester,
+		})
+	}
+}
+
+// dropResource drops a resource's database and roles, tolerating those
+// already dropped by an earlier attempt or never created.
+func dropResource(state *postgres.DB, r *resourceRef, run *jobRun) error {
+	username, database := r.Username, r.Database
+
+	if err := r.Backend.checkPrimary(); err != nil {
+		return err
+	}
+
+	// PostgreSQL 13 and later terminate connections as part of the drop,
+	// older versions need new connections disallowed and current ones
+	// terminated beforehand
+	caps := r.Backend.get()
+	force := caps != nil && caps.DropForce
+	if !force {
+		err := r.Backend.db.Exec(fmt.Sprintf(`ALTER DATABASE "%s" ALLOW_CONNECTIONS false`, database))
+		// invalid_catalog_name if it was already dropped
+		if err != nil && !postgres.IsPostgresCode(err, "3D000") {
+			return err
+		}
+		if err := r.Backend.db.Exec(disconnectConns, database); err != nil {
+			return err
+		}
+		run.stage("connections_terminated", "terminated connections to database %s", database)
+	}
+
+	// slots block dropping their database
+	if err := dropDatabaseSlots(r.Backend, database); err != nil {
+		return err
+	}
+	if err := dropBackendDatabase(r.Backend, database, force); err != nil {
+		return err
+	}
+	if force {
+		run.stage("connections_terminated", "terminated connections to database %s", database)
+	}
+	run.stage("database_dropped", "dropped database %s on backend %s", database, r.Backend.name)
+
+	if err := dropSnapshots(state, r); err != nil {
+		return err
+	}
+
+	if err := dropAccessRoles(r.Backend, database); err != nil {
+		return err
+	}
+	if err := dropPublicationRoles(state, r); err != nil {
+		return err
+	}
+
+	if err := r.Backend.db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, username)); err != nil {
+		return err
+	}
+	run.stage("role_dropped", "dropped role %s", username)
+
+	// drop the new role of an unfinished credential rotation
+	var rotated string
+	if err := state.QueryRow(`SELECT new_username FROM rotations WHERE resource = $1`, r.UUID).Scan(&rotated); err == nil {
+		if err := r.Backend.db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, rotated)); err != nil {
+			return err
+		}
+	} else if err != pgx.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// dropBackendDatabase drops a database whose connections have been
+// terminated, or with force those it still has, terminating again any which
+// reappear (e.g. from a connection pool reconnecting) until it succeeds or
+// runs out of attempts.
+func dropBackendDatabase(b *backend, database string, force bool) error {
+	conn, err := b.db.Acquire()
+	if err != nil {
+		return err
+	}
+	defer b.db.Release(conn)
+	if _, err := conn.Exec(fmt.Sprintf("SET lock_timeout = '%s'", dropLockTimeout)); err != nil {
+		return err
+	}
+	defer conn.Exec("RESET lock_timeout")
+
+	drop := fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, database)
+	if force {
+		drop += " WITH (FORCE)"
+	}
+	for attempt := 1; ; attempt++ {
+		_, err = conn.Exec(drop)
+		// object_in_use or lock_not_available
+		if err == nil || !postgres.IsPostgresCode(err, "55006") && !postgres.IsPostgresCode(err, "55P03") {
+			return err
+		}
+		if attempt == dropAttempts {
+			break
+		}
+		logger.Warn("database still in use, retrying drop", "database", database, "attempt", attempt, "err", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+		if _, err := conn.Exec(disconnectConns, database); err != nil {
+			return err
+		}
+	}
+
+	var pids []string
+	rows, err := conn.Query(connectedPids, database)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var pid int32
+		if err := rows.Scan(&pid); err != nil {
+			rows.Close()
+			return err
+		}
+		pids = append(pids, strconv.Itoa(int(pid)))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("database %s is still in use", database)
+	if len(pids) > 0 {
+		msg += " by pids " + strings.Join(pids, ",")
+	}
+	return httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: msg, Retry: true}
+}
+
 func (p *pgAPI) ping(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	if err := p.db.Exec("SELECT 1"); err != nil {
 		httphelper.Error(w, err)
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx"
+)
+
+// credentials with characters which have a meaning in URLs or are escaped
+// differently in paths and query strings
+var urlCredentials = []string{
+	"plain", "a+b", "a&b", "a=b", "a@b", "a:b", "a/b", "a?b", "a#b", "a%b", "a b", "a'b", "a%20b", `a\b`,
+	"+&=@:/?#% '",
+}
+
+var urlAddrs = []struct {
+	host, port string
+}{
+	{"db.example.com", "5432"},
+	{"2001:db8::1", "5432"},
+	{"/var/run/postgresql", "5432"},
+	{"/tmp", "6432"},
+}
+
+// TestDatabaseURLRoundTrips checks that the credentials, address and
+// database in DATABASE_URL come back out of Go's url.Parse, pgx and lib/pq.
+// lib/pq isn't vendored, so its parsing is reproduced by pqParseURL. psql
+// and other libpq clients aren't covered.
+func TestDatabaseURLRoundTrips(t *testing.T) {
+	for _, addr := range urlAddrs {
+		b := &backend{host: addr.host, port: addr.port}
+		for _, username := range urlCredentials {
+			for _, password := range urlCredentials {
+				s := b.databaseURL(username, password, "db")
+				checkURLParse(t, s, addr.host, addr.port, username, password)
+				checkPgx(t, s, addr.host, addr.port, username, password)
+				checkPq(t, s, addr.host, addr.port, username, password)
+			}
+		}
+	}
+}
+
+func checkURLParse(t *testing.T, s, host, port, username, password string) {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Errorf("url.Parse(%s): %s", s, err)
+		return
+	}
+	if got := u.User.Username(); got != username {
+		t.Errorf("url.Parse(%s): got username %q, want %q", s, got, username)
+	}
+	if got, _ := u.User.Password(); got != password {
+		t.Errorf("url.Parse(%s): got password %q, want %q", s, got, password)
+	}
+	gotHost, gotPort := u.Hostname(), u.Port()
+	if isSocket(host) {
+		gotHost, gotPort = u.Query().Get("host"), u.Query().Get("port")
+		if gotPort == "" {
+			gotPort = "5432"
+		}
+	}
+	if gotHost != host || gotPort != port || u.Path != "/db" {
+		t.Errorf("url.Parse(%s): got %s port %s database %s", s, gotHost, gotPort, u.Path)
+	}
+}
+
+// checkPgx checks the URL with the vendored pgx, which splits the URL's
+// host at the first colon and ignores the host query parameter. IPv6
+// addresses are skipped, as it can't parse them, and only the credentials
+// and database are checked for Unix sockets.
+func checkPgx(t *testing.T, s, host, port, username, password string) {
+	if strings.Contains(host, ":") {
+		return
+	}
+	c, err := pgx.ParseURI(s)
+	if err != nil {
+		t.Errorf("pgx.ParseURI(%s): %s", s, err)
+		return
+	}
+	if c.User != username || c.Password != password || c.Database != "db" {
+		t.Errorf("pgx.ParseURI(%s): got %q/%q database %s, want %q/%q", s, c.User, c.Password, c.Database, username, password)
+	}
+	if !isSocket(host) && (c.Host != host || fmt.Sprint(c.Port) != port) {
+		t.Errorf("pgx.ParseURI(%s): got %s:%d", s, c.Host, c.Port)
+	}
+}
+
+func checkPq(t *testing.T, s, host, port, username, password string) {
+	conninfo, err := pqParseURL(s)
+	if err != nil {
+		t.Errorf("pqParseURL(%s): %s", s, err)
+		return
+	}
+	params, err := parseConninfo(conninfo)
+	if err != nil {
+		t.Errorf("parseConninfo(%s): %s", conninfo, err)
+		return
+	}
+	if params["port"] == "" {
+		params["port"] = "5432"
+	}
+	want := map[string]string{"user": username, "password": password, "host": host, "port": port, "dbname": "db"}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("lib/pq %s: got %s %q, want %q", s, k, params[k], v)
+		}
+	}
+}
+
+// pqParseURL converts a URL to a connection string as lib/pq's ParseURL
+// does, before lib/pq parses the connection string itself.
+func pqParseURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return "", fmt.Errorf("invalid connection protocol: %s", u.Scheme)
+	}
+	var kvs []string
+	accrue := func(k, v string) {
+		if v != "" {
+			kvs = append(kvs, k+"="+conninfoValue(v))
+		}
+	}
+	if u.User != nil {
+		accrue("user", u.User.Username())
+		password, _ := u.User.Password()
+		accrue("password", password)
+	}
+	if host, port, err := net.SplitHostPort(u.Host); err != nil {
+		accrue("host", u.Host)
+	} else {
+		accrue("host", host)
+		accrue("port", port)
+	}
+	if u.Path != "" {
+		accrue("dbname", u.Path[1:])
+	}
+	for k, v := range u.Query() {
+		accrue(k, v[0])
+	}
+	return strings.Join(kvs, " "), nil
+}
+
+// parseConninfo parses a libpq style connection string of key=value pairs,
+// where values may be single quoted with backslash escapes.
+func parseConninfo(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("missing = after %q", s)
+		}
+		key := strings.TrimSpace(s[:i])
+		s = strings.TrimLeft(s[i+1:], " ")
+		var value []byte
+		if strings.HasPrefix(s, "'") {
+			s = s[1:]
+			for {
+				if s == "" {
+					return nil, fmt.Errorf("unterminated quoted value for %s", key)
+				}
+				c := s[0]
+				s = s[1:]
+				if c == '\'' {
+					break
+				}
+				if c == '\\' && s != "" {
+					c, s = s[0], s[1:]
+				}
+				value = append(value, c)
+			}
+		} else {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = []byte(s[:end]), s[end:]
+		}
+		params[key] = string(value)
+	}
+	return params, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Categories of security events.
+const (
+	securityAuthFailure  = "authentication_failure"
+	securityAuthzFailure = "authorization_failure"
+	securityDestructive  = "destructive"
+	securityAdmin        = "admin"
+)
+
+// securityEvent is an action of interest to security teams. Source is the
+// address of the client which requested it and Requester who made the
+// request, both empty for actions taken by the provider itself.
+type securityEvent struct {
+	Time      time.Time `json:"time"`
+	Category  string    `json:"category"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Requester string    `json:"requester,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// siem is the sink security events are exported to, nil unless SIEM_URL is
+// set.
+var siem *siemSink
+
+// recentEventsSize is the number of security events kept for the
+// dashboard.
+const recentEventsSize = 200
+
+// recentEvents are the latest security events, whether or not a SIEM is
+// configured. They are kept in memory only.
+var recentEvents = &eventLog{}
+
+type eventLog struct {
+	mtx    sync.Mutex
+	events []*securityEvent
+}
+
+func (l *eventLog) add(e *securityEvent) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if len(l.events) == recentEventsSize {
+		l.events = l.events[1:]
+	}
+	l.events = append(l.events, e)
+}
+
+// latest returns up to n events, newest first.
+func (l *eventLog) latest(n int) []*securityEvent {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if n > len(l.events) {
+		n = len(l.events)
+	}
+	events := make([]*securityEvent, n)
+	for i := range events {
+		events[i] = l.events[len(l.events)-1-i]
+	}
+	return events
+}
+
+// audit records a security event and exports it to the SIEM, in the
+// background. source is the origin of the request which caused it, empty
+// for actions taken by the provider itself.
+func audit(source origin, category, action, resource string, err error) {
+	e := &securityEvent{
+		Time:      time.Now().UTC(),
+		Category:  category,
+		Action:    action,
+		Resource:  resource,
+		Source:    source.Source,
+		Requester: source.Requester,
+		Outcome:   "success",
+	}
+	if err != nil {
+		e.Outcome, e.Error = "failure", redact(err.Error())
+	}
+	recentEvents.add(e)
+	if siem == nil {
+		return
+	}
+	select {
+	case siem.events <- e:
+	default:
+		logger.Error("dropping security event, the SIEM queue is full", "action", action, "resource", resource)
+	}
+}
+
+// requestSource returns the address of the client making a request, see
+// clientIP.
+func requestSource(req *http.Request) string {
+	if ip := clientIP(req); ip != nil {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
+// siemSink batches security events and delivers them to a syslog server, as
+// RFC 5424 or CEF messages, or to an HTTP endpoint as a JSON array. Failed
+// batches are retried with backoff before being dropped.
+type siemSink struct {
+	url      *url.URL
+	format   string
+	events   chan *securityEvent
+	batch    int
+	interval time.Duration
+	retries  int
+	client   *http.Client
+	hostname string
+}
+
+// newSIEMSink parses a sink URL, either syslog+tcp://host:port,
+// syslog+udp://host:port or an http(s) URL.
+func newSIEMSink(rawURL, format string) (*siemSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "syslog+tcp", "syslog+udp":
+		u.Host = withDefaultPort(u.Host, "514")
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	switch format {
+	case "":
+		format = "rfc5424"
+	case "rfc5424", "cef":
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &siemSink{
+		url:      u,
+		format:   format,
+		events:   make(chan *securityEvent, 10000),
+		batch:    100,
+		interval: 5 * time.Second,
+		retries:  5,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		hostname: hostname,
+	}, nil
+}
+
+// run delivers the queued events, a batch at a time, at least every
+// interval.
+func (s *siemSink) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var batch []*securityEvent
+	for {
+		select {
+		case e := <-s.events:
+			batch = append(batch, e)
+			if len(batch) < s.batch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.deliver(batch)
+		batch = nil
+	}
+}
+
+func (s *siemSink) deliver(batch []*securityEvent) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := s.send(batch)
+		if err == nil {
+			return
+		}
+		if attempt > s.retries {
+			logger.Error("dropping security events, delivery to the SIEM failed", "events", len(batch), "err", err)
+			return
+		}
+		logger.Error("error delivering security events, retrying", "attempt", attempt, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *siemSink) send(batch []*securityEvent) error {
+	if s.url.Scheme == "http" || s.url.Scheme == "https" {
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		res, err := s.client.Post(s.url.String(), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %d", res.StatusCode)
+		}
+		return nil
+	}
+
+	network := strings.TrimPrefix(s.url.Scheme, "syslog+")
+	conn, err := net.DialTimeout(network, s.url.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	for _, e := range batch {
+		msg := s.syslogMessage(e)
+		if network == "tcp" {
+			// octet counting framing, RFC 6587
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syslogMessage formats an event as an RFC 5424 message from the local4
+// facility, with either structured data or a CEF message.
+func (s *siemSink) syslogMessage(e *securityEvent) string {
+	severity := 5 // notice
+	if e.Outcome == "failure" || e.Category == securityAuthFailure {
+		severity = 4 // warning
+	}
+	header := fmt.Sprintf("<%d>1 %s %s pg-external %d %s", 20*8+severity, e.Time.Format(time.RFC3339Nano), s.hostname, os.Getpid(), e.Action)
+	if s.format == "cef" {
+		cefSeverity := 3
+		if severity == 4 {
+			cefSeverity = 7
+		}
+		ext := []string{
+			"rt=" + cefValue(fmt.Sprint(e.Time.UnixNano()/int64(time.Millisecond))),
+			"cat=" + cefValue(e.Category),
+			"act=" + cefValue(e.Action),
+			"outcome=" + cefValue(e.Outcome),
+		}
+		if e.Source != "" {
+			ext = append(ext, "src="+cefValue(e.Source))
+		}
+		if e.Requester != "" {
+			ext = append(ext, "suser="+cefValue(e.Requester))
+		}
+		if e.Resource != "" {
+			ext = append(ext, "cs1Label=resource", "cs1="+cefValue(e.Resource))
+		}
+		if e.Error != "" {
+			ext = append(ext, "msg="+cefValue(e.Error))
+		}
+		return fmt.Sprintf("%s - CEF:0|Flynn|pg-external|1|%s|%s|%d|%s",
+			header, cefHeader(e.Action), cefHeader(e.Category+" "+e.Action), cefSeverity, strings.Join(ext, " "))
+	}
+	params := []string{
+		sdParam("category", e.Category),
+		sdParam("outcome", e.Outcome),
+	}
+	if e.Source != "" {
+		params = append(params, sdParam("source", e.Source))
+	}
+	if e.Requester != "" {
+		params = append(params, sdParam("requester", e.Requester))
+	}
+	if e.Resource != "" {
+		params = append(params, sdParam("resource", e.Resource))
+	}
+	msg := e.Category + " " + e.Action + " " + e.Outcome
+	if e.Error != "" {
+		msg += ": " + e.Error
+	}
+	return fmt.Sprintf("%s [security@32473 %s] %s", header, strings.Join(params, " "), msg)
+}
+
+var (
+	sdEscaper        = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func sdParam(name, value string) string {
+	return name + `="` + sdEscaper.Replace(value) + `"`
+}
+
+func cefHeader(s string) string {
+	return cefHeaderEscaper.Replace(s)
+}
+
+func cefValue(s string) string {
+	return cefValueEscaper.Replace(s)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"golang.org/x/net/context"
+)
+
+// sloOperations are the operations whose outcome and latency are recorded.
+var sloOperations = []string{"provision", "deprovision"}
+
+// sloPeriod is a rolling window over which operations are summarized.
+type sloPeriod struct {
+	name     string
+	duration time.Duration
+}
+
+// parseWindows parses a comma separated list of durations.
+func parseWindows(s string) ([]sloPeriod, error) {
+	var windows []sloPeriod
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		d, err := time.ParseDuration(f)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SLO window %q", f)
+		}
+		windows = append(windows, sloPeriod{name: f, duration: d})
+	}
+	return windows, nil
+}
+
+// recordOperation records the outcome and duration of an operation, for
+// reporting by GET /admin/slo. Failing to record it is only logged.
+func recordOperation(state *postgres.DB, typ string, start time.Time, err error) {
+	if e := state.Exec(`INSERT INTO operations (type, succeeded, duration) VALUES ($1, $2, $3)`,
+		typ, err == nil, time.Since(start).Seconds()); e != nil {
+		logger.Error("error recording operation", "type", typ, "err", e)
+	}
+}
+
+// pruneOperations deletes the operations older than the longest SLO window.
+func pruneOperations(state *postgres.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := state.Exec(`DELETE FROM operations WHERE created_at < now() - make_interval(secs => $1)`, sloRetention().Seconds()); err != nil {
+			logger.Error("error pruning operations", "err", err)
+		}
+	}
+}
+
+func sloRetention() time.Duration {
+	var max time.Duration
+	for _, w := range sloWindows {
+		if w.duration > max {
+			max = w.duration
+		}
+	}
+	return max
+}
+
+type sloLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+type sloSummary struct {
+	Total       int64       `json:"total"`
+	Succeeded   int64       `json:"succeeded"`
+	SuccessRate *float64    `json:"success_rate"`
+	Latency     *sloLatency `json:"latency_seconds"`
+}
+
+type sloWindow struct {
+	Window     string                 `json:"window"`
+	Operations map[string]*sloSummary `json:"operations"`
+}
+
+// getSLO summarizes the success rate and latency percentiles of each
+// operation over the rolling windows configured by SLO_WINDOWS. Latencies
+// are those of successful operations, in seconds, and rates and latencies
+// are null for windows without any operations.
+func (p *pgAPI) getSLO(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	res := make([]*sloWindow, 0, len(sloWindows))
+	for _, window := range sloWindows {
+		sw := &sloWindow{Window: window.name, Operations: make(map[string]*sloSummary, len(sloOperations))}
+		for _, op := range sloOperations {
+			s := &sloSummary{}
+			var p50, p95, p99 *float64
+			if err := p.state.QueryRow(`
+SELECT count(*), count(*) FILTER (WHERE succeeded),
+  percentile_cont(0.5) WITHIN GROUP (ORDER BY duration) FILTER (WHERE succeeded),
+  percentile_cont(0.95) WITHIN GROUP (ORDER BY duration) FILTER (WHERE succeeded),
+  percentile_cont(0.99) WITHIN GROUP (ORDER BY duration) FILTER (WHERE succeeded)
+FROM operations WHERE type = $1 AND created_at >= now() - make_interval(secs => $2)`,
+				op, window.duration.Seconds()).Scan(&s.Total, &s.Succeeded, &p50, &p95, &p99); err != nil {
+				httphelper.Error(w, err)
+				return
+			}
+			if s.Total > 0 {
+				rate := float64(s.Succeeded) / float64(s.Total)
+				s.SuccessRate = &rate
+			}
+			if p50 != nil {
+				s.Latency = &sloLatency{P50: *p50, P95: *p95, P99: *p99}
+			}
+			sw.Operations[op] = s
+		}
+		res = append(res, sw)
+	}
+	httphelper.JSON(w, 200, res)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errSlotExists   = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "replication slot already exists"}
+	errSlotNotFound = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "replication slot not found"}
+)
+
+// slotPlugins are the output plugins slots may be created with.
+var slotPlugins = map[string]bool{
+	"pgoutput": true,
+	"wal2json": true,
+}
+
+type slotRequest struct {
+	Name   string `json:"name"`
+	Plugin string `json:"plugin"`
+}
+
+// slot is a logical replication slot of a resource's database. Slot names
+// are unique across the backend, so the name given is prefixed with the
+// database's. The remaining fields describe the slot on the backend, and are
+// unset if it has been dropped there.
+type slot struct {
+	Name      string    `json:"name"`
+	SlotName  string    `json:"slot_name"`
+	Plugin    string    `json:"plugin"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Active            *bool   `json:"active,omitempty"`
+	RestartLSN        *string `json:"restart_lsn,omitempty"`
+	ConfirmedFlushLSN *string `json:"confirmed_flush_lsn,omitempty"`
+	RetainedBytes     *int64  `json:"retained_bytes,omitempty"`
+}
+
+// createSlot creates a logical replication slot in a resource's database,
+// for a change data capture consumer to stream changes from.
+func (p *pgAPI) createSlot(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	var config slotRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.Plugin == "" {
+		config.Plugin = "pgoutput"
+	}
+	if !slotPlugins[config.Plugin] {
+		httphelper.ValidationError(w, "plugin", "must be pgoutput or wal2json")
+		return
+	}
+	if config.Name == "" || !validIdentifier.MatchString(config.Name) {
+		httphelper.ValidationError(w, "name", "must contain only lowercase letters, digits and underscores")
+		return
+	}
+	s := &slot{Name: config.Name, SlotName: r.Database + "_" + config.Name, Plugin: config.Plugin}
+	if len(s.SlotName) > maxIdentifierLength {
+		httphelper.ValidationError(w, "name", fmt.Sprintf("must be at most %d characters", maxIdentifierLength-len(r.Database)-1))
+		return
+	}
+	if s.SlotName == replicationName(r.Database) {
+		httphelper.ValidationError(w, "name", "is reserved")
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := checkPublications(r.Backend); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	// logical slots belong to the database they are created in
+	conn, err := pgx.Connect(r.Backend.connConfig(r.Database))
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`SELECT pg_create_logical_replication_slot($1, $2)`, s.SlotName, s.Plugin)
+	switch {
+	// duplicate_object
+	case postgres.IsPostgresCode(err, "42710"):
+		err = errSlotExists
+	// undefined_file if the plugin isn't installed
+	case postgres.IsPostgresCode(err, "58P01"):
+		httphelper.ValidationError(w, "plugin", "is not installed on the backend")
+		return
+	case err == nil:
+		err = p.state.QueryRow(`INSERT INTO slots (resource, name, slot_name, plugin) VALUES ($1, $2, $3, $4) RETURNING created_at`,
+			r.UUID, s.Name, s.SlotName, s.Plugin).Scan(&s.CreatedAt)
+		if err != nil {
+			conn.Exec(`SELECT pg_drop_replication_slot($1)`, s.SlotName)
+		}
+	}
+	audit(requestOrigin(ctx, req), securityAdmin, "create_slot", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 201, s)
+}
+
+// getSlots lists the replication slots of a resource's database, with their
+// state on the backend.
+func (p *pgAPI) getSlots(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	rows, err := p.state.Query(`SELECT name, slot_name, plugin, created_at FROM slots WHERE resource = $1 ORDER BY name`, r.UUID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	slots := []*slot{}
+	for rows.Next() {
+		s := &slot{}
+		if err := rows.Scan(&s.Name, &s.SlotName, &s.Plugin, &s.CreatedAt); err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		slots = append(slots, s)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	for _, s := range slots {
+		var active bool
+		var restart, confirmed *string
+		var retained *int64
+		err := r.Backend.db.QueryRow(`
+SELECT active, restart_lsn::text, confirmed_flush_lsn::text, pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn)::bigint
+FROM pg_replication_slots WHERE slot_name = $1`, s.SlotName).Scan(&active, &restart, &confirmed, &retained)
+		if err == pgx.ErrNoRows {
+			continue
+		} else if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		s.Active, s.RestartLSN, s.ConfirmedFlushLSN, s.RetainedBytes = &active, restart, confirmed, retained
+	}
+	httphelper.JSON(w, 200, slots)
+}
+
+// deleteSlot drops a replication slot, terminating the session streaming
+// from it if there is one.
+func (p *pgAPI) deleteSlot(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	var slotName string
+	err := p.state.QueryRow(`SELECT slot_name FROM slots WHERE resource = $1 AND name = $2`, r.UUID, params.ByName("name")).Scan(&slotName)
+	if err == pgx.ErrNoRows {
+		httphelper.Error(w, errSlotNotFound)
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	err = dropSlot(p.state, r.Backend, slotName)
+	audit(requestOrigin(ctx, req), securityDestructive, "delete_slot", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// dropSlot drops a slot on the backend if it still exists, terminating the
+// session using it, and forgets it.
+func dropSlot(state *postgres.DB, b *backend, slotName string) error {
+	if err := dropBackendSlots(b, "slot_name", slotName); err != nil {
+		return err
+	}
+	return state.Exec(`DELETE FROM slots WHERE slot_name = $1`, slotName)
+}
+
+// dropDatabaseSlots drops the logical replication slots of a database,
+// whether created by the provider or by a consumer directly, which would
+// otherwise block dropping it and retain WAL indefinitely.
+func dropDatabaseSlots(b *backend, database string) error {
+	return dropBackendSlots(b, "database", database)
+}
+
+// dropBackendSlots drops the slots whose column (slot_name or database)
+// matches value, terminating the sessions using them first.
+func dropBackendSlots(b *backend, column, value string) error {
+	var err error
+	for attempt := 1; attempt <= dropAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		if err := b.db.Exec(fmt.Sprintf(`SELECT pg_terminate_backend(active_pid) FROM pg_replication_slots WHERE %s = $1 AND active_pid IS NOT NULL`, column), value); err != nil {
+			return err
+		}
+		err = b.db.Exec(fmt.Sprintf(`SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE %s = $1`, column), value)
+		// object_in_use until the terminated sessions have exited
+		if !postgres.IsPostgresCode(err, "55006") {
+			break
+		}
+	}
+	return err
+}
+
+// slotMonitor watches the WAL retained by the logical replication slots of
+// the provider's databases, since a single forgotten consumer can fill the
+// shared server's disk. Slots retaining more than SLOT_WARNING_SIZE are
+// reported, and with SLOT_DROP_SIZE set those retaining more than that are
+// dropped.
+type slotMonitor struct {
+	state    *postgres.DB
+	backends *backendSet
+
+	// warned are the slots reported since they last retained less than
+	// the warning size
+	warned map[string]bool
+}
+
+func (m *slotMonitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.check(); err != nil {
+			logger.Error("error checking replication slots", "err", err)
+		}
+	}
+}
+
+type slotStatus struct {
+	uuid     string
+	database string
+	slotName string
+	active   bool
+	retained int64
+}
+
+func (m *slotMonitor) check() error {
+	rows, err := m.state.Query(`SELECT uuid, database, region FROM resources`)
+	if err != nil {
+		return err
+	}
+	resources := make(map[*backend]map[string]string)
+	for rows.Next() {
+		var uuid, database string
+		var region *string
+		if err := rows.Scan(&uuid, &database, &region); err != nil {
+			rows.Close()
+			return err
+		}
+		b, err := m.backends.forRegion(region)
+		if err != nil {
+			continue
+		}
+		if resources[b] == nil {
+			resources[b] = make(map[string]string)
+		}
+		resources[b][database] = uuid
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for b, databases := range resources {
+		if caps := b.get(); caps == nil || caps.VersionNum < 100000 {
+			continue
+		}
+		slots, err := m.backendSlots(b, databases)
+		if err != nil {
+			logger.Error("error checking replication slots", "backend", b.name, "err", err)
+			continue
+		}
+		for _, s := range slots {
+			seen[s.slotName] = true
+			if err := m.checkSlot(b, s); err != nil {
+				logger.Error("error checking replication slot", "slot", s.slotName, "err", err)
+			}
+		}
+	}
+	for name := range m.warned {
+		if !seen[name] {
+			delete(m.warned, name)
+		}
+	}
+	return nil
+}
+
+// backendSlots returns the logical slots on b of the given databases, which
+// map to their resources.
+func (m *slotMonitor) backendSlots(b *backend, databases map[string]string) ([]*slotStatus, error) {
+	rows, err := b.db.Query(`
+SELECT slot_name::text, database::text, active, coalesce(pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn), 0)::bigint
+FROM pg_replication_slots WHERE slot_type = 'logical'`)
+	if err != nil {
+		return nil, err
+	}
+	var slots []*slotStatus
+	for rows.Next() {
+		s := &slotStatus{}
+		if err := rows.Scan(&s.slotName, &s.database, &s.active, &s.retained); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var ok bool
+		if s.uuid, ok = databases[s.database]; ok {
+			slots = append(slots, s)
+		}
+	}
+	return slots, rows.Err()
+}
+
+func (m *slotMonitor) checkSlot(b *backend, s *slotStatus) error {
+	info := map[string]interface{}{
+		"id":       resourceID(s.uuid),
+		"database": s.database,
+		"slot":     s.slotName,
+		"active":   s.active,
+		"retained": s.retained,
+	}
+	if s.retained < slotWarningSize {
+		delete(m.warned, s.slotName)
+		return nil
+	}
+	if !m.warned[s.slotName] {
+		logger.Warn("replication slot is retaining WAL", "slot", s.slotName, "database", s.database, "retained", s.retained)
+		notify("slot.warning", info)
+		m.warned[s.slotName] = true
+	}
+
+	// the slot of a migration in progress is dropped along with it
+	if slotDropSize == 0 || s.retained < slotDropSize || s.slotName == replicationName(s.database) {
+		return nil
+	}
+	err := dropSlot(m.state, b, s.slotName)
+	audit(origin{}, securityDestructive, "drop_slot", resourceID(s.uuid), err)
+	if err != nil {
+		return err
+	}
+	logger.Warn("dropped replication slot retaining too much WAL", "slot", s.slotName, "database", s.database, "retained", s.retained)
+	delete(m.warned, s.slotName)
+	notify("slot.dropped", info)
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"golang.org/x/net/context"
+)
+
+const slowActivity = `
+SELECT a.datname::text, a.usename::text, a.pid, a.query, a.state, a.query_start,
+       extract(epoch FROM now() - a.query_start)::float8
+FROM pg_stat_activity a
+WHERE a.pid <> pg_backend_pid()
+  AND a.query_start IS NOT NULL
+  AND ((a.state = 'active' AND now() - a.query_start > make_interval(secs => $2))
+       OR a.state = 'idle in transaction (aborted)')
+  AND a.datname IN (` + providerDatabases + `)`
+
+// sessionErrors counts the sessions of each of the provider's databases
+// which ended in errors. The counters were added in PostgreSQL 14.
+const sessionErrors = `
+SELECT s.datname::text, s.sessions_fatal, s.sessions_killed, s.sessions_abandoned
+FROM pg_stat_database s
+WHERE s.datname IN (` + providerDatabases + `)`
+
+const providerDatabases = `
+    SELECT d.datname FROM pg_database d
+    JOIN pg_auth_members m ON m.roleid = d.datdba
+    JOIN pg_roles s ON s.oid = m.member
+    WHERE s.rolname = $1
+  `
+
+// slowLogSize is the number of entries kept per database.
+const slowLogSize = 100
+
+type slowQuery struct {
+	Kind       string    `json:"kind"`
+	Username   string    `json:"username"`
+	PID        int32     `json:"pid"`
+	Query      string    `json:"query"`
+	QueryStart time.Time `json:"query_start"`
+	Duration   float64   `json:"duration_seconds"`
+	SeenAt     time.Time `json:"seen_at"`
+}
+
+// connectionErrors are the sessions of a database which ended in errors
+// between two samples: terminated by a fatal error, killed by an operator
+// or abandoned by the client without closing them.
+type connectionErrors struct {
+	Fatal     int64     `json:"sessions_fatal"`
+	Killed    int64     `json:"sessions_killed"`
+	Abandoned int64     `json:"sessions_abandoned"`
+	Since     time.Time `json:"since"`
+	SeenAt    time.Time `json:"seen_at"`
+}
+
+// slowLog samples pg_stat_activity for long running queries and sessions
+// stuck in a failed transaction, and pg_stat_database for sessions which
+// ended in errors, keeping the most recent ones per database.
+type slowLog struct {
+	backends  []*backend
+	threshold time.Duration
+	push      bool
+
+	mtx      sync.RWMutex
+	entries  map[slowLogKey][]*slowQuery
+	errors   map[slowLogKey][]*connectionErrors
+	counters map[slowLogKey]*connectionErrors
+}
+
+// slowLogKey identifies a database, the same name may exist in several
+// regions.
+type slowLogKey struct {
+	region   string
+	database string
+}
+
+func newSlowLog(backends []*backend, threshold time.Duration, push bool) *slowLog {
+	return &slowLog{
+		backends:  backends,
+		threshold: threshold,
+		push:      push,
+		entries:   make(map[slowLogKey][]*slowQuery),
+		errors:    make(map[slowLogKey][]*connectionErrors),
+		counters:  make(map[slowLogKey]*connectionErrors),
+	}
+}
+
+func (l *slowLog) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, b := range l.backends {
+			if err := l.sample(b); err != nil {
+				logger.Error("error sampling slow queries", "region", b.region, "err", err)
+			}
+			if err := l.sampleErrors(b); err != nil {
+				logger.Error("error sampling connection errors", "region", b.region, "err", err)
+			}
+		}
+	}
+}
+
+func (l *slowLog) sample(b *backend) error {
+	rows, err := b.db.Query(slowActivity, serviceUser, l.threshold.Seconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var database, state string
+		q := &slowQuery{SeenAt: now}
+		if err := rows.Scan(&database, &q.Username, &q.PID, &q.Query, &state, &q.QueryStart, &q.Duration); err != nil {
+			return err
+		}
+		q.Kind = "slow_query"
+		if state != "active" {
+			q.Kind = "aborted_transaction"
+		}
+		if l.record(slowLogKey{b.region, database}, q) && l.push {
+			notify("query."+q.Kind, map[string]interface{}{
+				"database": database,
+				"region":   b.region,
+				"query":    q,
+			})
+		}
+	}
+	return rows.Err()
+}
+
+// sampleErrors compares the session counters of b's databases with the
+// previous sample, logging the sessions which have ended in errors since.
+func (l *slowLog) sampleErrors(b *backend) error {
+	if caps := b.get(); caps == nil || caps.VersionNum < 140000 {
+		return nil
+	}
+	rows, err := b.db.Query(sessionErrors, serviceUser)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var database string
+		c := &connectionErrors{SeenAt: now}
+		if err := rows.Scan(&database, &c.Fatal, &c.Killed, &c.Abandoned); err != nil {
+			return err
+		}
+		if e := l.recordErrors(slowLogKey{b.region, database}, c); e != nil && l.push {
+			notify("connection.errors", map[string]interface{}{
+				"database": database,
+				"region":   b.region,
+				"errors":   e,
+			})
+		}
+	}
+	return rows.Err()
+}
+
+// recordErrors replaces the counters of a database with c, adding the
+// errors since the previous counters to the log and returning them, nil if
+// there weren't any. The first counters of a database, and those after its
+// statistics were reset, are only kept to compare the next ones with.
+func (l *slowLog) recordErrors(key slowLogKey, c *connectionErrors) *connectionErrors {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	prev := l.counters[key]
+	l.counters[key] = c
+	if prev == nil || c.Fatal < prev.Fatal || c.Killed < prev.Killed || c.Abandoned < prev.Abandoned {
+		return nil
+	}
+	e := &connectionErrors{
+		Fatal:     c.Fatal - prev.Fatal,
+		Killed:    c.Killed - prev.Killed,
+		Abandoned: c.Abandoned - prev.Abandoned,
+		Since:     prev.SeenAt,
+		SeenAt:    c.SeenAt,
+	}
+	if e.Fatal == 0 && e.Killed == 0 && e.Abandoned == 0 {
+		return nil
+	}
+	entries := append(l.errors[key], e)
+	if len(entries) > slowLogSize {
+		entries = entries[len(entries)-slowLogSize:]
+	}
+	l.errors[key] = entries
+	return e
+}
+
+// record adds q to the log for a database, or updates the existing entry
+// for the same query, returning whether q wasn't seen before.
+func (l *slowLog) record(key slowLogKey, q *slowQuery) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	entries := l.entries[key]
+	for i, e := range entries {
+		if e.PID == q.PID && e.QueryStart.Equal(q.QueryStart) {
+			entries[i] = q
+			return false
+		}
+	}
+	entries = append(entries, q)
+	if len(entries) > slowLogSize {
+		entries = entries[len(entries)-slowLogSize:]
+	}
+	l.entries[key] = entries
+	return true
+}
+
+func (l *slowLog) get(key slowLogKey) []*slowQuery {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	entries := make([]*slowQuery, len(l.entries[key]))
+	copy(entries, l.entries[key])
+	return entries
+}
+
+func (p *pgAPI) getSlowQueries(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	httphelper.JSON(w, 200, p.slowLog.get(slowLogKey{r.Backend.region, r.Database}))
+}
+
+func (l *slowLog) getErrors(key slowLogKey) []*connectionErrors {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	entries := make([]*connectionErrors, len(l.errors[key]))
+	copy(entries, l.errors[key])
+	return entries
+}
+
+func (p *pgAPI) getConnectionErrors(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	httphelper.JSON(w, 200, p.slowLog.getErrors(slowLogKey{r.Backend.region, r.Database}))
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var (
+	errSnapshotExists   = httphelper.JSONError{Code: httphelper.ConflictErrorCode, Message: "a snapshot with this name already exists"}
+	errSnapshotNotFound = httphelper.JSONError{Code: httphelper.ObjectNotFoundErrorCode, Message: "snapshot not found"}
+	errSnapshotInUse    = httphelper.JSONError{
+		Code:    httphelper.ConflictErrorCode,
+		Message: "the database has active connections, which prevent copying it (retry with terminate_connections to close them)",
+		Retry:   true,
+	}
+)
+
+var validSnapshotName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+type snapshotRequest struct {
+	Name                 string   `json:"name"`
+	Description          string   `json:"description"`
+	Tags                 []string `json:"tags"`
+	TerminateConnections bool     `json:"terminate_connections"`
+}
+
+// snapshot is a named copy of a resource's database, kept on its backend as
+// a database nobody but the provider can connect to.
+type snapshot struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	SizeBytes   int64     `json:"size_bytes"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	database string
+}
+
+const snapshotColumns = `name, database, description, tags, size_bytes, coalesce(created_by, ''), created_at`
+
+func scanSnapshot(s scanner) (*snapshot, error) {
+	snap := &snapshot{}
+	if err := s.Scan(&snap.Name, &snap.database, &snap.Description, &snap.Tags, &snap.SizeBytes, &snap.CreatedBy, &snap.CreatedAt); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// createSnapshot copies a resource's database into a named snapshot, e.g.
+// before a risky schema change. Copying requires that nobody is connected to
+// the database, so the request fails unless terminate_connections is set
+// while it is in use.
+func (p *pgAPI) createSnapshot(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	var config snapshotRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if !validSnapshotName.MatchString(config.Name) {
+		httphelper.ValidationError(w, "name", "must be at most 63 lowercase letters, digits or any of _.-")
+		return
+	}
+	if err := validateTags(config.Tags); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.Tags == nil {
+		config.Tags = []string{}
+	}
+	var exists bool
+	if err := p.state.QueryRow(`SELECT EXISTS (SELECT 1 FROM snapshots WHERE resource = $1 AND name = $2)`, r.UUID, config.Name).Scan(&exists); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if exists {
+		httphelper.Error(w, errSnapshotExists)
+		return
+	}
+	b := r.Backend
+	if err := b.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if !checkCapacity(w, b) {
+		return
+	}
+
+	if config.TerminateConnections {
+		if err := b.db.Exec(disconnectConns, r.Database); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+	snap := &snapshot{
+		Name:        config.Name,
+		Description: config.Description,
+		Tags:        config.Tags,
+		CreatedBy:   requester(ctx, req),
+		database:    "snap_" + random.Hex(8),
+	}
+	err := snap.create(p.state, r)
+	audit(requestOrigin(ctx, req), securityAdmin, "create_snapshot", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 201, snap)
+}
+
+// create copies the resource's database and records the snapshot. The copy
+// belongs to the provider and PUBLIC may not connect to it, so the
+// resource's roles can't reach it, while the objects in it keep their
+// owners for restoring.
+func (snap *snapshot) create(state *postgres.DB, r *resourceRef) error {
+	b := r.Backend
+	err := b.db.Exec(fmt.Sprintf(`CREATE DATABASE "%s" TEMPLATE = "%s"`, snap.database, r.Database))
+	if postgres.IsPostgresCode(err, "55006") {
+		// object_in_use, someone is connected to the database
+		return errSnapshotInUse
+	} else if err != nil {
+		return err
+	}
+	err = b.db.Exec(fmt.Sprintf(`REVOKE ALL ON DATABASE "%s" FROM PUBLIC`, snap.database))
+	if err == nil {
+		err = b.db.QueryRow(`SELECT pg_database_size($1)`, snap.database).Scan(&snap.SizeBytes)
+	}
+	if err == nil {
+		err = state.QueryRow(`INSERT INTO snapshots (resource, name, database, description, tags, size_bytes, created_by) VALUES ($1, $2, $3, $4, $5, $6, nullif($7, '')) RETURNING created_at`,
+			r.UUID, snap.Name, snap.database, snap.Description, snap.Tags, snap.SizeBytes, snap.CreatedBy).Scan(&snap.CreatedAt)
+		if postgres.IsUniquenessError(err, "") {
+			err = errSnapshotExists
+		}
+	}
+	if err != nil {
+		b.db.Exec(fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, snap.database))
+	}
+	return err
+}
+
+// getSnapshots lists the snapshots of a resource, newest first.
+func (p *pgAPI) getSnapshots(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return
+	}
+	rows, err := p.state.Query(`SELECT `+snapshotColumns+` FROM snapshots WHERE resource = $1 ORDER BY created_at DESC`, r.UUID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	snaps := []*snapshot{}
+	for rows.Next() {
+		snap, err := scanSnapshot(rows)
+		if err != nil {
+			rows.Close()
+			httphelper.Error(w, err)
+			return
+		}
+		snaps = append(snaps, snap)
+	}
+	if err := rows.Err(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, snaps)
+}
+
+// lookupSnapshot returns the resource and the snapshot named in the path.
+func (p *pgAPI) lookupSnapshot(ctx context.Context, w http.ResponseWriter) (*resourceRef, *snapshot, bool) {
+	r, ok := p.lookupResource(ctx, w)
+	if !ok {
+		return nil, nil, false
+	}
+	if r.UUID == "" {
+		httphelper.Error(w, errUntracked)
+		return nil, nil, false
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	snap, err := scanSnapshot(p.state.QueryRow(`SELECT `+snapshotColumns+` FROM snapshots WHERE resource = $1 AND name = $2`, r.UUID, params.ByName("name")))
+	if err == pgx.ErrNoRows {
+		err = errSnapshotNotFound
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return nil, nil, false
+	}
+	return r, snap, true
+}
+
+// deleteSnapshot drops a snapshot.
+func (p *pgAPI) deleteSnapshot(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	r, snap, ok := p.lookupSnapshot(ctx, w)
+	if !ok {
+		return
+	}
+	if err := r.Backend.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	err := dropSnapshot(p.state, r.Backend, snap.database)
+	audit(requestOrigin(ctx, req), securityDestructive, "delete_snapshot", r.id(), err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+type restoreRequest struct {
+	App string `json:"app"`
+	Env string `json:"env"`
+	TTL string `json:"ttl"`
+}
+
+// restoreSnapshot provisions a new resource from a snapshot, next to the
+// resource it was taken of, which is left untouched. The new resource
+// belongs to the same tenant and app, and is tagged "snapshot:<name>".
+func (p *pgAPI) restoreSnapshot(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	version, ok := negotiateResource(w, req)
+	if !ok {
+		return
+	}
+	r, snap, ok := p.lookupSnapshot(ctx, w)
+	if !ok {
+		return
+	}
+	var config restoreRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil && err != io.EOF {
+		httphelper.Error(w, err)
+		return
+	}
+	var ttl *float64
+	if config.TTL != "" {
+		d, err := parseTTL(config.TTL)
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		secs := d.Seconds()
+		ttl = &secs
+	}
+	var app, env string
+	var tenant *string
+	if err := p.state.QueryRow(`SELECT app, env, tenant FROM resources WHERE uuid = $1`, r.UUID).Scan(&app, &env, &tenant); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.App != "" {
+		app = config.App
+	}
+	if config.Env != "" {
+		env = config.Env
+	}
+
+	b := r.Backend
+	if err := b.checkPrimary(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if !checkCapacity(w, b) {
+		return
+	}
+	spec := &provisionSpec{
+		App:       app,
+		Env:       env,
+		TTL:       ttl,
+		Tags:      []string{"snapshot:" + snap.Name},
+		Template:  snap.database,
+		Parent:    r.UUID,
+		Requester: requester(ctx, req),
+	}
+	if tenant != nil {
+		spec.Tenant = *tenant
+		if err := p.checkTenantSize(spec.Tenant); err != nil {
+			provisionError(w, err)
+			return
+		}
+	}
+	res, err := p.provision(b, spec)
+	audit(requestOrigin(ctx, req), securityAdmin, "restore_snapshot", r.id(), err)
+	if err != nil {
+		provisionError(w, err)
+		return
+	}
+	writeResource(w, version, res)
+}
+
+// dropSnapshot drops a snapshot's database and forgets it.
+func dropSnapshot(state *postgres.DB, b *backend, database string) error {
+	if err := dropBackendDatabase(b, database, false); err != nil {
+		return err
+	}
+	return state.Exec(`DELETE FROM snapshots WHERE database = $1`, database)
+}
+
+// snapshotDatabases returns the databases of a resource's snapshots.
+func snapshotDatabases(state *postgres.DB, resource string) ([]string, error) {
+	rows, err := state.Query(`SELECT database FROM snapshots WHERE resource = $1`, resource)
+	if err != nil {
+		return nil, err
+	}
+	var databases []string
+	for rows.Next() {
+		var database string
+		if err := rows.Scan(&database); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		databases = append(databases, database)
+	}
+	return databases, rows.Err()
+}
+
+// dropSnapshots drops every snapshot of a resource. The resource's roles own
+// objects in them, so they must go before the roles can be dropped.
+func dropSnapshots(state *postgres.DB, r *resourceRef) error {
+	if r.UUID == "" {
+		return nil
+	}
+	databases, err := snapshotDatabases(state, r.UUID)
+	if err != nil {
+		return err
+	}
+	for _, database := range databases {
+		if err := dropSnapshot(state, r.Backend, database); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reassignSnapshots hands the objects a role owns in a resource's snapshots
+// over to another, so that the role can be dropped.
+func reassignSnapshots(state *postgres.DB, b *backend, resource, from, to string) error {
+	databases, err := snapshotDatabases(state, resource)
+	if err != nil {
+		return err
+	}
+	for _, database := range databases {
+		conn, err := pgx.Connect(b.connConfig(database))
+		if err != nil {
+			return err
+		}
+		_, err = conn.Exec(fmt.Sprintf(`REASSIGN OWNED BY "%s" TO "%s"`, from, to))
+		if err == nil {
+			_, err = conn.Exec(fmt.Sprintf(`DROP OWNED BY "%s"`, from))
+		}
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+)
+
+// openState connects to the provider's own state database on the backend,
+// creating it if it doesn't exist yet, and brings its schema up to date.
+func openState(b *backend) (*postgres.DB, error) {
+	db := b.db
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, stateDatabase).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := db.Exec(fmt.Sprintf(`CREATE DATABASE "%s"`, stateDatabase)); err != nil {
+			return nil, err
+		}
+	}
+
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: b.connConfig(stateDatabase)})
+	if err != nil {
+		return nil, err
+	}
+	state := postgres.New(pool, nil)
+	if err := migrateState(state); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return state, nil
+}
+
+func migrateState(db *postgres.DB) error {
+	m := postgres.NewMigrations()
+	m.Add(1,
+		`CREATE TABLE resources (
+			database       text PRIMARY KEY,
+			username       text NOT NULL,
+			quota_bytes    bigint,
+			quota_level    integer NOT NULL DEFAULT 0,
+			quota_enforced boolean NOT NULL DEFAULT false,
+			created_at     timestamptz NOT NULL DEFAULT now()
+		)`,
+	)
+	m.Add(2,
+		`ALTER TABLE resources ADD COLUMN uuid uuid`,
+		`UPDATE resources SET uuid = md5(random()::text || database)::uuid`,
+		`ALTER TABLE resources ALTER COLUMN uuid SET NOT NULL`,
+		`ALTER TABLE resources ADD UNIQUE (uuid)`,
+	)
+	// a NULL region refers to the main backend
+	m.Add(3,
+		`ALTER TABLE resources ADD COLUMN region text`,
+	)
+	m.Add(4,
+		`CREATE TABLE rotations (
+			resource     uuid PRIMARY KEY REFERENCES resources (uuid) ON DELETE CASCADE,
+			old_username text NOT NULL,
+			new_username text NOT NULL,
+			expires_at   timestamptz NOT NULL,
+			created_at   timestamptz NOT NULL DEFAULT now()
+		)`,
+	)
+	m.Add(5,
+		`ALTER TABLE resources ADD COLUMN expires_at timestamptz`,
+		`ALTER TABLE resources ADD COLUMN expiry_warned boolean NOT NULL DEFAULT false`,
+	)
+	m.Add(6,
+		`ALTER TABLE resources ADD COLUMN ttl_seconds double precision`,
+		`ALTER TABLE resources ADD COLUMN renewals integer NOT NULL DEFAULT 0`,
+	)
+	m.Add(7,
+		`ALTER TABLE resources ADD COLUMN tags text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE resources ADD COLUMN parent uuid`,
+		`CREATE INDEX ON resources USING gin (tags)`,
+	)
+	m.Add(8,
+		`ALTER TABLE resources ADD COLUMN app text NOT NULL DEFAULT ''`,
+		`ALTER TABLE resources ADD COLUMN env text NOT NULL DEFAULT ''`,
+		`ALTER TABLE resources ADD COLUMN comment text NOT NULL DEFAULT ''`,
+	)
+	m.Add(9,
+		`ALTER TABLE resources ADD COLUMN status text NOT NULL DEFAULT 'ready'
+			CHECK (status IN ('provisioning', 'ready', 'degraded', 'deleting', 'soft-deleted', 'failed'))`,
+		`ALTER TABLE resources ADD COLUMN status_message text NOT NULL DEFAULT ''`,
+		`ALTER TABLE resources ADD COLUMN status_changed_at timestamptz NOT NULL DEFAULT now()`,
+		`CREATE INDEX ON resources (status)`,
+	)
+	// only one job of each type may run for a resource at a time
+	m.Add(10,
+		`CREATE TABLE jobs (
+			id          uuid PRIMARY KEY,
+			type        text NOT NULL,
+			resource    text NOT NULL,
+			state       text NOT NULL CHECK (state IN ('running', 'succeeded', 'failed')),
+			error       text NOT NULL DEFAULT '',
+			created_at  timestamptz NOT NULL DEFAULT now(),
+			finished_at timestamptz
+		)`,
+		`CREATE UNIQUE INDEX ON jobs (type, resource) WHERE state = 'running'`,
+		`CREATE INDEX ON jobs (created_at)`,
+	)
+	m.Add(11,
+		`ALTER TABLE jobs DROP CONSTRAINT jobs_state_check`,
+		`ALTER TABLE jobs ADD CONSTRAINT jobs_state_check CHECK (state IN ('running', 'succeeded', 'failed', 'cancelled'))`,
+		`CREATE TABLE job_logs (
+			id      bigserial PRIMARY KEY,
+			job     uuid NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+			time    timestamptz NOT NULL DEFAULT now(),
+			message text NOT NULL
+		)`,
+		`CREATE INDEX ON job_logs (job)`,
+	)
+	m.Add(12,
+		`ALTER TABLE job_logs ADD COLUMN stage text NOT NULL DEFAULT ''`,
+	)
+	m.Add(13,
+		`CREATE TABLE operations (
+			id         bigserial PRIMARY KEY,
+			type       text NOT NULL,
+			succeeded  boolean NOT NULL,
+			duration   double precision NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now()
+		)`,
+		`CREATE INDEX ON operations (type, created_at)`,
+	)
+	m.Add(14,
+		`ALTER TABLE jobs DROP CONSTRAINT jobs_state_check`,
+		`ALTER TABLE jobs ADD CONSTRAINT jobs_state_check CHECK (state IN ('queued', 'running', 'succeeded', 'failed', 'cancelled'))`,
+		`DROP INDEX jobs_type_resource_idx`,
+		`CREATE UNIQUE INDEX ON jobs (type, resource) WHERE state IN ('queued', 'running')`,
+	)
+	m.Add(15,
+		`ALTER TABLE resources ADD COLUMN rotation_interval_seconds double precision`,
+		`ALTER TABLE resources ADD COLUMN rotation_overlap_seconds double precision`,
+		`ALTER TABLE resources ADD COLUMN rotated_at timestamptz`,
+	)
+	m.Add(16,
+		`CREATE TABLE extensions (
+			resource   uuid NOT NULL REFERENCES resources (uuid) ON DELETE CASCADE,
+			name       text NOT NULL,
+			version    text NOT NULL,
+			pinned     boolean NOT NULL DEFAULT false,
+			updated_at timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (resource, name)
+		)`,
+	)
+	m.Add(17,
+		`ALTER TABLE resources DROP CONSTRAINT resources_status_check`,
+		`ALTER TABLE resources ADD CONSTRAINT resources_status_check CHECK (status IN ('provisioning', 'ready', 'degraded', 'migrating', 'deleting', 'soft-deleted', 'failed'))`,
+	)
+	m.Add(18,
+		`CREATE TABLE publications (
+			resource   uuid NOT NULL REFERENCES resources (uuid) ON DELETE CASCADE,
+			name       text NOT NULL,
+			tables     text[] NOT NULL,
+			username   text NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (resource, name)
+		)`,
+	)
+	m.Add(19,
+		`CREATE TABLE slots (
+			resource   uuid NOT NULL REFERENCES resources (uuid) ON DELETE CASCADE,
+			name       text NOT NULL,
+			slot_name  text NOT NULL UNIQUE,
+			plugin     text NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (resource, name)
+		)`,
+	)
+	m.Add(20,
+		`ALTER TABLE resources ADD COLUMN tenant text`,
+		`CREATE INDEX resources_tenant_idx ON resources (tenant)`,
+		`CREATE TABLE tenant_quotas (
+			tenant        text PRIMARY KEY,
+			max_databases integer,
+			max_bytes     bigint,
+			updated_at    timestamptz NOT NULL DEFAULT now()
+		)`,
+	)
+	m.Add(21,
+		`CREATE TABLE api_keys (
+			id         uuid PRIMARY KEY,
+			name       text NOT NULL,
+			tenant     text,
+			key_hash   text NOT NULL UNIQUE,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			revoked_at timestamptz
+		)`,
+		`ALTER TABLE jobs ADD COLUMN tenant text`,
+	)
+	m.Add(22,
+		`ALTER TABLE api_keys ADD COLUMN role text NOT NULL DEFAULT 'operator' CHECK (role IN ('viewer', 'provisioner', 'operator'))`,
+	)
+	m.Add(23,
+		`ALTER TABLE resources ADD COLUMN created_by text`,
+		`ALTER TABLE jobs ADD COLUMN requester text`,
+	)
+	m.Add(24,
+		`CREATE TABLE snapshots (
+			resource    uuid NOT NULL REFERENCES resources (uuid) ON DELETE CASCADE,
+			name        text NOT NULL,
+			database    text NOT NULL UNIQUE,
+			description text NOT NULL DEFAULT '',
+			tags        text[] NOT NULL DEFAULT '{}',
+			size_bytes  bigint NOT NULL,
+			created_by  text,
+			created_at  timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (resource, name)
+		)`,
+	)
+	m.Add(25,
+		`CREATE TABLE provision_intents (
+			resource   uuid PRIMARY KEY REFERENCES resources (uuid) ON DELETE CASCADE,
+			created_at timestamptz NOT NULL DEFAULT now()
+		)`,
+	)
+	m.Add(26,
+		`CREATE TABLE archives (
+			database          text PRIMARY KEY,
+			original_database text NOT NULL,
+			resource_id       text NOT NULL,
+			region            text,
+			app               text NOT NULL DEFAULT '',
+			env               text NOT NULL DEFAULT '',
+			tenant            text,
+			tags              text[] NOT NULL DEFAULT '{}',
+			archived_by       text,
+			archived_at       timestamptz NOT NULL DEFAULT now(),
+			expires_at        timestamptz NOT NULL
+		)`,
+	)
+	m.Add(27,
+		`ALTER TABLE resources DROP CONSTRAINT resources_status_check`,
+		`ALTER TABLE resources ADD CONSTRAINT resources_status_check CHECK (status IN ('provisioning', 'ready', 'degraded', 'paused', 'migrating', 'deleting', 'soft-deleted', 'failed'))`,
+	)
+	m.Add(28,
+		`CREATE TABLE maintenance_windows (
+			resource         uuid UNIQUE REFERENCES resources (uuid) ON DELETE CASCADE,
+			tenant           text UNIQUE,
+			days             text[] NOT NULL DEFAULT '{}',
+			start_minute     integer NOT NULL,
+			duration_seconds integer NOT NULL,
+			updated_at       timestamptz NOT NULL DEFAULT now(),
+			CHECK ((resource IS NULL) <> (tenant IS NULL))
+		)`,
+		`CREATE TABLE scheduled_operations (
+			id         uuid PRIMARY KEY,
+			type       text NOT NULL,
+			resource   uuid NOT NULL REFERENCES resources (uuid) ON DELETE CASCADE,
+			params     text NOT NULL DEFAULT '{}',
+			tenant     text,
+			requester  text,
+			run_at     timestamptz NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			UNIQUE (resource, type)
+		)`,
+	)
+	m.Add(29,
+		`ALTER TABLE jobs ADD COLUMN params text`,
+		`ALTER TABLE jobs ADD COLUMN checkpointed_at timestamptz`,
+	)
+	// array_to_string isn't immutable, so can't be used in an index
+	// expression as is
+	m.Add(30,
+		`CREATE FUNCTION search_tags(tags text[]) RETURNS text
+LANGUAGE sql IMMUTABLE AS $$ SELECT coalesce(array_to_string(tags, ' '), '') $$`,
+		`CREATE INDEX resources_search ON resources USING gin (to_tsvector('simple', coalesce(database, '') || ' ' || coalesce(username, '') || ' ' || coalesce(app, '') || ' ' || coalesce(env, '') || ' ' || coalesce(comment, '') || ' ' || coalesce(tenant, '') || ' ' || coalesce(created_by, '') || ' ' || search_tags(tags)))`,
+	)
+	// nothing soft deletes resources, archived ones leave the table
+	m.Add(31,
+		`ALTER TABLE resources DROP CONSTRAINT resources_status_check`,
+		`ALTER TABLE resources ADD CONSTRAINT resources_status_check CHECK (status IN ('provisioning', 'ready', 'degraded', 'paused', 'migrating', 'deleting', 'failed'))`,
+	)
+	return m.Migrate(db)
+}
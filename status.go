@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// The lifecycle states of a resource. Resources are provisioning until their
+// database and role exist, ready or degraded while in use (as determined by
+// the health monitor), paused while connections are turned off, migrating
+// while being moved to another backend, deleting while being deprovisioned,
+// and failed if either of those didn't complete.
+const (
+	statusProvisioning = "provisioning"
+	statusReady        = "ready"
+	statusDegraded     = "degraded"
+	statusPaused       = "paused"
+	statusMigrating    = "migrating"
+	statusDeleting     = "deleting"
+	statusFailed       = "failed"
+)
+
+var validStatus = map[string]bool{
+	statusProvisioning: true,
+	statusReady:        true,
+	statusDegraded:     true,
+	statusPaused:       true,
+	statusMigrating:    true,
+	statusDeleting:     true,
+	statusFailed:       true,
+}
+
+// setStatus records a resource's status along with a message explaining it.
+func setStatus(state *postgres.DB, uuid, status, message string) error {
+	err := state.Exec(`UPDATE resources SET status = $1, status_message = $2, status_changed_at = now() WHERE uuid = $3`, status, redact(message), uuid)
+	if err != nil {
+		logger.Error("error setting resource status", "id", resourceID(uuid), "status", status, "err", err)
+	}
+	return err
+}
+
+// healthMonitor moves resources in use between ready and degraded, depending
+// on whether their database and role exist, and the database accepts
+// connections and is writable.
+type healthMonitor struct {
+	state    *postgres.DB
+	backends *backendSet
+}
+
+func (m *healthMonitor) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, b := range m.backends.all() {
+			if err := m.check(b); err != nil {
+				logger.Error("error checking resource health", "backend", b.name, "err", err)
+			}
+		}
+	}
+}
+
+type healthStatus struct {
+	uuid     string
+	database string
+	username string
+	status   string
+	message  string
+	enforced bool
+}
+
+func (m *healthMonitor) check(b *backend) error {
+	rows, err := m.state.Query(`
+SELECT uuid, database, username, status, status_message, quota_enforced FROM resources
+WHERE status IN ('ready', 'degraded') AND coalesce(region, $1) = $2`, m.backends.main.region, b.region)
+	if err != nil {
+		return err
+	}
+	var resources []*healthStatus
+	for rows.Next() {
+		r := &healthStatus{}
+		if err := rows.Scan(&r.uuid, &r.database, &r.username, &r.status, &r.message, &r.enforced); err != nil {
+			rows.Close()
+			return err
+		}
+		resources = append(resources, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = b.db.Query(`SELECT datname::text, datallowconn FROM pg_database`)
+	if err != nil {
+		return err
+	}
+	allowConn := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var allow bool
+		if err := rows.Scan(&name, &allow); err != nil {
+			rows.Close()
+			return err
+		}
+		allowConn[name] = allow
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	roles, err := backendRoles(b)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range resources {
+		status, message := statusReady, ""
+		if allow, ok := allowConn[r.database]; !ok {
+			status, message = statusDegraded, "the database does not exist"
+		} else if _, ok := roles[r.username]; !ok {
+			status, message = statusDegraded, "the role does not exist"
+		} else if !allow {
+			status, message = statusDegraded, "the database does not allow connections"
+		} else if r.enforced {
+			status, message = statusDegraded, "the database is over quota and read-only"
+		}
+		if status == r.status && message == r.message {
+			continue
+		}
+		// don't overwrite a status set since the resources were read
+		if err := m.state.Exec(`UPDATE resources SET status = $1, status_message = $2, status_changed_at = now() WHERE uuid = $3 AND status IN ('ready', 'degraded')`,
+			status, message, r.uuid); err != nil {
+			logger.Error("error setting resource status", "database", r.database, "err", err)
+			continue
+		}
+		if status != r.status {
+			notify("resource."+status, map[string]interface{}{
+				"id":       resourceID(r.uuid),
+				"database": r.database,
+				"message":  message,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// tenancyScaffold is run in a new database, as its owner, to help apps
+// isolate their tenants' rows with row level security. Tables with a
+// tenant_id column are enrolled with SELECT tenancy.enable('table'), after
+// which sessions of roles other than the owner only see and write rows
+// matching the app.tenant_id setting, e.g. SET app.tenant_id = '42'.
+var tenancyScaffold = []string{
+	`CREATE SCHEMA tenancy`,
+	`CREATE FUNCTION tenancy.current_tenant() RETURNS text
+LANGUAGE sql STABLE AS $$ SELECT nullif(current_setting('app.tenant_id', true), '') $$`,
+	`CREATE FUNCTION tenancy.enable(tbl regclass) RETURNS void
+LANGUAGE plpgsql AS $$
+BEGIN
+  EXECUTE format('ALTER TABLE %s ENABLE ROW LEVEL SECURITY', tbl);
+  EXECUTE format('CREATE POLICY tenant_isolation ON %s USING (tenant_id::text = tenancy.current_tenant()) WITH CHECK (tenant_id::text = tenancy.current_tenant())', tbl);
+END $$`,
+	`REVOKE ALL ON FUNCTION tenancy.enable(regclass) FROM PUBLIC`,
+}
+
+// tenantUsername returns the name of a database's tenant scoped login role.
+func tenantUsername(database string) string {
+	return suffixedName(database, "_app")
+}
+
+// createTenancy sets up the row level security scaffold in a new database,
+// owned by owner, and a login role for the app which is a member of the
+// readwrite access role. Unlike the owner, the role is subject to the
+// tenant isolation policies, and can't alter them.
+func createTenancy(b *backend, database, owner, password string, validUntil *time.Time) error {
+	conn, err := pgx.Connect(b.connConfig(database))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// create the objects as the owner so that it can manage them
+	if _, err := tx.Exec(fmt.Sprintf(`SET LOCAL ROLE "%s"`, owner)); err != nil {
+		return err
+	}
+	for _, stmt := range tenancyScaffold {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	_, rw := accessRoleNames(database)
+	return createMemberUser(b, tenantUsername(database), password, rw, validUntil)
+}
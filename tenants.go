@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var validTenant = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// forbiddenCode is the error code of requests refused with 403, which
+// httphelper has no code for.
+const forbiddenCode httphelper.ErrorCode = "forbidden"
+
+// tenantQuota is a tenant's usage and limits. A zero limit is unlimited.
+type tenantQuota struct {
+	Tenant       string `json:"tenant"`
+	Databases    int    `json:"databases"`
+	MaxDatabases int    `json:"max_databases"`
+	SizeBytes    int64  `json:"size_bytes"`
+	MaxSizeBytes int64  `json:"max_size_bytes"`
+}
+
+// loadTenantQuota reads a tenant's limits, which default to
+// TENANT_MAX_DATABASES and TENANT_MAX_SIZE, and counts its databases.
+func loadTenantQuota(q rowQueryer, tenant string) (*tenantQuota, error) {
+	t := &tenantQuota{Tenant: tenant, MaxDatabases: tenantMaxDatabases, MaxSizeBytes: tenantMaxSize}
+	var maxDatabases *int
+	var maxSize *int64
+	err := q.QueryRow(`SELECT max_databases, max_bytes FROM tenant_quotas WHERE tenant = $1`, tenant).Scan(&maxDatabases, &maxSize)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	if maxDatabases != nil {
+		t.MaxDatabases = *maxDatabases
+	}
+	if maxSize != nil {
+		t.MaxSizeBytes = *maxSize
+	}
+	if err := q.QueryRow(`SELECT count(*)::integer FROM resources WHERE tenant = $1 AND status <> 'failed'`, tenant).Scan(&t.Databases); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// measureTenantSize adds up the sizes of a tenant's databases on their
+// backends.
+func measureTenantSize(state *postgres.DB, backends *backendSet, t *tenantQuota) error {
+	rows, err := state.Query(`SELECT database, region FROM resources WHERE tenant = $1 AND status NOT IN ('provisioning', 'failed')`, t.Tenant)
+	if err != nil {
+		return err
+	}
+	type located struct {
+		database string
+		backend  *backend
+	}
+	var databases []located
+	for rows.Next() {
+		var l located
+		var region *string
+		if err := rows.Scan(&l.database, &region); err != nil {
+			rows.Close()
+			return err
+		}
+		if l.backend, err = backends.forRegion(region); err != nil {
+			rows.Close()
+			return err
+		}
+		databases = append(databases, l)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	t.SizeBytes = 0
+	for _, l := range databases {
+		var size *int64
+		if err := l.backend.db.QueryRow(`SELECT pg_database_size(datname) FROM pg_database WHERE datname = $1`, l.database).Scan(&size); err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		if size != nil {
+			t.SizeBytes += *size
+		}
+	}
+	return nil
+}
+
+// errTenantQuota returns the error refusing a provision which would take a
+// tenant over its quota, with its usage and limits as the detail.
+func errTenantQuota(t *tenantQuota, msg string) error {
+	detail, _ := json.Marshal(t)
+	return httphelper.JSONError{Code: forbiddenCode, Message: fmt.Sprintf("tenant %s %s", t.Tenant, msg), Detail: detail}
+}
+
+// checkTenantSize refuses provisioning for a tenant whose databases have
+// reached its size limit. The number of databases is checked as the
+// resource is recorded, so concurrent provisions can't exceed it.
+func (p *pgAPI) checkTenantSize(tenant string) error {
+	t, err := loadTenantQuota(p.state, tenant)
+	if err != nil || t.MaxSizeBytes == 0 {
+		return err
+	}
+	if err := measureTenantSize(p.state, p.backends, t); err != nil {
+		return err
+	}
+	if t.SizeBytes >= t.MaxSizeBytes {
+		return errTenantQuota(t, "has reached its size quota")
+	}
+	return nil
+}
+
+// provisionError writes an error returned while provisioning, using 403
+// for tenant quotas.
+func provisionError(w http.ResponseWriter, err error) {
+	if e, ok := err.(httphelper.JSONError); ok && e.Code == forbiddenCode {
+		httphelper.JSON(w, 403, e)
+		return
+	}
+	httphelper.Error(w, err)
+}
+
+// getTenantQuota returns a tenant's usage and limits. Tenant scoped API keys
+// can only read their own.
+func (p *pgAPI) getTenantQuota(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	tenant := params.ByName("id")
+	if !callerFromContext(ctx).sees(tenant) {
+		httphelper.JSON(w, 403, httphelper.JSONError{Code: forbiddenCode, Message: "the API key can only read the quota of tenant " + callerTenant(ctx)})
+		return
+	}
+	t, err := loadTenantQuota(p.state, tenant)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := measureTenantSize(p.state, p.backends, t); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, t)
+}
+
+type tenantQuotaRequest struct {
+	MaxDatabases *int    `json:"max_databases"`
+	MaxSize      *string `json:"max_size"`
+}
+
+// setTenantQuota overrides a tenant's limits. Limits left out revert to the
+// defaults, and "0" is unlimited.
+func (p *pgAPI) setTenantQuota(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	tenant := params.ByName("id")
+	if !validTenant.MatchString(tenant) {
+		httphelper.ValidationError(w, "id", "must be lowercase letters, digits, dashes and underscores")
+		return
+	}
+	var config tenantQuotaRequest
+	if err := httphelper.DecodeJSON(req, &config); err != nil && err != io.EOF {
+		httphelper.Error(w, err)
+		return
+	}
+	if config.MaxDatabases != nil && *config.MaxDatabases < 0 {
+		httphelper.ValidationError(w, "max_databases", "must not be negative")
+		return
+	}
+	var maxSize *int64
+	if config.MaxSize != nil {
+		var n int64
+		if *config.MaxSize != "0" {
+			var err error
+			if n, err = parseSize(*config.MaxSize); err != nil {
+				httphelper.ValidationError(w, "max_size", "is invalid")
+				return
+			}
+		}
+		maxSize = &n
+	}
+	err := p.state.Exec(`
+INSERT INTO tenant_quotas (tenant, max_databases, max_bytes) VALUES ($1, $2, $3)
+ON CONFLICT (tenant) DO UPDATE SET max_databases = $2, max_bytes = $3, updated_at = now()`, tenant, config.MaxDatabases, maxSize)
+	audit(requestOrigin(ctx, req), securityAdmin, "set_tenant_quota", tenant, err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	p.getTenantQuota(ctx, w, req)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// tlsConfig returns the TLS configuration for connecting to the backend
+// according to PGSSLMODE, with the same meaning as in libpq. fallback
+// indicates whether a plaintext connection may be used if TLS fails.
+func (b *backend) tlsConfig() (conf *tls.Config, fallback bool) {
+	host, _ := b.addr()
+	if isSocket(host) {
+		// TLS isn't supported over Unix sockets
+		return nil, false
+	}
+	switch servicePgSSL {
+	case "disable":
+		return nil, false
+	case "allow", "prefer":
+		return &tls.Config{InsecureSkipVerify: true}, true
+	case "require":
+		return &tls.Config{InsecureSkipVerify: true}, false
+	case "verify-ca":
+		// verify the chain but not the hostname, which crypto/tls doesn't
+		// support directly
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyChain(rawCerts, "")
+			},
+		}, false
+	default: // verify-full
+		if b.discover == nil {
+			return &tls.Config{ServerName: host, RootCAs: rootCertPool}, false
+		}
+		// the config outlives the discovered address, so check the
+		// hostname against the address actually dialed
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				host, _ := b.addr()
+				return verifyChain(rawCerts, host)
+			},
+		}, false
+	}
+}
+
+// verifyChain verifies the certificate chain presented by the server against
+// PGSSLROOTCERT (or the system roots), and the hostname unless it is empty.
+func verifyChain(rawCerts [][]byte, host string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("tls: server presented no certificates")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{DNSName: host, Roots: rootCertPool, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// appSSLMode is the sslmode apps should use to connect to the backend.
+func (b *backend) appSSLMode() string {
+	if host, _ := b.appAddr(); isSocket(host) {
+		return "disable"
+	}
+	return servicePgSSL
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// vault is where scheduled rotations store new credentials, nil unless
+// VAULT_ADDR is set.
+var vault *vaultClient
+
+// vaultClient writes secrets to a Vault KV version 2 secrets engine over
+// its HTTP API.
+type vaultClient struct {
+	addr   string
+	token  string
+	mount  string
+	prefix string
+	client *http.Client
+}
+
+func newVaultClient(addr, token, mount, prefix string) (*vaultClient, error) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return nil, fmt.Errorf("VAULT_ADDR must be an http or https URL")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN must be set with VAULT_ADDR")
+	}
+	if mount == "" {
+		mount = "secret"
+	}
+	if prefix == "" {
+		prefix = "pg-external"
+	}
+	registerSecret(token)
+	return &vaultClient{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		mount:  strings.Trim(mount, "/"),
+		prefix: strings.Trim(prefix, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// write stores data as a new version of the secret name, returning its path.
+func (v *vaultClient) write(name string, data map[string]string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return "", err
+	}
+	res, err := v.do("POST", "data/"+v.prefix+"/"+name, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return v.secretPath(name), nil
+}
+
+// read returns the latest version of the secret name, nil if there isn't one.
+func (v *vaultClient) read(name string) (map[string]string, error) {
+	res, err := v.do("GET", "data/"+v.prefix+"/"+name, nil)
+	if err == errVaultNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var secret struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	return secret.Data.Data, nil
+}
+
+// delete deletes the latest version of the secret name.
+func (v *vaultClient) delete(name string) error {
+	res, err := v.do("DELETE", "data/"+v.prefix+"/"+name, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (v *vaultClient) secretPath(name string) string {
+	return v.mount + "/" + v.prefix + "/" + name
+}
+
+var errVaultNotFound = errors.New("secret not found in vault")
+
+func (v *vaultClient) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s/%s", v.addr, v.mount, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == 404 {
+		res.Body.Close()
+		return nil, errVaultNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d from vault", res.StatusCode)
+	}
+	return res, nil
+}
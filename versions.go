@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// Versions of the resource returned when provisioning. Version 1 is the
+// Flynn resource contract, only the id and env, and version 2 adds meta.
+const (
+	resourceVersionLegacy = 1
+	resourceVersionMeta   = 2
+	maxResourceVersion    = resourceVersionMeta
+)
+
+// resourceMediaType is the media type clients request a resource version
+// with, e.g. Accept: application/vnd.pg-external.v2+json.
+var resourceMediaType = regexp.MustCompile(`^application/vnd\.pg-external\.v([0-9]+)\+json$`)
+
+// resourceMediaTypeFor returns the media type of a resource version.
+func resourceMediaTypeFor(version int) string {
+	return fmt.Sprintf("application/vnd.pg-external.v%d+json", version)
+}
+
+// negotiateResource returns the resource version to respond to a provision
+// request with: the highest supported one named in the Accept header, or
+// RESOURCE_RESPONSE_VERSION if it doesn't name any. If it only names
+// unsupported versions, a 406 response is written and ok is false. This is
+// checked before provisioning so that a database isn't created for a
+// response the client can't read.
+func negotiateResource(w http.ResponseWriter, req *http.Request) (version int, ok bool) {
+	var requested []string
+	for _, accept := range req.Header["Accept"] {
+		for _, typ := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(typ))
+			if err != nil {
+				continue
+			}
+			m := resourceMediaType.FindStringSubmatch(mediaType)
+			if m == nil {
+				continue
+			}
+			requested = append(requested, mediaType)
+			if v, err := strconv.Atoi(m[1]); err == nil && v >= resourceVersionLegacy && v <= maxResourceVersion && v > version {
+				version = v
+			}
+		}
+	}
+	if version > 0 {
+		return version, true
+	}
+	if len(requested) > 0 {
+		httphelper.JSON(w, 406, httphelper.JSONError{
+			Code:    "not_acceptable",
+			Message: fmt.Sprintf("none of %s are supported, the latest version is %s", strings.Join(requested, ", "), resourceMediaTypeFor(maxResourceVersion)),
+		})
+		return 0, false
+	}
+	return resourceResponseVersion, true
+}
+
+// writeResource responds with a provisioned resource in the given version.
+// Version 1 is encoded exactly as Flynn's own providers do.
+func writeResource(w http.ResponseWriter, version int, res *resourceResponse) {
+	if version == resourceVersionLegacy {
+		httphelper.JSON(w, 200, &res.Resource)
+		return
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", resourceMediaTypeFor(version))
+	w.WriteHeader(200)
+	w.Write(data)
+}
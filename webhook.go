@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify posts an event to WEBHOOK_URL in the background. Delivery is best
+// effort, failures are only logged.
+func notify(event string, data map[string]interface{}) {
+	if webhookURL == "" {
+		return
+	}
+	body, err := webhookPayload(event, data)
+	if err != nil {
+		logger.Error("error encoding webhook", "event", event, "err", err)
+		return
+	}
+	go func() {
+		if err := postWebhook(body); err != nil {
+			logger.Error("error delivering webhook", "event", event, "err", err)
+		}
+	}()
+}
+
+// notifySync posts an event to WEBHOOK_URL and waits for it to be accepted,
+// for events whose delivery matters.
+func notifySync(event string, data map[string]interface{}) error {
+	if webhookURL == "" {
+		return fmt.Errorf("WEBHOOK_URL is not set")
+	}
+	body, err := webhookPayload(event, data)
+	if err != nil {
+		return err
+	}
+	return postWebhook(body)
+}
+
+func webhookPayload(event string, data map[string]interface{}) ([]byte, error) {
+	payload := map[string]interface{}{
+		"event": event,
+		"time":  time.Now().UTC(),
+	}
+	for k, v := range data {
+		payload[k] = v
+	}
+	return json.Marshal(payload)
+}
+
+func postWebhook(body []byte) error {
+	res, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}